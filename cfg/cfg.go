@@ -0,0 +1,232 @@
+// Package cfg builds control-flow graphs of compiled bytecode and runs the classic analyses over them:
+// dominators and the liveness of local slots. A graph can be exported in the DOT format of Graphviz.
+package cfg
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/taimats/sarupiler/code"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// Block is a basic block: the instructions from Start up to End, which run one after another.
+type Block struct {
+	Index int
+	Start int
+	End   int
+	Succs []*Block
+	Preds []*Block
+	Throw *Block //Throw is the handler that an exception raised in the block goes to, if any.
+}
+
+// Graph is the control-flow graph of a sequence of instructions.
+type Graph struct {
+	Instructions code.Instructions
+	Blocks       []*Block //Blocks are sorted by their start.
+	Entries      []*Block //Entries are the blocks where execution can start, Blocks[0] first.
+}
+
+// jumps are the instructions which take the position they jump to as their first operand.
+var jumps = map[code.Opcode]bool{
+	code.OpJump:                  true,
+	code.OpJumpNotTruthy:         true,
+	code.OpJumpUnlessGreaterThan: true,
+	code.OpJumpUnlessEqual:       true,
+	code.OpJumpUnlessNotEqual:    true,
+}
+
+// exits are the instructions after which control never goes on with the next one.
+var exits = map[code.Opcode]bool{
+	code.OpJump:        true,
+	code.OpReturnValue: true,
+	code.OpReturn:      true,
+	code.OpThrow:       true,
+}
+
+// ends are the instructions which end a block although control may go on with the next one. A tail call
+// of a closure takes over the frame and never comes back, but a tail call of any other callee runs as a
+// plain call.
+var ends = map[code.Opcode]bool{
+	code.OpTailCall: true,
+}
+
+// instruction is a decoded instruction at a position.
+type instruction struct {
+	pos      int
+	op       code.Opcode
+	operands []int
+	next     int
+}
+
+func decode(ins code.Instructions) ([]instruction, error) {
+	var decoded []instruction
+	for pos := 0; pos < len(ins); {
+		def, err := code.Lookup(ins[pos])
+		if err != nil {
+			return nil, fmt.Errorf("at %04d: %w", pos, err)
+		}
+		operands, n := code.ReadOperands(def, ins[pos+1:])
+		decoded = append(decoded, instruction{pos: pos, op: code.Opcode(ins[pos]), operands: operands, next: pos + 1 + n})
+		pos += 1 + n
+	}
+	return decoded, nil
+}
+
+// New builds the graph of the instructions of a main program guarded by handlers.
+func New(ins code.Instructions, handlers []obj.Handler) (*Graph, error) {
+	return build(ins, handlers, nil)
+}
+
+// NewWithFunction builds the graph of a compiled function. Each entry of a function with default
+// parameter values starts a block, which is one of the entries of the graph.
+func NewWithFunction(fn *obj.CompiledFunction) (*Graph, error) {
+	return build(fn.Instructions, fn.Handlers, fn.Entries)
+}
+
+func build(ins code.Instructions, handlers []obj.Handler, entries []int) (*Graph, error) {
+	decoded, err := decode(ins)
+	if err != nil {
+		return nil, err
+	}
+	//A block starts at the first instruction, at every jump target and entry, after every jump, exit and end,
+	//and at the bounds of the ranges guarded by handlers, so that only whole blocks throw to a handler.
+	leaders := map[int]bool{0: true}
+	for _, in := range decoded {
+		if jumps[in.op] {
+			leaders[in.operands[0]] = true
+		}
+		if jumps[in.op] || exits[in.op] || ends[in.op] {
+			leaders[in.next] = true
+		}
+	}
+	for _, h := range handlers {
+		leaders[h.Start], leaders[h.End], leaders[h.Target] = true, true, true
+	}
+	for _, e := range entries {
+		leaders[e] = true
+	}
+	starts := make([]int, 0, len(leaders))
+	for pos := range leaders {
+		if pos < len(ins) {
+			starts = append(starts, pos)
+		}
+	}
+	slices.Sort(starts)
+
+	g := &Graph{Instructions: ins}
+	byStart := make(map[int]*Block, len(starts))
+	for i, start := range starts {
+		end := len(ins)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		b := &Block{Index: i, Start: start, End: end}
+		g.Blocks = append(g.Blocks, b)
+		byStart[start] = b
+	}
+	if len(g.Blocks) == 0 {
+		g.Blocks = []*Block{{}}
+		byStart[0] = g.Blocks[0]
+	}
+	g.Entries = []*Block{g.Blocks[0]}
+	for _, e := range entries {
+		if b := byStart[e]; b != nil && !slices.Contains(g.Entries, b) {
+			g.Entries = append(g.Entries, b)
+		}
+	}
+
+	link := func(from *Block, to int) {
+		if b := byStart[to]; b != nil && !slices.Contains(from.Succs, b) {
+			from.Succs = append(from.Succs, b)
+			b.Preds = append(b.Preds, from)
+		}
+	}
+	for _, b := range g.Blocks {
+		last, ok := lastInstruction(decoded, b)
+		if !ok {
+			continue
+		}
+		if !exits[last.op] {
+			link(b, b.End)
+		}
+		if jumps[last.op] {
+			link(b, last.operands[0])
+		}
+		for _, h := range handlers {
+			if h.Start <= b.Start && b.End <= h.End {
+				b.Throw = byStart[h.Target]
+				link(b, h.Target)
+			}
+		}
+	}
+	return g, nil
+}
+
+func lastInstruction(decoded []instruction, b *Block) (instruction, bool) {
+	i, found := slices.BinarySearchFunc(decoded, b.End, func(in instruction, end int) int {
+		return in.next - end
+	})
+	if !found || decoded[i].pos < b.Start {
+		return instruction{}, false
+	}
+	return decoded[i], true
+}
+
+// BlockAt returns the block containing the instruction at pos.
+func (g *Graph) BlockAt(pos int) *Block {
+	i, _ := slices.BinarySearchFunc(g.Blocks, pos, func(b *Block, pos int) int {
+		if pos < b.Start {
+			return 1
+		}
+		if pos >= b.End {
+			return -1
+		}
+		return 0
+	})
+	if i == len(g.Blocks) {
+		return nil
+	}
+	return g.Blocks[i]
+}
+
+// Reachable returns the blocks reachable from the entries, sorted by their start.
+func (g *Graph) Reachable() []*Block {
+	seen := make([]bool, len(g.Blocks))
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		if seen[b.Index] {
+			return
+		}
+		seen[b.Index] = true
+		for _, s := range b.Succs {
+			visit(s)
+		}
+	}
+	for _, e := range g.Entries {
+		visit(e)
+	}
+	var blocks []*Block
+	for _, b := range g.Blocks {
+		if seen[b.Index] {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// Disassemble returns the instructions of b, one per line, with their positions in the whole sequence.
+func (g *Graph) Disassemble(b *Block) string {
+	var out strings.Builder
+	decoded, _ := decode(g.Instructions[b.Start:b.End])
+	for _, in := range decoded {
+		def, _ := code.Lookup(byte(in.op))
+		fmt.Fprintf(&out, "%04d %s", b.Start+in.pos, def.Name)
+		for _, o := range in.operands {
+			fmt.Fprintf(&out, " %d", o)
+		}
+		out.WriteString("\n")
+	}
+	return out.String()
+}
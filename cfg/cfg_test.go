@@ -0,0 +1,161 @@
+package cfg_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taimats/sarupiler/cfg"
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/compiler"
+	"github.com/taimats/sarupiler/monkey/lexer"
+	"github.com/taimats/sarupiler/monkey/parser"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// graph compiles input and returns the graph of the function it ends with.
+func graph(t *testing.T, input string) *cfg.Graph {
+	t.Helper()
+	comp := compiler.New()
+	err := comp.Compile(parser.New(lexer.New(input)).ParseProgram())
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	constants := comp.Bytecode().Constants
+	g, err := cfg.NewWithFunction(constants[len(constants)-1].(*obj.CompiledFunction))
+	if err != nil {
+		t.Fatalf("failed to build the graph: (error: %s)", err)
+	}
+	return g
+}
+
+type blockWant struct {
+	start, end int
+	succs      []int
+	idom       int //idom is -1 for no immediate dominator.
+	liveIn     []int
+	liveOut    []int
+}
+
+func assertBlocks(t *testing.T, g *cfg.Graph, want []blockWant) {
+	t.Helper()
+	a := assert.New(t)
+	if !a.Len(g.Blocks, len(want)) {
+		return
+	}
+	dom := g.Dominators()
+	live := g.Liveness()
+	for i, w := range want {
+		b := g.Blocks[i]
+		a.Equal(w.start, b.Start, "start of b%d", i)
+		a.Equal(w.end, b.End, "end of b%d", i)
+		var succs []int
+		for _, s := range b.Succs {
+			succs = append(succs, s.Index)
+		}
+		a.Equal(w.succs, succs, "succs of b%d", i)
+		idom := -1
+		if d := dom.IDom(b); d != nil {
+			idom = d.Index
+		}
+		a.Equal(w.idom, idom, "idom of b%d", i)
+		a.Equal(w.liveIn, live.In[i].Slice(), "live in of b%d", i)
+		a.Equal(w.liveOut, live.Out[i].Slice(), "live out of b%d", i)
+	}
+}
+
+func TestIf(t *testing.T) {
+	g := graph(t, `fn(x) { if (x > 1) { let y = x + 1; y } else { 0 } }`)
+	assertBlocks(t, g, []blockWant{
+		{0, 8, []int{1, 2}, -1, []int{0}, []int{0}},
+		{8, 19, []int{3}, 0, []int{0}, nil},
+		{19, 22, []int{3}, 0, nil, nil},
+		{22, 23, nil, 0, nil, nil},
+	})
+	dom := g.Dominators()
+	assert.True(t, dom.Dominates(g.Blocks[0], g.Blocks[3]))
+	assert.True(t, dom.Dominates(g.Blocks[3], g.Blocks[3]))
+	assert.False(t, dom.Dominates(g.Blocks[1], g.Blocks[3]))
+	assert.Equal(t, g.Blocks[1], g.BlockAt(12))
+	assert.Equal(t, "0019 OpConstant 2\n", g.Disassemble(g.Blocks[2]))
+}
+
+func TestTailCall(t *testing.T) {
+	//A tail call of a builtin goes on with the next instruction, so the jump after it is reachable.
+	g := graph(t, `fn(f, x) { if (x) { f(x) } else { 0 } }`)
+	assertBlocks(t, g, []blockWant{
+		{0, 5, []int{1, 3}, -1, []int{0, 1}, []int{0, 1}},
+		{5, 11, []int{2}, 0, []int{0, 1}, nil},
+		{11, 14, []int{4}, 1, nil, nil},
+		{14, 17, []int{4}, 0, nil, nil},
+		{17, 18, nil, 0, nil, nil},
+	})
+	assert.Len(t, g.Reachable(), 5)
+}
+
+func TestHandlers(t *testing.T) {
+	g := graph(t, `fn(f) { let a = 1; try(fn() { f() }, fn(e) { e + a }) }`)
+	assertBlocks(t, g, []blockWant{
+		{0, 11, []int{1}, -1, []int{0}, []int{1}},
+		{11, 13, []int{2, 3}, 0, []int{1}, []int{1}},
+		{13, 16, []int{4}, 1, nil, nil},
+		{16, 28, []int{4}, 1, []int{1}, nil},
+		{28, 29, nil, 1, nil, nil},
+	})
+	assert.Equal(t, g.Blocks[3], g.Blocks[1].Throw)
+	assert.Nil(t, g.Blocks[2].Throw)
+}
+
+func TestEntries(t *testing.T) {
+	g := graph(t, `params(fn(a, b) { a + b }, {"b": 2})`)
+	assertBlocks(t, g, []blockWant{
+		{0, 5, []int{1}, -1, []int{0}, []int{0, 1}},
+		{5, 11, nil, -1, []int{0, 1}, nil},
+	})
+	assert.Equal(t, g.Blocks, g.Entries)
+}
+
+func TestMainProgram(t *testing.T) {
+	ins := code.Instructions{}
+	for _, i := range [][]byte{
+		code.Make(code.OpTrue),
+		code.Make(code.OpJumpNotTruthy, 6),
+		code.Make(code.OpNull),
+		code.Make(code.OpPop),
+		code.Make(code.OpFalse),
+		code.Make(code.OpPop),
+	} {
+		ins = append(ins, i...)
+	}
+	g, err := cfg.New(ins, nil)
+	if err != nil {
+		t.Fatalf("failed to build the graph: (error: %s)", err)
+	}
+	assertBlocks(t, g, []blockWant{
+		{0, 4, []int{1, 2}, -1, nil, nil},
+		{4, 6, []int{2}, 0, nil, nil},
+		{6, 8, nil, 0, nil, nil},
+	})
+	assert.Len(t, g.Reachable(), 3)
+
+	_, err = cfg.New(code.Instructions{255}, nil)
+	assert.EqualError(t, err, "at 0000: opcode 255 undefined")
+}
+
+func TestDOT(t *testing.T) {
+	g := graph(t, `fn(x) { if (x > 1) { let y = x + 1; y } else { 0 } }`)
+	assert.Equal(t, `digraph "f" {
+	node [shape=box, fontname="monospace"];
+	b0 [label="b0\l0000 OpGetLocal 0\l0002 OpConstant 0\l0005 OpJumpUnlessGreaterThan 19\l", style=bold];
+	b1 [label="b1\l0008 OpAddLocalConstant 0 1\l0012 OpSetLocal 1\l0014 OpGetLocal 1\l0016 OpJump 22\l"];
+	b2 [label="b2\l0019 OpConstant 2\l"];
+	b3 [label="b3\l0022 OpReturnValue\l"];
+	b0 -> b1;
+	b0 -> b2 [label="false"];
+	b1 -> b3;
+	b2 -> b3;
+}
+`, g.DOT("f"))
+
+	g = graph(t, `fn(f) { try(fn() { f() }, fn(e) { e }) }`)
+	assert.Contains(t, g.DOT("try"), "b1 -> b3 [style=dashed, label=\"throw\"];")
+}
@@ -0,0 +1,112 @@
+package cfg
+
+// Dominators is the dominator tree of a graph. A block dominates another one if every path from an entry
+// to the other block goes through it.
+type Dominators struct {
+	idom []*Block
+	g    *Graph
+}
+
+// Dominators computes the dominator tree with the algorithm of Cooper, Harvey and Kennedy. The entries
+// hang off a virtual root, so that a block reached from several entries is dominated by none of them.
+func (g *Graph) Dominators() *Dominators {
+	n := len(g.Blocks)
+	root := n
+	succs := func(i int) []*Block {
+		if i == root {
+			return g.Entries
+		}
+		return g.Blocks[i].Succs
+	}
+	preds := make([][]int, n)
+	for _, b := range g.Blocks {
+		for _, p := range b.Preds {
+			preds[b.Index] = append(preds[b.Index], p.Index)
+		}
+	}
+	for _, e := range g.Entries {
+		preds[e.Index] = append(preds[e.Index], root)
+	}
+
+	//Number the blocks in postorder, visiting them depth-first from the root.
+	order := make([]int, n+1)
+	for i := range order {
+		order[i] = -1
+	}
+	var postorder []int
+	seen := make([]bool, n+1)
+	var visit func(i int)
+	visit = func(i int) {
+		seen[i] = true
+		for _, s := range succs(i) {
+			if !seen[s.Index] {
+				visit(s.Index)
+			}
+		}
+		order[i] = len(postorder)
+		postorder = append(postorder, i)
+	}
+	visit(root)
+
+	idom := make([]int, n+1)
+	for i := range idom {
+		idom[i] = -1
+	}
+	idom[root] = root
+	intersect := func(a, b int) int {
+		for a != b {
+			for order[a] < order[b] {
+				a = idom[a]
+			}
+			for order[b] < order[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(postorder) - 2; i >= 0; i-- {
+			b := postorder[i]
+			dom := -1
+			for _, p := range preds[b] {
+				if idom[p] == -1 {
+					continue
+				}
+				if dom == -1 {
+					dom = p
+				} else {
+					dom = intersect(p, dom)
+				}
+			}
+			if idom[b] != dom {
+				idom[b] = dom
+				changed = true
+			}
+		}
+	}
+
+	d := &Dominators{idom: make([]*Block, n), g: g}
+	for i := range n {
+		if idom[i] != -1 && idom[i] != root {
+			d.idom[i] = g.Blocks[idom[i]]
+		}
+	}
+	return d
+}
+
+// IDom returns the immediate dominator of b, or nil if b is an entry, is reached from several entries
+// without a common dominator, or is unreachable.
+func (d *Dominators) IDom(b *Block) *Block {
+	return d.idom[b.Index]
+}
+
+// Dominates reports whether a dominates b. Every block dominates itself.
+func (d *Dominators) Dominates(a, b *Block) bool {
+	for ; b != nil; b = d.idom[b.Index] {
+		if a == b {
+			return true
+		}
+	}
+	return false
+}
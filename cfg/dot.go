@@ -0,0 +1,42 @@
+package cfg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DOT returns the graph in the DOT format of Graphviz, with the instructions of each block as its label.
+// Entries are drawn bold, the edges of failed conditions are labeled false, and the edges to exception
+// handlers are dashed.
+func (g *Graph) DOT(name string) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "digraph %q {\n", name)
+	out.WriteString("\tnode [shape=box, fontname=\"monospace\"];\n")
+	for _, b := range g.Blocks {
+		label := fmt.Sprintf("b%d\n%s", b.Index, g.Disassemble(b))
+		label = strings.ReplaceAll(strings.ReplaceAll(label, `\`, `\\`), "\n", `\l`)
+		style := ""
+		for _, e := range g.Entries {
+			if e == b {
+				style = ", style=bold"
+			}
+		}
+		fmt.Fprintf(&out, "\tb%d [label=\"%s\"%s];\n", b.Index, label, style)
+	}
+	for _, b := range g.Blocks {
+		decoded, _ := decode(g.Instructions[b.Start:b.End])
+		conditional := len(decoded) > 0 && jumps[decoded[len(decoded)-1].op] && !exits[decoded[len(decoded)-1].op]
+		for _, s := range b.Succs {
+			attrs := ""
+			switch {
+			case s == b.Throw:
+				attrs = " [style=dashed, label=\"throw\"]"
+			case conditional && s.Start != b.End:
+				attrs = " [label=\"false\"]"
+			}
+			fmt.Fprintf(&out, "\tb%d -> b%d%s;\n", b.Index, s.Index, attrs)
+		}
+	}
+	out.WriteString("}\n")
+	return out.String()
+}
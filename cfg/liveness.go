@@ -0,0 +1,88 @@
+package cfg
+
+import (
+	"math/bits"
+
+	"github.com/taimats/sarupiler/code"
+)
+
+// Slots is a set of local slots. A function has at most 256 of them, since OpGetLocal takes a one-byte operand.
+type Slots [4]uint64
+
+func (s *Slots) Has(slot int) bool {
+	return s[slot/64]&(1<<(slot%64)) != 0
+}
+
+func (s *Slots) Add(slot int) {
+	s[slot/64] |= 1 << (slot % 64)
+}
+
+func (s *Slots) Remove(slot int) {
+	s[slot/64] &^= 1 << (slot % 64)
+}
+
+// Slice returns the slots in the set in increasing order.
+func (s *Slots) Slice() []int {
+	var slots []int
+	for i, w := range s {
+		for ; w != 0; w &= w - 1 {
+			slots = append(slots, i*64+bits.TrailingZeros64(w))
+		}
+	}
+	return slots
+}
+
+func (s *Slots) union(t Slots) {
+	for i := range s {
+		s[i] |= t[i]
+	}
+}
+
+// Liveness is the result of the live-variable analysis of the local slots of a function. A slot is live
+// at a point if its value may be read later without being overwritten first.
+type Liveness struct {
+	In  []Slots //In holds the slots live at the start of each block, by the index of the block.
+	Out []Slots //Out holds the slots live at the end of each block.
+}
+
+// Liveness computes the live local slots of every block, iterating backwards over the graph until
+// nothing changes any more.
+func (g *Graph) Liveness() *Liveness {
+	n := len(g.Blocks)
+	use := make([]Slots, n)
+	def := make([]Slots, n)
+	for _, b := range g.Blocks {
+		decoded, _ := decode(g.Instructions[b.Start:b.End])
+		for _, in := range decoded {
+			switch in.op {
+			case code.OpGetLocal, code.OpAddLocalConstant, code.OpSubLocalConstant:
+				if !def[b.Index].Has(in.operands[0]) {
+					use[b.Index].Add(in.operands[0])
+				}
+			case code.OpSetLocal:
+				def[b.Index].Add(in.operands[0])
+			}
+		}
+	}
+
+	l := &Liveness{In: make([]Slots, n), Out: make([]Slots, n)}
+	for changed := true; changed; {
+		changed = false
+		for i := n - 1; i >= 0; i-- {
+			b := g.Blocks[i]
+			var out Slots
+			for _, s := range b.Succs {
+				out.union(l.In[s.Index])
+			}
+			in := out
+			for j := range in {
+				in[j] = use[i][j] | (out[j] &^ def[i][j])
+			}
+			if in != l.In[i] || out != l.Out[i] {
+				l.In[i], l.Out[i] = in, out
+				changed = true
+			}
+		}
+	}
+	return l
+}
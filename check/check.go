@@ -0,0 +1,433 @@
+// Package check is a static checker of monkey programs. Unlike the compiler, which stops at the first error,
+// it reports every problem it finds as a diagnostic with a position in the source: undefined, unused and
+// shadowed bindings, calls with the wrong number of args, calls of values which are not functions, and
+// if expressions whose condition is a constant.
+package check
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/taimats/sarupiler/compiler"
+	"github.com/taimats/sarupiler/monkey/ast"
+	"github.com/taimats/sarupiler/monkey/lexer"
+	"github.com/taimats/sarupiler/monkey/parser"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// Severity tells whether a diagnostic is an error, which makes compiling or running the program fail,
+// or a warning about code which is likely a mistake.
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+// Diagnostic is a problem found in a program.
+type Diagnostic struct {
+	Pos      Position
+	Severity Severity
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s", d.Pos, d.Severity, d.Message)
+}
+
+// arity is the number of args a function takes. max is -1 for a function with a rest parameter.
+type arity struct {
+	min, max int
+}
+
+func (a arity) accepts(n int) bool {
+	return a.min <= n && (a.max < 0 || n <= a.max)
+}
+
+func (a arity) String() string {
+	switch {
+	case a.max < 0:
+		return fmt.Sprintf("%d or more", a.min)
+	case a.min == a.max:
+		return fmt.Sprintf("%d", a.min)
+	case a.max == a.min+1:
+		return fmt.Sprintf("%d or %d", a.min, a.max)
+	}
+	return fmt.Sprintf("%d to %d", a.min, a.max)
+}
+
+// intrinsics are the calls the compiler translates itself unless a binding of the same name is defined.
+var intrinsics = map[string]arity{
+	"import": {1, 1},
+	"throw":  {1, 1},
+	"try":    {2, 3},
+	"params": {2, 3},
+	"spread": {1, 1},
+}
+
+// value is what the checker knows about the value of an expression.
+type value struct {
+	fn       *arity //fn is the arity of a function value.
+	constant string //constant is the kind of a value which cannot be called, e.g. "an integer".
+}
+
+// binding is a name bound by a let statement, a parameter or the builtin registry.
+type binding struct {
+	name    string
+	ident   *ast.Identifier //ident is nil for builtins and intrinsics.
+	builtin bool
+	param   bool
+	used    bool
+	value   value
+}
+
+func (b *binding) describe(sources *compiler.SourceMap) string {
+	switch {
+	case b.ident == nil && b.builtin:
+		return "builtin " + b.name
+	case b.ident == nil:
+		return "intrinsic " + b.name
+	}
+	return fmt.Sprintf("%s declared at %s", b.name, sources.Position(b.ident))
+}
+
+// scope holds the bindings of a function, as the compiler has one symbol table per function.
+type scope struct {
+	outer    *scope
+	bindings map[string]*binding
+	declared []*binding
+	defining *binding //defining is the binding whose value is being checked, which refers to it without using it.
+}
+
+func newScope(outer *scope) *scope {
+	return &scope{outer: outer, bindings: make(map[string]*binding)}
+}
+
+func (s *scope) resolve(name string) (*binding, bool) {
+	for ; s != nil; s = s.outer {
+		if b, ok := s.bindings[name]; ok {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// Checker checks programs against a set of builtins.
+type Checker struct {
+	builtins     *obj.Registry
+	wholeProgram bool
+}
+
+// New returns a checker for programs using the default builtins.
+func New() *Checker {
+	return NewWithBuiltins(obj.DefaultRegistry())
+}
+
+// NewWithBuiltins returns a checker for programs compiled against the builtin registry r.
+func NewWithBuiltins(r *obj.Registry) *Checker {
+	return &Checker{builtins: r}
+}
+
+// SetWholeProgram makes the checker treat each program as the whole program, so that unused global
+// bindings are reported as unused local ones are. Globals of programs embedded in Go are often only
+// used from Go, which is why they are not reported by default.
+func (c *Checker) SetWholeProgram(on bool) {
+	c.wholeProgram = on
+}
+
+// Check parses input and returns the diagnostics of the program sorted by position.
+// The error is only non-nil if input cannot be parsed.
+func (c *Checker) Check(input string) ([]Diagnostic, error) {
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		return nil, fmt.Errorf("failed to parse: %s", strings.Join(errs, "; "))
+	}
+
+	universe := newScope(nil)
+	for name := range intrinsics {
+		universe.bindings[name] = &binding{name: name}
+	}
+	for _, def := range c.builtins.Definitions() {
+		universe.bindings[def.Name] = &binding{name: def.Name, builtin: true}
+	}
+	ch := &checker{sources: compiler.NewSourceMap(input, program), scope: newScope(universe)}
+	for _, s := range program.Statements {
+		ch.statement(s)
+	}
+	if c.wholeProgram {
+		ch.reportUnused()
+	}
+
+	slices.SortStableFunc(ch.diagnostics, func(a, b Diagnostic) int {
+		if a.Pos.Line != b.Pos.Line {
+			return a.Pos.Line - b.Pos.Line
+		}
+		return a.Pos.Column - b.Pos.Column
+	})
+	return ch.diagnostics, nil
+}
+
+// checker is the state of checking a single program.
+type checker struct {
+	sources     *compiler.SourceMap
+	scope       *scope
+	diagnostics []Diagnostic
+}
+
+func (c *checker) report(node ast.Node, severity Severity, format string, a ...any) {
+	c.diagnostics = append(c.diagnostics, Diagnostic{Pos: c.sources.Position(node), Severity: severity, Message: fmt.Sprintf(format, a...)})
+}
+
+// declare binds the name of ident in the current scope, warning if it hides another binding.
+func (c *checker) declare(ident *ast.Identifier, param bool) *binding {
+	name := ident.Value
+	if prev, ok := c.scope.bindings[name]; ok {
+		c.report(ident, Warning, "%s redeclares %s", name, prev.describe(c.sources))
+	} else if prev, ok := c.scope.resolve(name); ok {
+		c.report(ident, Warning, "%s shadows %s", name, prev.describe(c.sources))
+	}
+	b := &binding{name: name, ident: ident, param: param}
+	c.scope.bindings[name] = b
+	c.scope.declared = append(c.scope.declared, b)
+	return b
+}
+
+// reportUnused warns about the let bindings of the current scope nothing refers to.
+// Names starting with an underscore are meant to be unused.
+func (c *checker) reportUnused() {
+	for _, b := range c.scope.declared {
+		if !b.used && !b.param && !strings.HasPrefix(b.name, "_") {
+			c.report(b.ident, Warning, "unused variable: %s", b.name)
+		}
+	}
+}
+
+func (c *checker) statement(node ast.Statement) {
+	switch node := node.(type) {
+	case *ast.LetStatement:
+		//As in the compiler, the name is bound before its value, so that functions can call themselves.
+		//A function literal is known to be a function before its body is checked, for recursive calls.
+		b := c.declare(node.Name, false)
+		if fn, ok := node.Value.(*ast.FunctionLiteral); ok {
+			b.value = value{fn: &arity{min: len(fn.Parameters), max: len(fn.Parameters)}}
+		}
+		outer := c.scope.defining
+		c.scope.defining = b
+		b.value = c.expression(node.Value)
+		c.scope.defining = outer
+	case *ast.ReturnStatement:
+		c.expression(node.ReturnValue)
+	case *ast.ExpressionStatement:
+		c.expression(node.Expression)
+	case *ast.BlockStatement:
+		c.block(node)
+	}
+}
+
+func (c *checker) block(node *ast.BlockStatement) {
+	if node == nil {
+		return
+	}
+	for _, s := range node.Statements {
+		c.statement(s)
+	}
+}
+
+// expression checks node and returns what is known about its value.
+func (c *checker) expression(node ast.Expression) value {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return value{constant: "an integer"}
+	case *ast.StringLiteral:
+		return value{constant: "a string"}
+	case *ast.Boolean:
+		return value{constant: "a boolean"}
+	case *ast.Identifier:
+		return c.identifier(node)
+	case *ast.PrefixExpression:
+		c.expression(node.Right)
+		if node.Operator == "!" {
+			return value{constant: "a boolean"}
+		}
+	case *ast.InfixExpression:
+		c.expression(node.Left)
+		c.expression(node.Right)
+	case *ast.IfExpression:
+		c.expression(node.Condition)
+		if truthy, ok := constantTruth(node.Condition); ok {
+			c.report(node, Warning, "condition is always %t: %s", truthy, node.Condition.String())
+		}
+		c.block(node.Consequence)
+		c.block(node.Alternative)
+	case *ast.FunctionLiteral:
+		return c.function(node, nil, "")
+	case *ast.CallExpression:
+		return c.call(node)
+	case *ast.ArrayLiteral:
+		c.elements(node.Elements)
+		return value{constant: "an array"}
+	case *ast.IndexExpression:
+		c.expression(node.Left)
+		c.expression(node.Index)
+	case *ast.HashLiteral:
+		for _, k := range c.sources.HashKeys(node) {
+			c.expression(k)
+			c.expression(node.Pairs[k])
+		}
+		return value{constant: "a hash"}
+	}
+	return value{}
+}
+
+func (c *checker) identifier(node *ast.Identifier) value {
+	b, ok := c.scope.resolve(node.Value)
+	if !ok {
+		c.report(node, Error, "undefined variable: %s", node.Value)
+		return value{}
+	}
+	if !c.isDefining(b) {
+		b.used = true
+	}
+	return b.value
+}
+
+// isDefining reports whether b is a binding whose value is being checked in the current function or
+// the ones enclosing it.
+func (c *checker) isDefining(b *binding) bool {
+	for s := c.scope; s != nil; s = s.outer {
+		if s.defining == b {
+			return true
+		}
+	}
+	return false
+}
+
+// function checks a function literal whose parameters may have default values and a rest parameter,
+// as given to params, and returns the function value.
+func (c *checker) function(node *ast.FunctionLiteral, defaults *ast.HashLiteral, rest string) value {
+	c.scope = newScope(c.scope)
+	for _, p := range node.Parameters {
+		c.declare(p, true)
+	}
+	a := arity{min: len(node.Parameters), max: len(node.Parameters)}
+	for _, p := range node.Parameters {
+		if p.Value == rest {
+			a.min--
+			a.max = -1
+		}
+	}
+	if defaults != nil {
+		optional := make(map[string]bool)
+		for _, k := range c.sources.HashKeys(defaults) {
+			if lit, ok := k.(*ast.StringLiteral); ok {
+				optional[lit.Value] = true
+			}
+			c.expression(defaults.Pairs[k])
+		}
+		for _, p := range node.Parameters {
+			if optional[p.Value] && p.Value != rest {
+				a.min--
+			}
+		}
+	}
+	c.block(node.Body)
+	c.reportUnused()
+	c.scope = c.scope.outer
+	return value{fn: &a}
+}
+
+func (c *checker) call(node *ast.CallExpression) value {
+	if ident, ok := node.Function.(*ast.Identifier); ok && c.isIntrinsic(node, ident.Value) {
+		return c.intrinsic(node, ident.Value)
+	}
+
+	callee := c.expression(node.Function)
+	spread := c.elements(node.Arguments)
+	switch {
+	case callee.constant != "":
+		c.report(node.Function, Error, "calling non-function: %s is %s", node.Function.String(), callee.constant)
+	case callee.fn != nil && !spread && !callee.fn.accepts(len(node.Arguments)):
+		c.report(node.Function, Error, "wrong number of args for %s: (got=%d, want=%s)", node.Function.String(), len(node.Arguments), callee.fn)
+	}
+	return value{}
+}
+
+// elements checks call args or the elements of an array literal, where spread is allowed,
+// and reports whether any of them is spread.
+func (c *checker) elements(exprs []ast.Expression) bool {
+	spread := false
+	for _, e := range exprs {
+		if call, ok := e.(*ast.CallExpression); ok && c.isIntrinsic(call, "spread") {
+			spread = true
+			for _, a := range call.Arguments {
+				c.expression(a)
+			}
+			continue
+		}
+		c.expression(e)
+	}
+	return spread
+}
+
+// isIntrinsic reports whether node calls the intrinsic name, which no binding in scope hides.
+func (c *checker) isIntrinsic(node *ast.CallExpression, name string) bool {
+	ident, ok := node.Function.(*ast.Identifier)
+	if _, intrinsic := intrinsics[name]; !ok || !intrinsic || ident.Value != name {
+		return false
+	}
+	b, _ := c.scope.resolve(name)
+	return b != nil && b.ident == nil
+}
+
+// intrinsic checks a call of an intrinsic, whose args the compiler expects in a certain shape.
+func (c *checker) intrinsic(node *ast.CallExpression, name string) value {
+	if want := intrinsics[name]; !want.accepts(len(node.Arguments)) {
+		c.report(node.Function, Error, "wrong number of args for %s: (got=%d, want=%s)", name, len(node.Arguments), want)
+	}
+	if name == "params" && len(node.Arguments) >= 2 {
+		fn, isFn := node.Arguments[0].(*ast.FunctionLiteral)
+		defaults, isHash := node.Arguments[1].(*ast.HashLiteral)
+		if isFn && isHash {
+			rest := ""
+			if len(node.Arguments) == 3 {
+				if lit, ok := node.Arguments[2].(*ast.StringLiteral); ok {
+					rest = lit.Value
+				}
+			}
+			return c.function(fn, defaults, rest)
+		}
+	}
+	if name == "spread" {
+		c.report(node.Function, Error, "spread is only allowed in call args and array literals: %s", node.String())
+	}
+	for _, a := range node.Arguments {
+		c.expression(a)
+	}
+	return value{}
+}
+
+// constantTruth reports whether cond is a constant, and whether it is truthy. Only false is a falsy
+// constant, since there is no null literal and every integer, zero included, is truthy.
+func constantTruth(cond ast.Expression) (bool, bool) {
+	switch cond := cond.(type) {
+	case *ast.Boolean:
+		return cond.Value, true
+	case *ast.IntegerLiteral, *ast.StringLiteral, *ast.ArrayLiteral, *ast.HashLiteral, *ast.FunctionLiteral:
+		return true, true
+	case *ast.PrefixExpression:
+		if cond.Operator == "!" {
+			truthy, ok := constantTruth(cond.Right)
+			return !truthy, ok
+		}
+	}
+	return false, false
+}
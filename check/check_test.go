@@ -0,0 +1,210 @@
+package check_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taimats/sarupiler/check"
+	"github.com/taimats/sarupiler/monkey/object"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+func diagnostics(t *testing.T, c *check.Checker, input string) []string {
+	t.Helper()
+	diags, err := c.Check(input)
+	if err != nil {
+		t.Fatalf("checker failed: (error: %s)", err)
+	}
+	var got []string
+	for _, d := range diags {
+		got = append(got, d.String())
+	}
+	return got
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name:  "clean program",
+			input: `let add = fn(a, b) { a + b }; add(1, 2);`,
+		},
+		{
+			name:  "undefined variables",
+			input: "let f = fn() { x };\nf() + y;",
+			want: []string{
+				"1:16: error: undefined variable: x",
+				"2:7: error: undefined variable: y",
+			},
+		},
+		{
+			name:  "unused local",
+			input: "let f = fn(a) {\n  let b = 1;\n  let _c = 2;\n  a\n};\nf(1);",
+			want:  []string{"2:7: warning: unused variable: b"},
+		},
+		{
+			name:  "unused recursive local",
+			input: "let f = fn() {\n  let loop = fn(n) { loop(n - 1) };\n  1\n};\nf();",
+			want:  []string{"2:7: warning: unused variable: loop"},
+		},
+		{
+			name:  "unused globals are not reported by default",
+			input: `let x = 1;`,
+		},
+		{
+			name:  "shadowed outer binding",
+			input: "let x = 1;\nlet f = fn(x) { x };\nf(x);",
+			want:  []string{"2:12: warning: x shadows x declared at 1:5"},
+		},
+		{
+			name:  "shadowed builtin",
+			input: "let len = fn(s) { 0 };\nlen(1);",
+			want:  []string{"1:5: warning: len shadows builtin len"},
+		},
+		{
+			name:  "redeclared binding",
+			input: "let x = 1;\nlet x = 2;\nx;",
+			want:  []string{"2:5: warning: x redeclares x declared at 1:5"},
+		},
+		{
+			name:  "wrong arity",
+			input: "let add = fn(a, b) { a + b };\nadd(1);\nadd(1, 2, 3);",
+			want: []string{
+				"2:1: error: wrong number of args for add: (got=1, want=2)",
+				"3:1: error: wrong number of args for add: (got=3, want=2)",
+			},
+		},
+		{
+			name:  "wrong arity of a recursive call",
+			input: "let f = fn(n) { f() };\nf(1);",
+			want:  []string{"1:17: error: wrong number of args for f: (got=0, want=1)"},
+		},
+		{
+			name:  "wrong arity of a function literal",
+			input: `fn(a) { a }(1, 2);`,
+			want:  []string{"1:1: error: wrong number of args for fn(a) a: (got=2, want=1)"},
+		},
+		{
+			name:  "wrong arity of an alias",
+			input: "let f = fn() { 1 };\nlet g = f;\ng(1);",
+			want:  []string{"3:1: error: wrong number of args for g: (got=1, want=0)"},
+		},
+		{
+			name:  "default and rest parameters",
+			input: "let f = params(fn(a, b, more) { a }, {\"b\": 2}, \"more\");\nf(1);\nf(1, 2, 3, 4);\nf();",
+			want:  []string{"4:1: error: wrong number of args for f: (got=0, want=1 or more)"},
+		},
+		{
+			name:  "default parameters",
+			input: "let f = params(fn(a, b) { a + b }, {\"b\": 2});\nf(1, 2, 3);",
+			want:  []string{"2:1: error: wrong number of args for f: (got=3, want=1 or 2)"},
+		},
+		{
+			name:  "spread args are not counted",
+			input: "let f = fn(a, b) { a + b };\nf(spread([1, 2]));",
+		},
+		{
+			name:  "spread elements",
+			input: "let a = [1];\n[spread(a), 2];",
+		},
+		{
+			name:  "intrinsics",
+			input: "throw(1, 2);\ntry(fn() { 1 });\nspread([1]);",
+			want: []string{
+				"1:1: error: wrong number of args for throw: (got=2, want=1)",
+				"2:1: error: wrong number of args for try: (got=1, want=2 or 3)",
+				"3:1: error: spread is only allowed in call args and array literals: spread([1])",
+			},
+		},
+		{
+			name:  "non-callable callees",
+			input: "let x = 5;\nx(1);\n\"s\"();\n[1, 2](0);",
+			want: []string{
+				"2:1: error: calling non-function: x is an integer",
+				"3:1: error: calling non-function: s is a string",
+				"4:1: error: calling non-function: [1, 2] is an array",
+			},
+		},
+		{
+			name:  "constant conditions",
+			input: "if (true) { 1 };\nif (0) { 1 } else { 2 };\nif (!true) { 1 };\nlet x = 1;\nif (x > 0) { 1 };",
+			want: []string{
+				"1:1: warning: condition is always true: true",
+				"2:1: warning: condition is always true: 0",
+				"3:1: warning: condition is always false: (!true)",
+			},
+		},
+		{
+			name:  "positions in hash literals",
+			input: `{"b": y, "a": z};`,
+			want: []string{
+				"1:7: error: undefined variable: y",
+				"1:15: error: undefined variable: z",
+			},
+		},
+		{
+			name:  "positions in hash literals with keys of the same text",
+			input: "{f(): y,\n f(): z};",
+			want: []string{
+				"1:2: error: undefined variable: f",
+				"1:7: error: undefined variable: y",
+				"2:2: error: undefined variable: f",
+				"2:7: error: undefined variable: z",
+			},
+		},
+		{
+			name:  "every problem is reported",
+			input: "let f = fn(a) {\n  let unused = g;\n  f(a, a)\n};",
+			want: []string{
+				"2:7: warning: unused variable: unused",
+				"2:16: error: undefined variable: g",
+				"3:3: error: wrong number of args for f: (got=2, want=1)",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, diagnostics(t, check.New(), tt.input))
+		})
+	}
+}
+
+func TestWholeProgram(t *testing.T) {
+	c := check.New()
+	c.SetWholeProgram(true)
+	got := diagnostics(t, c, "let x = 1;\nlet f = fn() { f() };\nlet _y = 2;\nlet z = 3;\nz;")
+	assert.Equal(t, []string{
+		"1:5: warning: unused variable: x",
+		"2:5: warning: unused variable: f",
+	}, got)
+}
+
+func TestCustomBuiltins(t *testing.T) {
+	r := obj.NewRegistry()
+	err := r.Register("double", func(args ...object.Object) object.Object { return args[0] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := diagnostics(t, check.NewWithBuiltins(r), "double(1);\nlen(\"a\");")
+	assert.Equal(t, []string{"2:1: error: undefined variable: len"}, got)
+}
+
+func TestParseError(t *testing.T) {
+	_, err := check.New().Check("let = 1;")
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "failed to parse: "))
+	}
+}
+
+func TestDiagnostic(t *testing.T) {
+	d := check.Diagnostic{Severity: check.Error, Message: "undefined variable: x"}
+	assert.Equal(t, "-: error: undefined variable: x", d.String())
+	d.Pos = check.Position{Line: 3, Column: 7}
+	d.Severity = check.Warning
+	assert.Equal(t, "3:7: warning: undefined variable: x", d.String())
+}
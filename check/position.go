@@ -0,0 +1,7 @@
+package check
+
+import "github.com/taimats/sarupiler/compiler"
+
+// Position is a position in the source, counting lines and columns from 1.
+// The zero Position means that the position is unknown.
+type Position = compiler.Position
@@ -36,6 +36,17 @@ const (
 	OpGetBuiltin
 	OpClosure
 	OpGetFree
+	OpThrow
+	OpConcat
+	OpCallSpread
+	OpAddLocalConstant
+	OpSubLocalConstant
+	OpJumpUnlessGreaterThan
+	OpJumpUnlessEqual
+	OpJumpUnlessNotEqual
+	OpIndexConstant
+	OpCallCached
+	OpTailCall
 )
 
 type Instructions []byte
@@ -111,6 +122,22 @@ var definitions = map[Opcode]*Definition{
 	OpGetBuiltin:    {"OpGetBuiltin", []int{1}},
 	OpClosure:       {"OpClosure", []int{2, 1}}, //the first of the two operands is a constant index, and the second is the number of free variables.
 	OpGetFree:       {"OpGetFree", []int{1}},
+	OpThrow:         {"OpThrow", []int{}},
+	OpConcat:        {"OpConcat", []int{2}},    //the operand of OpConcat is the number of arrays joined into a new one.
+	OpCallSpread:    {"OpCallSpread", []int{}}, //OpCallSpread calls a function with the elements of an array as its args.
+
+	//Superinstructions fuse a common sequence of instructions into one, to save dispatches in hot loops.
+	OpAddLocalConstant:      {"OpAddLocalConstant", []int{1, 2}},   //OpGetLocal, OpConstant and OpAdd: the operands are a local index and a constant index.
+	OpSubLocalConstant:      {"OpSubLocalConstant", []int{1, 2}},   //OpGetLocal, OpConstant and OpSub.
+	OpJumpUnlessGreaterThan: {"OpJumpUnlessGreaterThan", []int{2}}, //OpGreaterThan and OpJumpNotTruthy.
+	OpJumpUnlessEqual:       {"OpJumpUnlessEqual", []int{2}},       //OpEqual and OpJumpNotTruthy.
+	OpJumpUnlessNotEqual:    {"OpJumpUnlessNotEqual", []int{2}},    //OpNotEqual and OpJumpNotTruthy.
+
+	//Instructions with an inline cache take the index of their cache slot as the last operand.
+	OpIndexConstant: {"OpIndexConstant", []int{2, 2}}, //OpIndexConstant indexes with a string constant: the first operand is the constant index.
+	OpCallCached:    {"OpCallCached", []int{1, 2}},    //OpCallCached is OpCall of a function loaded from a global: the first operand is the number of args.
+
+	OpTailCall: {"OpTailCall", []int{1}}, //OpTailCall is OpCall in tail position, which replaces the frame of the caller with the one of the callee.
 }
 
 func Lookup(op byte) (*Definition, error) {
@@ -56,6 +56,7 @@ func TestReadOperands(t *testing.T) {
 		{code.OpConstant, []int{65535}, 2},
 		{code.OpGetLocal, []int{255}, 1},
 		{code.OpClosure, []int{65534, 255}, 3},
+		{code.OpAddLocalConstant, []int{255, 65534}, 3},
 	}
 	a := assert.New(t)
 
@@ -1,9 +1,7 @@
 package compiler
 
 import (
-	"cmp"
 	"fmt"
-	"slices"
 
 	"github.com/taimats/sarupiler/code"
 	"github.com/taimats/sarupiler/monkey/ast"
@@ -15,26 +13,61 @@ type Compiler struct {
 	constants []object.Object
 
 	symbolTable *SymbolTable
+	builtins    *obj.Registry
 
 	scopes     []CompilationScope //scopes is a stack for a set of instructions with a scope (= CompilationScope).
 	scopeIndex int                //scopeIndex represents a current position in a slice of scopes.
+
+	loader    Loader
+	modules   map[string]*module //modules caches compiled modules by their canonical names.
+	importing []string           //importing is a stack of the modules being compiled, used to detect import cycles.
+
+	numHidden int //numHidden counts the hidden bindings defined so far, so that each gets a unique name.
+
+	plain bool //plain disables superinstructions, so that benchmarks can measure what they gain.
+
+	numCaches int //numCaches counts the inline cache slots allocated so far.
+
+	wholeProgram bool     //wholeProgram allows unused global bindings to be dropped.
+	warnings     []string //warnings collects the warnings reported during compilation.
+
+	inlinable map[int]inlineCandidate //inlinable maps the global slots bound to inlinable functions to them.
+	inlining  bool                    //inlining is set while an inlined body is compiled, which is never inlined into.
+	inline    bool                    //inline enables inlining.
+
+	hashKeys map[*ast.HashLiteral][]ast.Expression //hashKeys holds the source order of the keys of hash literals.
 }
 
 func New() *Compiler {
+	return NewWithBuiltins(obj.DefaultRegistry())
+}
+
+// NewWithBuiltins creates a compiler resolving builtin names against r instead of the default builtins.
+// The registry is recorded in the Bytecode, so that the VM fetches builtins from the same registry.
+func NewWithBuiltins(r *obj.Registry) *Compiler {
 	scope := CompilationScope{
 		instructions:        code.Instructions{},
 		lastInstruction:     EmittedInstruction{},
 		previousInstruction: EmittedInstruction{},
 	}
 	symtable := NewSymbolTable()
-	for i, bi := range obj.Builtins {
-		symtable.DefineBuiltin(i, bi.Name)
-	}
+	DefineBuiltins(symtable, r)
 	return &Compiler{
 		constants:   []object.Object{},
 		symbolTable: symtable,
+		builtins:    r,
 		scopes:      []CompilationScope{scope},
 		scopeIndex:  0,
+		modules:     make(map[string]*module),
+		inlinable:   make(map[int]inlineCandidate),
+		hashKeys:    make(map[*ast.HashLiteral][]ast.Expression),
+	}
+}
+
+// DefineBuiltins defines every builtin in r on the symbol table s with its registry index.
+func DefineBuiltins(s *SymbolTable, r *obj.Registry) {
+	for i, def := range r.Definitions() {
+		s.DefineBuiltin(i, def.Name)
 	}
 }
 
@@ -48,6 +81,10 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 func (c *Compiler) Compile(node ast.Node) error {
 	switch node := node.(type) {
 	case *ast.Program:
+		if c.wholeProgram && c.scopeIndex == 0 {
+			c.scopes[0].uses = make(map[string]bool)
+			collectUses(node, c.scopes[0].uses)
+		}
 		for _, s := range node.Statements {
 			err := c.Compile(s)
 			if err != nil {
@@ -113,7 +150,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return fmt.Errorf("unkown operator: %s", node.Operator)
 		}
 	case *ast.IntegerLiteral:
-		integer := &object.Integer{Value: node.Value}
+		integer := obj.NativeInt(node.Value)
 		c.emit(code.OpConstant, c.addConstant(integer))
 	case *ast.Boolean:
 		if node.Value {
@@ -122,45 +159,16 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpFalse)
 		}
 	case *ast.IfExpression:
-		err := c.Compile(node.Condition)
-		if err != nil {
-			return err
-		}
-		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
-
-		err = c.Compile(node.Consequence)
-		if err != nil {
-			return err
-		}
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
-		}
-		jumpPos := c.emit(code.OpJump, 9999)
-		afterConsequencePos := len(c.currentInstructions())
-		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
-
-		if node.Alternative == nil {
-			c.emit(code.OpNull)
-			c.changeOperand(jumpPos, len(c.currentInstructions()))
-			return nil
-		}
-		err = c.Compile(node.Alternative)
-		if err != nil {
-			return err
-		}
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
-		}
-		afterAlternativePos := len(c.currentInstructions())
-		c.changeOperand(jumpPos, afterAlternativePos)
+		return c.compileIf(node, false)
 	case *ast.BlockStatement:
-		for _, s := range node.Statements {
-			err := c.Compile(s)
-			if err != nil {
-				return err
-			}
-		}
+		return c.compileStatements(node.Statements, c.Compile)
 	case *ast.LetStatement:
+		if c.isUnused(node) {
+			c.warn("unused binding: %s", node.Name.Value)
+			return c.discard(func() error {
+				return c.Compile(node.Value)
+			})
+		}
 		symbol := c.symbolTable.Define(node.Name.Value)
 		err := c.Compile(node.Value)
 		if err != nil {
@@ -171,6 +179,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		} else {
 			c.emit(code.OpSetLocal, symbol.Index)
 		}
+		c.recordInlinable(symbol, node)
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
@@ -181,6 +190,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 		str := &object.String{Value: node.Value}
 		c.emit(code.OpConstant, c.addConstant(str))
 	case *ast.ArrayLiteral:
+		if c.hasSpread(node.Elements) {
+			return c.compileSpreadElements(node.Elements)
+		}
 		for _, el := range node.Elements {
 			err := c.Compile(el)
 			if err != nil {
@@ -189,14 +201,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		c.emit(code.OpArray, len(node.Elements))
 	case *ast.HashLiteral:
-		keys := make([]ast.Expression, 0, len(node.Pairs))
-		for k := range node.Pairs {
-			keys = append(keys, k)
-		}
-		slices.SortFunc(keys, func(a, b ast.Expression) int {
-			return cmp.Compare(a.String(), b.String())
-		})
-		for _, k := range keys {
+		for _, k := range c.keysOf(node) {
 			err := c.Compile(k)
 			if err != nil {
 				return err
@@ -212,57 +217,70 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if err != nil {
 			return err
 		}
+		if key, ok := node.Index.(*ast.StringLiteral); ok {
+			str := &object.String{Value: key.Value}
+			c.emit(code.OpIndexConstant, c.addConstant(str), c.newCache())
+			return nil
+		}
 		err = c.Compile(node.Index)
 		if err != nil {
 			return err
 		}
 		c.emit(code.OpIndex)
 	case *ast.FunctionLiteral:
-		c.enterScope()
-		for _, p := range node.Parameters {
-			c.symbolTable.Define(p.Value)
+		params := make([]parameter, len(node.Parameters))
+		for i, p := range node.Parameters {
+			params[i] = parameter{name: p.Value}
 		}
-		err := c.Compile(node.Body)
+		return c.compileFunction(node, params)
+	case *ast.ReturnStatement:
+		err := c.compileReturnValue(node.ReturnValue)
 		if err != nil {
 			return err
 		}
-		if c.lastInstructionIs(code.OpPop) {
-			c.replaceLastPopWithReturn()
+		c.emit(code.OpReturnValue)
+	case *ast.CallExpression:
+		if c.isIntrinsic(node, importFunc) {
+			return c.compileImport(node)
 		}
-		if !c.lastInstructionIs(code.OpReturnValue) {
-			c.emit(code.OpReturn)
+		if c.isIntrinsic(node, tryFunc) {
+			return c.compileTry(node)
 		}
-		freeSymbols := c.symbolTable.FreeSymbols
-		numLocals := c.symbolTable.numDefinitions
-		ins := c.leaveScope()
-
-		for _, s := range freeSymbols {
-			c.loadSymbol(s)
+		if c.isIntrinsic(node, throwFunc) {
+			return c.compileThrow(node)
 		}
-		compiledFn := &obj.CompiledFunction{
-			Instructions:  ins,
-			NumLocals:     numLocals,
-			NumParameters: len(node.Parameters),
+		if c.isIntrinsic(node, paramsFunc) {
+			return c.compileParams(node)
 		}
-		fnIndex := c.addConstant(compiledFn)
-		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
-	case *ast.ReturnStatement:
-		err := c.Compile(node.ReturnValue)
-		if err != nil {
-			return err
+		if c.isIntrinsic(node, spreadFunc) {
+			return fmt.Errorf("spread is only allowed in call args and array literals: %s", node.String())
+		}
+		if cand, ok := c.inlineCandidate(node); ok {
+			return c.compileInline(node, cand)
 		}
-		c.emit(code.OpReturnValue)
-	case *ast.CallExpression:
 		err := c.Compile(node.Function)
 		if err != nil {
 			return err
 		}
+		global := c.lastInstructionIs(code.OpGetGlobal)
+		if c.hasSpread(node.Arguments) {
+			err := c.compileSpreadElements(node.Arguments)
+			if err != nil {
+				return err
+			}
+			c.emit(code.OpCallSpread)
+			return nil
+		}
 		for _, a := range node.Arguments {
 			err := c.Compile(a)
 			if err != nil {
 				return err
 			}
 		}
+		if global {
+			c.emit(code.OpCallCached, len(node.Arguments), c.newCache())
+			return nil
+		}
 		c.emit(code.OpCall, len(node.Arguments))
 	}
 	return nil
@@ -272,10 +290,29 @@ func (c *Compiler) Bytecode() *Bytecode {
 	return &Bytecode{
 		Instructions: c.currentInstructions(),
 		Constants:    c.constants,
+		Builtins:     c.builtins,
+		Handlers:     c.scopes[c.scopeIndex].handlers,
+		NumCaches:    c.numCaches,
 	}
 }
 
+// newCache allocates a slot for the inline cache of an instruction.
+// Each instruction gets its own slot, which the VM fills the first time it runs the instruction.
+func (c *Compiler) newCache() int {
+	c.numCaches++
+	return c.numCaches - 1
+}
+
+// SymbolTable returns the symbol table of the current scope,
+// which is the global one once compilation has finished.
+func (c *Compiler) SymbolTable() *SymbolTable {
+	return c.symbolTable
+}
+
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
+	if pos, ok := c.emitFused(op, operands...); ok {
+		return pos
+	}
 	ins := code.Make(op, operands...)
 	pos := c.addInstruction(ins)
 	c.setLastInstruction(op, pos)
@@ -373,6 +410,9 @@ func (c *Compiler) loadSymbol(s Symbol) {
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	Builtins     *obj.Registry //Builtins is the registry that the indices of OpGetBuiltin refer to.
+	Handlers     []obj.Handler //Handlers is the exception-handler table of the main program.
+	NumCaches    int           //NumCaches is the number of inline cache slots used by the instructions.
 }
 
 type EmittedInstruction struct {
@@ -384,4 +424,9 @@ type CompilationScope struct {
 	instructions        code.Instructions
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+	handlers            []obj.Handler
+	lastTarget          int             //lastTarget is the position of the latest jump target, which no superinstruction may span.
+	uses                map[string]bool //uses holds the names referred to in the scope, or nil if its bindings must all be kept.
+	inlineBase          int             //inlineBase is the first local slot of the bodies inlined into the scope.
+	inlineSize          int             //inlineSize is the number of slots from inlineBase the inlined bodies use.
 }
@@ -1,6 +1,7 @@
 package compiler_test
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/taimats/sarupiler/monkey/object"
 	"github.com/taimats/sarupiler/monkey/parser"
 	obj "github.com/taimats/sarupiler/object"
+	"github.com/taimats/sarupiler/vm"
 )
 
 type compilerTestCase struct {
@@ -85,7 +87,7 @@ func TestIntegerArithmetic(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func runCompilerTests(t *testing.T, tests []compilerTestCase) {
+func runCompilerTests(t *testing.T, tests []compilerTestCase, setups ...func(*compiler.Compiler)) {
 	t.Helper()
 	a := assert.New(t)
 
@@ -93,6 +95,9 @@ func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 		program := parse(tt.input)
 
 		compiler := compiler.New()
+		for _, setup := range setups {
+			setup(compiler)
+		}
 		err := compiler.Compile(program)
 		if err != nil {
 			t.Fatalf("compiler failed to Compile: (error: %s)", err)
@@ -610,7 +615,7 @@ func TestFunctionCalls(t *testing.T) {
 				code.Make(code.OpClosure, 1, 0),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpCall, 0),
+				code.Make(code.OpCallCached, 0, 0),
 				code.Make(code.OpPop),
 			),
 		},
@@ -635,7 +640,7 @@ func TestFunctionCalls(t *testing.T) {
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpCall, 1),
+				code.Make(code.OpCallCached, 1, 0),
 				code.Make(code.OpPop),
 			),
 		},
@@ -668,7 +673,7 @@ func TestFunctionCalls(t *testing.T) {
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpConstant, 3),
-				code.Make(code.OpCall, 3),
+				code.Make(code.OpCallCached, 3, 0),
 				code.Make(code.OpPop),
 			),
 		},
@@ -1006,3 +1011,760 @@ func TestClosures(t *testing.T) {
 // 			},
 // 		},
 // 	}
+
+func TestCompileWithBuiltinRegistry(t *testing.T) {
+	r := obj.NewRegistry()
+	err := r.Register("double", func(args ...object.Object) object.Object { return args[0] })
+	if err != nil {
+		t.Fatalf("failed to register builtin: (error: %s)", err)
+	}
+	err = r.Register("triple", func(args ...object.Object) object.Object { return args[0] })
+	if err != nil {
+		t.Fatalf("failed to register builtin: (error: %s)", err)
+	}
+
+	comp := compiler.NewWithBuiltins(r)
+	err = comp.Compile(parse(`triple(1); double(2);`))
+	if err != nil {
+		t.Fatalf("compiler failed to Compile: (error: %s)", err)
+	}
+	bytecode := comp.Bytecode()
+
+	want := concatInstructions(
+		code.Make(code.OpGetBuiltin, 1),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpPop),
+		code.Make(code.OpGetBuiltin, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpPop),
+	)
+	assert.Equal(t, want, bytecode.Instructions, bytecode.Instructions.String())
+	assert.Same(t, r, bytecode.Builtins)
+
+	comp = compiler.NewWithBuiltins(r)
+	err = comp.Compile(parse(`len("a")`))
+	assert.EqualError(t, err, "undefined variable: len")
+}
+
+func TestTryCatch(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn() { 1 }; let g = fn(e) { e }; try(f, g);`))
+	if err != nil {
+		t.Fatalf("compiler failed to Compile: (error: %s)", err)
+	}
+	bytecode := comp.Bytecode()
+
+	want := concatInstructions(
+		code.Make(code.OpClosure, 1, 0),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpClosure, 2, 0),
+		code.Make(code.OpSetGlobal, 1),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpCall, 0),
+		code.Make(code.OpJump, 33),
+		code.Make(code.OpSetGlobal, 2),
+		code.Make(code.OpGetGlobal, 1),
+		code.Make(code.OpGetGlobal, 2),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpPop),
+	)
+	assert.Equal(t, want, bytecode.Instructions, bytecode.Instructions.String())
+	assert.Equal(t, []obj.Handler{{Start: 17, End: 19, Target: 22}}, bytecode.Handlers)
+}
+
+func TestTryCatchErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`try(fn() { 1 })`, "wrong number of args for try: (got=1 want=2 or 3)"},
+		{`try(fn() { 1 }, fn(e) { e }, fn() { 1 }, 1)`, "wrong number of args for try: (got=4 want=2 or 3)"},
+		{`throw()`, "wrong number of args for throw: (got=0 want=1)"},
+		{`throw(1, 2)`, "wrong number of args for throw: (got=2 want=1)"},
+	}
+	for _, tt := range tests {
+		err := compiler.New().Compile(parse(tt.input))
+		assert.EqualError(t, err, tt.want)
+	}
+}
+
+func TestParams(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`params(fn(a, b, rest) { a }, {"b": 2}, "rest")`))
+	if err != nil {
+		t.Fatalf("compiler failed to Compile: (error: %s)", err)
+	}
+	bytecode := comp.Bytecode()
+
+	want := &obj.CompiledFunction{
+		Instructions: concatInstructions(
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpSetLocal, 1),
+			code.Make(code.OpGetLocal, 0),
+			code.Make(code.OpReturnValue),
+		),
+		NumLocals:     3,
+		NumParameters: 3,
+		NumOptional:   1,
+		Variadic:      true,
+		Entries:       []int{0, 5},
+	}
+	assert.Equal(t, []object.Object{&object.Integer{Value: 2}, want}, bytecode.Constants)
+	min, max := want.Arity()
+	assert.Equal(t, []int{1, -1}, []int{min, max})
+}
+
+func TestParamsErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`params(fn(a) { a })`, "wrong number of args for params: (got=1 want=2 or 3)"},
+		{`params(1, {})`, "params expects a function literal: (got=1)"},
+		{`params(fn(a) { a }, [])`, "params expects a hash literal of default values: (got=[])"},
+		{`params(fn(a) { a }, {}, 1)`, "params expects the name of the rest parameter: (got=1)"},
+		{`params(fn(a) { a }, {"b": 1})`, "undefined parameter: b"},
+		{`params(fn(a) { a }, {1: 1})`, "default values must be keyed by parameter names: (got=1)"},
+		{`params(fn(a) { a }, {}, "b")`, "undefined parameter: b"},
+		{`params(fn(a, b) { a }, {"a": 1})`, "required parameter follows a parameter with a default value: b"},
+		{`params(fn(a, b) { a }, {}, "a")`, "rest parameter must be the last parameter: a"},
+		{`params(fn(a) { a }, {"a": 1}, "a")`, "rest parameter cannot have a default value: a"},
+	}
+	for _, tt := range tests {
+		err := compiler.New().Compile(parse(tt.input))
+		assert.EqualError(t, err, tt.want)
+	}
+}
+
+func TestSpread(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:         `[1, spread([2]), 3]`,
+			wantConstants: []object.Object{&object.Integer{Value: 1}, &object.Integer{Value: 2}, &object.Integer{Value: 3}},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpConcat, 3),
+				code.Make(code.OpPop),
+			),
+		},
+		{
+			input:         `len(spread(["a"]))`,
+			wantConstants: []object.Object{&object.String{Value: "a"}},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpGetBuiltin, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpConcat, 1),
+				code.Make(code.OpCallSpread),
+				code.Make(code.OpPop),
+			),
+		},
+	}
+	runCompilerTests(t, tests)
+
+	err := compiler.New().Compile(parse(`let a = spread([1]);`))
+	assert.EqualError(t, err, "spread is only allowed in call args and array literals: spread([1])")
+	err = compiler.New().Compile(parse(`[spread([1], [2])]`))
+	assert.EqualError(t, err, "wrong number of args for spread: (got=2 want=1)")
+}
+
+func TestSuperinstructions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn(a) { if (a < 2) { a + 1 } else { a - 2 } }`,
+			wantConstants: []object.Object{
+				&object.Integer{Value: 2},
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+				&obj.CompiledFunction{
+					NumLocals:     1,
+					NumParameters: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpConstant, 0),
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpJumpUnlessGreaterThan, 15),
+						code.Make(code.OpAddLocalConstant, 0, 1),
+						code.Make(code.OpJump, 19),
+						code.Make(code.OpSubLocalConstant, 0, 2),
+						code.Make(code.OpReturnValue),
+					),
+				},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			),
+		},
+		{
+			//the consequence jumps to OpConstant, which must not be fused with the OpGetLocal before it.
+			input: `fn(a) { (if (a) { a } else { a }) - 1 }`,
+			wantConstants: []object.Object{
+				&object.Integer{Value: 1},
+				&obj.CompiledFunction{
+					NumLocals:     1,
+					NumParameters: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpJumpNotTruthy, 10),
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpJump, 12),
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpConstant, 0),
+						code.Make(code.OpSub),
+						code.Make(code.OpReturnValue),
+					),
+				},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			),
+		},
+		{
+			//the consequence of the inner if jumps to the outer OpJumpNotTruthy, right after the comparison.
+			input: `if (if (true) { false } else { 1 > 2 }) { 3 }`,
+			wantConstants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+				&object.Integer{Value: 3},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 8),
+				code.Make(code.OpFalse),
+				code.Make(code.OpJump, 15),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterThan),
+				code.Make(code.OpJumpNotTruthy, 24),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpJump, 25),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			),
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+const countdown = `
+let countdown = fn(n, acc) { if (n == 0) { acc } else { countdown(n - 1, acc + 1) } };
+let run = fn() { countdown(500, 0) };
+`
+
+const fibonacci = `
+let fibonacci = fn(x) { if (x < 2) { x } else { fibonacci(x - 1) + fibonacci(x - 2) } };
+let run = fn() { fibonacci(20) };
+`
+
+func BenchmarkSuperinstructions(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		input string
+	}{
+		{"countdown", countdown},
+		{"fibonacci", fibonacci},
+	} {
+		b.Run(bench.name+"/plain", func(b *testing.B) {
+			comp := compiler.New()
+			compiler.DisableSuperinstructions(comp)
+			runBenchmark(b, comp, bench.input)
+		})
+		b.Run(bench.name+"/fused", func(b *testing.B) {
+			runBenchmark(b, compiler.New(), bench.input)
+		})
+	}
+}
+
+// runBenchmark compiles input, which defines a function run, and runs it once to define its globals.
+// Only the calls of run are timed, on the same VM, so that neither compiling nor allocating the VM is.
+func runBenchmark(b *testing.B, comp *compiler.Compiler, input string) {
+	b.Helper()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		b.Fatalf("compiler failed to Compile: (error: %s)", err)
+	}
+	run, _ := comp.SymbolTable().Resolve("run")
+	globals := make([]object.Object, vm.GlobalSize)
+	sut := vm.NewWithGlobalStore(comp.Bytecode(), globals)
+	err = sut.Run()
+	if err != nil {
+		b.Fatalf("vm failed to run: (error: %s)", err)
+	}
+	b.ResetTimer()
+	for range b.N {
+		_, err := sut.Call(globals[run.Index])
+		if err != nil {
+			b.Fatalf("vm failed to call: (error: %s)", err)
+		}
+	}
+}
+
+func TestInlineCaches(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `let h = {"a": 1}; h["a"]; h["a"]`,
+			wantConstants: []object.Object{
+				&object.String{Value: "a"},
+				&object.Integer{Value: 1},
+				&object.String{Value: "a"},
+				&object.String{Value: "a"},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpIndexConstant, 2, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpIndexConstant, 3, 1),
+				code.Make(code.OpPop),
+			),
+		},
+		{
+			input: `let f = fn(x) { x }; f(1); fn(x) { x }(2); f(3)`,
+			wantConstants: []object.Object{
+				&obj.CompiledFunction{
+					NumLocals:     1,
+					NumParameters: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpReturnValue),
+					),
+				},
+				&object.Integer{Value: 1},
+				&obj.CompiledFunction{
+					NumLocals:     1,
+					NumParameters: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpReturnValue),
+					),
+				},
+				&object.Integer{Value: 2},
+				&object.Integer{Value: 3},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCallCached, 1, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpCallCached, 1, 1),
+				code.Make(code.OpPop),
+			),
+		},
+	}
+	runCompilerTests(t, tests)
+
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn(h) { h["a"] }; f({"a": 1})`))
+	if err != nil {
+		t.Fatalf("compiler failed to Compile: (error: %s)", err)
+	}
+	assert.Equal(t, 2, comp.Bytecode().NumCaches)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn(f) { f(1) }`,
+			wantConstants: []object.Object{
+				&object.Integer{Value: 1},
+				&obj.CompiledFunction{
+					NumLocals:     1,
+					NumParameters: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpConstant, 0),
+						code.Make(code.OpTailCall, 1),
+						code.Make(code.OpReturnValue),
+					),
+				},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			),
+		},
+		{
+			input: `fn(f) { if (true) { f(1) } else { 2 } }`,
+			wantConstants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+				&obj.CompiledFunction{
+					NumLocals:     1,
+					NumParameters: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpTrue),
+						code.Make(code.OpJumpNotTruthy, 14),
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpConstant, 0),
+						code.Make(code.OpTailCall, 1),
+						code.Make(code.OpJump, 17),
+						code.Make(code.OpConstant, 1),
+						code.Make(code.OpReturnValue),
+					),
+				},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			),
+		},
+		{
+			input: `fn(f) { if (f(1)) { return f(2); } let x = f(3); f(x) + 4 }`,
+			wantConstants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+				&object.Integer{Value: 3},
+				&object.Integer{Value: 4},
+				&obj.CompiledFunction{
+					NumLocals:     2,
+					NumParameters: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpConstant, 0),
+						code.Make(code.OpCall, 1),
+						code.Make(code.OpJumpNotTruthy, 18),
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpConstant, 1),
+						code.Make(code.OpTailCall, 1),
+						code.Make(code.OpReturnValue),
+						code.Make(code.OpNull),
+						code.Make(code.OpPop),
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpConstant, 2),
+						code.Make(code.OpCall, 1),
+						code.Make(code.OpSetLocal, 1),
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpGetLocal, 1),
+						code.Make(code.OpCall, 1),
+						code.Make(code.OpConstant, 3),
+						code.Make(code.OpAdd),
+						code.Make(code.OpReturnValue),
+					),
+				},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 4, 0),
+				code.Make(code.OpPop),
+			),
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestDeadCode(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn() { return 1; 2 }`,
+			wantConstants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+				&obj.CompiledFunction{
+					Instructions: concatInstructions(
+						code.Make(code.OpConstant, 0),
+						code.Make(code.OpReturnValue),
+					),
+				},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			),
+		},
+		{
+			input: `fn() { let a = 1; let b = 2; b }`,
+			wantConstants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+				&obj.CompiledFunction{
+					NumLocals: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpConstant, 1),
+						code.Make(code.OpSetLocal, 0),
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpReturnValue),
+					),
+				},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			),
+		},
+		{
+			input: `fn(x) { if (x) { return 1; } else { return 2; } }`,
+			wantConstants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+				&obj.CompiledFunction{
+					NumLocals:     1,
+					NumParameters: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpJumpNotTruthy, 9),
+						code.Make(code.OpConstant, 0),
+						code.Make(code.OpReturnValue),
+						code.Make(code.OpConstant, 1),
+						code.Make(code.OpReturnValue),
+						code.Make(code.OpReturnValue),
+					),
+				},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			),
+		},
+		{
+			input: `let a = 1; let b = 2; b`,
+			wantConstants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpPop),
+			),
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestDeadCodeWarnings(t *testing.T) {
+	tests := []struct {
+		input        string
+		wholeProgram bool
+		want         []string
+	}{
+		{`fn() { return 1; 2; 3 }`, false, []string{"unreachable code after return: 2"}},
+		{`fn() { let a = 1; let b = [2, {"c": fn() { a }}]; let d = puts(4); }`, false, []string{"unused binding: b"}},
+		{`fn() { return 1; let a = 2; }`, false, []string{"unreachable code after return: let a = 2;"}},
+		{`let a = 1; let b = fn() { a }; b()`, false, nil},
+		{`let a = 1; let b = fn() { 2 }; let c = len(""); b()`, true, []string{"unused binding: a"}},
+	}
+	for _, tt := range tests {
+		comp := compiler.New()
+		comp.SetWholeProgram(tt.wholeProgram)
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler failed to Compile: (error: %s)", err)
+		}
+		assert.Equal(t, tt.want, comp.Warnings(), tt.input)
+	}
+
+	comp := compiler.New()
+	comp.SetWholeProgram(true)
+	err := comp.Compile(parse(`let a = 1; let b = 2; b`))
+	if err != nil {
+		t.Fatalf("compiler failed to Compile: (error: %s)", err)
+	}
+	_, ok := comp.SymbolTable().Resolve("a")
+	assert.False(t, ok)
+	assert.Equal(t, concatInstructions(
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpPop),
+	), comp.Bytecode().Instructions)
+
+	err = compiler.New().Compile(parse(`fn() { return 1; x }`))
+	assert.EqualError(t, err, "undefined variable: x")
+}
+
+func TestInlining(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `let add = fn(a, b) { a + b }; fn(x) { add(x, 2) }`,
+			wantConstants: []object.Object{
+				&obj.CompiledFunction{
+					NumLocals:     2,
+					NumParameters: 2,
+					Instructions: concatInstructions(
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpGetLocal, 1),
+						code.Make(code.OpAdd),
+						code.Make(code.OpReturnValue),
+					),
+				},
+				&object.Integer{Value: 2},
+				&obj.CompiledFunction{
+					NumLocals:     3,
+					NumParameters: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpConstant, 1),
+						code.Make(code.OpSetLocal, 2),
+						code.Make(code.OpSetLocal, 1),
+						code.Make(code.OpGetLocal, 1),
+						code.Make(code.OpGetLocal, 2),
+						code.Make(code.OpAdd),
+						code.Make(code.OpReturnValue),
+					),
+				},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			),
+		},
+		{
+			input: `let f = fn(n) { f(n) }; fn() { f(1) }`,
+			wantConstants: []object.Object{
+				&obj.CompiledFunction{
+					NumLocals:     1,
+					NumParameters: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpGetGlobal, 0),
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpTailCall, 1),
+						code.Make(code.OpReturnValue),
+					),
+				},
+				&object.Integer{Value: 1},
+				&obj.CompiledFunction{
+					Instructions: concatInstructions(
+						code.Make(code.OpGetGlobal, 0),
+						code.Make(code.OpConstant, 1),
+						code.Make(code.OpTailCall, 1),
+						code.Make(code.OpReturnValue),
+					),
+				},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			),
+		},
+		{
+			input: `let inc = fn(a) { a + 1 }; fn(x) { inc(x) * inc(x) }`,
+			wantConstants: []object.Object{
+				&object.Integer{Value: 1},
+				&obj.CompiledFunction{
+					NumLocals:     1,
+					NumParameters: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpAddLocalConstant, 0, 0),
+						code.Make(code.OpReturnValue),
+					),
+				},
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 1},
+				&obj.CompiledFunction{
+					NumLocals:     2,
+					NumParameters: 1,
+					Instructions: concatInstructions(
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpSetLocal, 1),
+						code.Make(code.OpAddLocalConstant, 1, 2),
+						code.Make(code.OpGetLocal, 0),
+						code.Make(code.OpSetLocal, 1),
+						code.Make(code.OpAddLocalConstant, 1, 3),
+						code.Make(code.OpMul),
+						code.Make(code.OpReturnValue),
+					),
+				},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 4, 0),
+				code.Make(code.OpPop),
+			),
+		},
+	}
+	runCompilerTests(t, tests, func(c *compiler.Compiler) { c.SetInlining(true) })
+
+	//Inlining is off by default.
+	runCompilerTests(t, []compilerTestCase{
+		{
+			input: `let f = fn() { 1 }; fn() { f() }`,
+			wantConstants: []object.Object{
+				&object.Integer{Value: 1},
+				&obj.CompiledFunction{
+					Instructions: concatInstructions(
+						code.Make(code.OpConstant, 0),
+						code.Make(code.OpReturnValue),
+					),
+				},
+				&obj.CompiledFunction{
+					Instructions: concatInstructions(
+						code.Make(code.OpGetGlobal, 0),
+						code.Make(code.OpTailCall, 0),
+						code.Make(code.OpReturnValue),
+					),
+				},
+			},
+			wantInstructions: concatInstructions(
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			),
+		},
+	})
+}
+
+// localNames returns n distinct identifiers, which cannot contain digits.
+func localNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = "v" + string(rune('a'+i/26)) + string(rune('a'+i%26))
+	}
+	return names
+}
+
+func TestInliningRespectsLocalLimit(t *testing.T) {
+	tests := []struct {
+		numLets       int
+		wantNumLocals int
+		wantInlined   bool
+	}{
+		{numLets: 253, wantNumLocals: 256, wantInlined: true},
+		{numLets: 254, wantNumLocals: 255, wantInlined: false},
+	}
+	a := assert.New(t)
+	for _, tt := range tests {
+		var body strings.Builder
+		for _, name := range localNames(tt.numLets) {
+			fmt.Fprintf(&body, "let %s = x + 1; ", name)
+		}
+		input := fmt.Sprintf("let add = fn(a, b) { a + b }; fn(x) { %s add(x, x) }", body.String())
+		comp := compiler.New()
+		comp.SetInlining(true)
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler failed to Compile: (error: %s)", err)
+		}
+		constants := comp.Bytecode().Constants
+		fn := constants[len(constants)-1].(*obj.CompiledFunction)
+		a.Equal(tt.wantNumLocals, fn.NumLocals)
+		a.Equal(!tt.wantInlined, strings.Contains(fn.Instructions.String(), "OpTailCall"))
+	}
+}
@@ -0,0 +1,125 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/monkey/ast"
+)
+
+// SetWholeProgram makes the compiler treat each compiled program as the whole program, so that unused
+// global bindings get dropped as unused local ones do. It must not be set when globals are looked up
+// by name after compilation, as the REPL and the engine do, or when a program is compiled in pieces.
+func (c *Compiler) SetWholeProgram(on bool) {
+	c.wholeProgram = on
+}
+
+// Warnings returns the warnings reported so far, such as unreachable code and unused bindings.
+func (c *Compiler) Warnings() []string {
+	return c.warnings
+}
+
+func (c *Compiler) warn(format string, a ...any) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, a...))
+}
+
+// compileStatements compiles the statements of a block, the last one with compileLast.
+// Statements after a return statement are unreachable: they are compiled for their errors only, and their
+// instructions are dropped.
+func (c *Compiler) compileStatements(stmts []ast.Statement, compileLast func(ast.Node) error) error {
+	for i, s := range stmts {
+		compile := c.Compile
+		if i == len(stmts)-1 {
+			compile = compileLast
+		}
+		err := compile(s)
+		if err != nil {
+			return err
+		}
+		if _, ok := s.(*ast.ReturnStatement); ok && i < len(stmts)-1 {
+			c.warn("unreachable code after return: %s", stmts[i+1].String())
+			return c.discard(func() error {
+				for _, s := range stmts[i+1:] {
+					err := c.Compile(s)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+	}
+	return nil
+}
+
+// discard runs compile and drops the instructions, handlers and warnings it has produced.
+// Constants and symbols it has defined are kept, since nothing refers to them.
+func (c *Compiler) discard(compile func() error) error {
+	scope := c.scopes[c.scopeIndex]
+	numWarnings := len(c.warnings)
+	err := compile()
+	s := &c.scopes[c.scopeIndex]
+	s.instructions = s.instructions[:len(scope.instructions)]
+	s.handlers = s.handlers[:len(scope.handlers)]
+	s.lastInstruction = scope.lastInstruction
+	s.previousInstruction = scope.previousInstruction
+	s.lastTarget = scope.lastTarget
+	c.warnings = c.warnings[:numWarnings]
+	return err
+}
+
+// isUnused reports whether the binding of a let statement can be dropped: its value has no side effects
+// and nothing in the current scope refers to its name.
+func (c *Compiler) isUnused(node *ast.LetStatement) bool {
+	uses := c.scopes[c.scopeIndex].uses
+	return uses != nil && !uses[node.Name.Value] && isPure(node.Value)
+}
+
+// isPure reports whether evaluating node can neither fail nor have side effects.
+func isPure(node ast.Expression) bool {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral, *ast.StringLiteral, *ast.Boolean, *ast.Identifier, *ast.FunctionLiteral:
+		return true
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			if !isPure(el) {
+				return false
+			}
+		}
+		return true
+	case *ast.HashLiteral:
+		for k, v := range node.Pairs {
+			switch k.(type) {
+			case *ast.IntegerLiteral, *ast.StringLiteral, *ast.Boolean:
+			default:
+				return false
+			}
+			if !isPure(v) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// collectUses adds the names of the identifiers that node refers to, in nested functions as well, to uses.
+// The names bound by let statements and parameters are not uses of their own.
+func collectUses(node ast.Node, uses map[string]bool) {
+	inspect(node, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Identifier); ok {
+			uses[ident.Value] = true
+		}
+		return true
+	})
+}
+
+// endsWithExit reports whether the last instruction emitted leaves the function and no jump targets
+// the position after it, so that the next instruction cannot be reached from there.
+func (c *Compiler) endsWithExit() bool {
+	scope := c.scopes[c.scopeIndex]
+	if scope.lastTarget == len(scope.instructions) {
+		return false
+	}
+	return c.lastInstructionIs(code.OpReturnValue) || c.lastInstructionIs(code.OpReturn) || c.lastInstructionIs(code.OpThrow)
+}
@@ -26,3 +26,6 @@ func EnterScope(c *Compiler) {
 func LeaveScope(c *Compiler) {
 	c.leaveScope()
 }
+func DisableSuperinstructions(c *Compiler) {
+	c.plain = true
+}
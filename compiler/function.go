@@ -0,0 +1,143 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/monkey/ast"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// paramsFunc is the name of the call expression which gives a function literal default parameter values
+// and a rest parameter, since the parser only knows plain parameters:
+// `params(fn(a, b, rest) { ... }, {"b": 2}, "rest")` stands for `fn(a, b = 2, ...rest) { ... }`.
+// The rest parameter is optional, and the defaults may be empty.
+const paramsFunc = "params"
+
+// parameter is a parameter of a function literal. value is nil for a required parameter.
+type parameter struct {
+	name  string
+	value ast.Expression //value is the default value, evaluated at call time when the arg is missing.
+	rest  bool
+}
+
+// compileFunction compiles a function literal with the given parameters. Parameters with a default value
+// must follow the required ones, and a rest parameter must be the last one.
+//
+// The instructions start with one block per default value, which sets the parameter to the default.
+// A call passing k of the optional args starts at Entries[k], skipping the blocks of the args it has passed.
+func (c *Compiler) compileFunction(node *ast.FunctionLiteral, params []parameter) error {
+	numOptional := 0
+	variadic := false
+	for i, p := range params {
+		switch {
+		case p.rest && i != len(params)-1:
+			return fmt.Errorf("rest parameter must be the last parameter: %s", p.name)
+		case p.rest && p.value != nil:
+			return fmt.Errorf("rest parameter cannot have a default value: %s", p.name)
+		case p.rest:
+			variadic = true
+		case p.value != nil:
+			numOptional++
+		case numOptional > 0:
+			return fmt.Errorf("required parameter follows a parameter with a default value: %s", p.name)
+		}
+	}
+
+	c.enterScope()
+	c.scopes[c.scopeIndex].uses = make(map[string]bool)
+	collectUses(node.Body, c.scopes[c.scopeIndex].uses)
+	symbols := make([]Symbol, len(params))
+	for i, p := range params {
+		symbols[i] = c.symbolTable.Define(p.name)
+	}
+	var entries []int
+	if numOptional > 0 {
+		for i, p := range params {
+			if p.value == nil || p.rest {
+				continue
+			}
+			entries = append(entries, c.jumpTarget())
+			err := c.Compile(p.value)
+			if err != nil {
+				return err
+			}
+			c.emit(code.OpSetLocal, symbols[i].Index)
+		}
+		entries = append(entries, c.jumpTarget())
+	}
+	err := c.compileTail(node.Body)
+	if err != nil {
+		return err
+	}
+	if c.lastInstructionIs(code.OpPop) {
+		c.replaceLastPopWithReturn()
+	}
+	if !c.lastInstructionIs(code.OpReturnValue) {
+		c.emit(code.OpReturn)
+	}
+	freeSymbols := c.symbolTable.FreeSymbols
+	numLocals := c.symbolTable.numDefinitions
+	handlers := c.scopes[c.scopeIndex].handlers
+	ins := c.leaveScope()
+
+	for _, s := range freeSymbols {
+		c.loadSymbol(s)
+	}
+	compiledFn := &obj.CompiledFunction{
+		Instructions:  ins,
+		NumLocals:     numLocals,
+		NumParameters: len(params),
+		NumOptional:   numOptional,
+		Variadic:      variadic,
+		Entries:       entries,
+		Handlers:      handlers,
+	}
+	fnIndex := c.addConstant(compiledFn)
+	c.emit(code.OpClosure, fnIndex, len(freeSymbols))
+	return nil
+}
+
+func (c *Compiler) compileParams(node *ast.CallExpression) error {
+	if len(node.Arguments) != 2 && len(node.Arguments) != 3 {
+		return fmt.Errorf("wrong number of args for params: (got=%d want=2 or 3)", len(node.Arguments))
+	}
+	fn, ok := node.Arguments[0].(*ast.FunctionLiteral)
+	if !ok {
+		return fmt.Errorf("params expects a function literal: (got=%s)", node.Arguments[0].String())
+	}
+	defaults, ok := node.Arguments[1].(*ast.HashLiteral)
+	if !ok {
+		return fmt.Errorf("params expects a hash literal of default values: (got=%s)", node.Arguments[1].String())
+	}
+	rest := ""
+	if len(node.Arguments) == 3 {
+		lit, ok := node.Arguments[2].(*ast.StringLiteral)
+		if !ok {
+			return fmt.Errorf("params expects the name of the rest parameter: (got=%s)", node.Arguments[2].String())
+		}
+		rest = lit.Value
+	}
+
+	params := make([]parameter, len(fn.Parameters))
+	index := make(map[string]int, len(fn.Parameters))
+	for i, p := range fn.Parameters {
+		params[i] = parameter{name: p.Value, rest: p.Value == rest}
+		index[p.Value] = i
+	}
+	if _, ok := index[rest]; rest != "" && !ok {
+		return fmt.Errorf("undefined parameter: %s", rest)
+	}
+	for key, value := range defaults.Pairs {
+		lit, ok := key.(*ast.StringLiteral)
+		if !ok {
+			return fmt.Errorf("default values must be keyed by parameter names: (got=%s)", key.String())
+		}
+		i, ok := index[lit.Value]
+		if !ok {
+			return fmt.Errorf("undefined parameter: %s", lit.Value)
+		}
+		params[i].value = value
+	}
+	return c.compileFunction(fn, params)
+}
@@ -0,0 +1,172 @@
+package compiler
+
+import (
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/monkey/ast"
+)
+
+// maxInlineSize is the number of AST nodes up to which the body of a function is inlined.
+const maxInlineSize = 16
+
+// maxLocals is the number of local slots the one-byte operands of OpGetLocal and OpSetLocal can address.
+const maxLocals = 256
+
+// inlineCandidate is a function literal bound to a global, which calls inside functions get inlined.
+type inlineCandidate struct {
+	fn        *ast.FunctionLiteral
+	globals   *SymbolTable //globals holds the symbols the names in the body resolved to where the function is defined.
+	numLocals int          //numLocals is the number of locals the body needs: its parameters and let bindings.
+}
+
+// SetInlining turns inlining on or off. It is off by default, since it is only correct as long as
+// nothing but the program itself stores into its globals, which the engine and hosts calling into
+// the VM with their own global store do.
+func (c *Compiler) SetInlining(on bool) {
+	c.inline = on
+}
+
+// recordInlinable records the function bound by a let statement at global scope, if it can be inlined.
+// Every let statement defines a new global slot, so the slot keeps referring to the same function for good.
+// The globals the body refers to are resolved here, as they are when the function itself is compiled,
+// since later let statements may bind their names to other slots.
+func (c *Compiler) recordInlinable(s Symbol, node *ast.LetStatement) {
+	fn, ok := node.Value.(*ast.FunctionLiteral)
+	if !ok || s.Scope != GlobalScope || !canInline(node.Name.Value, fn) {
+		return
+	}
+	uses := make(map[string]bool)
+	collectUses(fn.Body, uses)
+	globals := NewSymbolTable()
+	for name := range uses {
+		if sym, ok := c.symbolTable.Resolve(name); ok {
+			globals.store[name] = sym
+		}
+	}
+	numLocals := len(fn.Parameters)
+	inspect(fn.Body, func(n ast.Node) bool {
+		if _, ok := n.(*ast.LetStatement); ok {
+			numLocals++
+		}
+		return true
+	})
+	c.inlinable[s.Index] = inlineCandidate{fn: fn, globals: globals, numLocals: numLocals}
+}
+
+// canInline reports whether the function bound to name is small and non-recursive, and can be inlined
+// as a sequence of statements: it defines no nested functions and returns only from its last statement.
+func canInline(name string, fn *ast.FunctionLiteral) bool {
+	size := 0
+	ok := true
+	inspect(fn.Body, func(n ast.Node) bool {
+		size++
+		switch n := n.(type) {
+		case *ast.FunctionLiteral:
+			ok = false
+		case *ast.ReturnStatement:
+			stmts := fn.Body.Statements
+			ok = ok && n == stmts[len(stmts)-1]
+		case *ast.Identifier:
+			ok = ok && n.Value != name
+		}
+		return ok && size <= maxInlineSize
+	})
+	return ok && size <= maxInlineSize
+}
+
+// inlineCandidate returns the function to be inlined for a call, if there is one. Only calls inside
+// functions are inlined, since the parameters and bindings of the callee become locals of the caller,
+// and only as long as the caller has local slots left for them.
+func (c *Compiler) inlineCandidate(node *ast.CallExpression) (inlineCandidate, bool) {
+	ident, ok := node.Function.(*ast.Identifier)
+	if !ok || !c.inline || c.inlining || c.symbolTable.Outer == nil {
+		return inlineCandidate{}, false
+	}
+	s, ok := c.symbolTable.Resolve(ident.Value)
+	if !ok || s.Scope != GlobalScope {
+		return inlineCandidate{}, false
+	}
+	cand, ok := c.inlinable[s.Index]
+	if !ok || len(cand.fn.Parameters) != len(node.Arguments) || c.hasSpread(node.Arguments) {
+		return inlineCandidate{}, false
+	}
+	if c.inlineBase()+cand.numLocals > maxLocals {
+		return inlineCandidate{}, false
+	}
+	return cand, true
+}
+
+// inlineBase returns the first local slot for the body of the next inlined call. Inlined bodies never
+// nest and leave nothing behind in their slots, so a call reuses the slots of the previous one as long
+// as the caller has not defined locals of its own after them.
+func (c *Compiler) inlineBase() int {
+	scope := c.scopes[c.scopeIndex]
+	if scope.inlineBase+scope.inlineSize == c.symbolTable.numDefinitions {
+		return scope.inlineBase
+	}
+	return c.symbolTable.numDefinitions
+}
+
+// compileInline compiles a call as the body of the callee, leaving its return value on the stack.
+// The args are stored into locals of the caller standing for the parameters, and the names in
+// the body resolve against the globals of the callee, so that locals of the caller cannot shadow them.
+func (c *Compiler) compileInline(node *ast.CallExpression, cand inlineCandidate) error {
+	for _, a := range node.Arguments {
+		err := c.Compile(a)
+		if err != nil {
+			return err
+		}
+	}
+	caller := c.symbolTable
+	base := c.inlineBase()
+	table := NewEnclosedSymbolTable(cand.globals)
+	table.numDefinitions = base
+	params := make([]Symbol, len(cand.fn.Parameters))
+	for i, p := range cand.fn.Parameters {
+		params[i] = table.Define(p.Value)
+	}
+	for i := len(params) - 1; i >= 0; i-- {
+		c.emit(code.OpSetLocal, params[i].Index)
+	}
+
+	scope := &c.scopes[c.scopeIndex]
+	uses := scope.uses
+	scope.uses = make(map[string]bool)
+	collectUses(cand.fn.Body, scope.uses)
+	c.symbolTable = table
+	c.inlining = true
+	err := c.compileInlineBody(cand.fn.Body.Statements)
+	c.inlining = false
+	c.symbolTable = caller
+	scope = &c.scopes[c.scopeIndex]
+	scope.uses = uses
+	scope.inlineBase = base
+	scope.inlineSize = max(scope.inlineSize, table.numDefinitions-base)
+	caller.numDefinitions = max(caller.numDefinitions, base+scope.inlineSize)
+	return err
+}
+
+func (c *Compiler) compileInlineBody(stmts []ast.Statement) error {
+	if len(stmts) == 0 {
+		c.emit(code.OpNull)
+		return nil
+	}
+	for _, s := range stmts[:len(stmts)-1] {
+		err := c.Compile(s)
+		if err != nil {
+			return err
+		}
+	}
+	switch last := stmts[len(stmts)-1].(type) {
+	case *ast.ExpressionStatement:
+		return c.Compile(last.Expression)
+	case *ast.ReturnStatement:
+		return c.Compile(last.ReturnValue)
+	default:
+		err := c.Compile(last)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpNull)
+		return nil
+	}
+}
@@ -0,0 +1,57 @@
+package compiler
+
+import "github.com/taimats/sarupiler/monkey/ast"
+
+// inspect traverses node depth-first, calling f for node and then for each of its children as long as
+// f returns true. The identifiers bound by let statements and parameters are not visited.
+func inspect(node ast.Node, f func(ast.Node) bool) {
+	if !f(node) {
+		return
+	}
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			inspect(s, f)
+		}
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			inspect(s, f)
+		}
+	case *ast.ExpressionStatement:
+		inspect(node.Expression, f)
+	case *ast.LetStatement:
+		inspect(node.Value, f)
+	case *ast.ReturnStatement:
+		inspect(node.ReturnValue, f)
+	case *ast.PrefixExpression:
+		inspect(node.Right, f)
+	case *ast.InfixExpression:
+		inspect(node.Left, f)
+		inspect(node.Right, f)
+	case *ast.IfExpression:
+		inspect(node.Condition, f)
+		inspect(node.Consequence, f)
+		if node.Alternative != nil {
+			inspect(node.Alternative, f)
+		}
+	case *ast.FunctionLiteral:
+		inspect(node.Body, f)
+	case *ast.CallExpression:
+		inspect(node.Function, f)
+		for _, a := range node.Arguments {
+			inspect(a, f)
+		}
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			inspect(el, f)
+		}
+	case *ast.IndexExpression:
+		inspect(node.Left, f)
+		inspect(node.Index, f)
+	case *ast.HashLiteral:
+		for k, v := range node.Pairs {
+			inspect(k, f)
+			inspect(v, f)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package compiler
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/monkey/ast"
+	"github.com/taimats/sarupiler/monkey/lexer"
+	"github.com/taimats/sarupiler/monkey/object"
+	"github.com/taimats/sarupiler/monkey/parser"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// importFunc is the name of the call expression compiled as an import, e.g. `let m = import("math");`.
+const importFunc = "import"
+
+// moduleSlotPrefix prefixes the hidden global that caches the object of an imported module.
+const moduleSlotPrefix = "import:"
+
+// Loader resolves and loads the source of imported modules.
+type Loader interface {
+	// Resolve returns the canonical name of the module imported as path from the module named from.
+	// from is empty when the main program imports a module.
+	Resolve(from, path string) (string, error)
+	// Load returns the source of the module with the canonical name.
+	Load(name string) (string, error)
+}
+
+// FileLoader loads modules from the file system. Paths starting with "./" or "../" are relative to the
+// importing module, and other paths are relative to Root.
+type FileLoader struct {
+	Root string
+}
+
+func (l FileLoader) Resolve(from, p string) (string, error) {
+	if from != "" && (strings.HasPrefix(p, "./") || strings.HasPrefix(p, "../")) {
+		return filepath.Join(filepath.Dir(from), p), nil
+	}
+	return filepath.Abs(filepath.Join(l.Root, p))
+}
+
+func (l FileLoader) Load(name string) (string, error) {
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return string(src), nil
+}
+
+// MapLoader loads modules from memory, keyed by slash-separated paths.
+type MapLoader map[string]string
+
+func (l MapLoader) Resolve(from, p string) (string, error) {
+	if from != "" && (strings.HasPrefix(p, "./") || strings.HasPrefix(p, "../")) {
+		return path.Join(path.Dir(from), p), nil
+	}
+	return path.Clean(p), nil
+}
+
+func (l MapLoader) Load(name string) (string, error) {
+	src, ok := l[name]
+	if !ok {
+		return "", fmt.Errorf("module not found: %s", name)
+	}
+	return src, nil
+}
+
+// module is a compiled module. The module body is compiled to a function which defines the module's
+// globals and returns a hash of its exports, and the returned hash is cached in a hidden global.
+type module struct {
+	fnIndex int
+	slot    Symbol
+}
+
+// SetLoader sets the loader used to resolve imports. Without a loader, imports fail to compile.
+func (c *Compiler) SetLoader(l Loader) {
+	c.loader = l
+}
+
+// isIntrinsic reports whether node calls the intrinsic name, which the compiler translates itself
+// unless the script has defined a binding of the same name.
+func (c *Compiler) isIntrinsic(node *ast.CallExpression, name string) bool {
+	ident, ok := node.Function.(*ast.Identifier)
+	if !ok || ident.Value != name {
+		return false
+	}
+	_, defined := c.symbolTable.Resolve(name)
+	return !defined
+}
+
+// compileImport emits instructions which push the module object, running the module body on first use.
+func (c *Compiler) compileImport(node *ast.CallExpression) error {
+	if len(node.Arguments) != 1 {
+		return fmt.Errorf("wrong number of args for import: (got=%d want=1)", len(node.Arguments))
+	}
+	lit, ok := node.Arguments[0].(*ast.StringLiteral)
+	if !ok {
+		return fmt.Errorf("import path must be a string literal: (got=%s)", node.Arguments[0].String())
+	}
+	if c.loader == nil {
+		return fmt.Errorf("cannot import %q: no module loader", lit.Value)
+	}
+	from := ""
+	if len(c.importing) > 0 {
+		from = c.importing[len(c.importing)-1]
+	}
+	name, err := c.loader.Resolve(from, lit.Value)
+	if err != nil {
+		return fmt.Errorf("cannot resolve import %q: %w", lit.Value, err)
+	}
+	mod, ok := c.modules[name]
+	if !ok {
+		mod, err = c.compileModule(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.emit(code.OpGetGlobal, mod.slot.Index)
+	jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+	c.emit(code.OpGetGlobal, mod.slot.Index)
+	jumpPos := c.emit(code.OpJump, 9999)
+	c.changeOperand(jumpNotTruthyPos, c.jumpTarget())
+	c.emit(code.OpClosure, mod.fnIndex, 0)
+	c.emit(code.OpCall, 0)
+	c.emit(code.OpSetGlobal, mod.slot.Index)
+	c.emit(code.OpGetGlobal, mod.slot.Index)
+	c.changeOperand(jumpPos, c.jumpTarget())
+	return nil
+}
+
+func (c *Compiler) compileModule(name string) (*module, error) {
+	if i := slices.Index(c.importing, name); i >= 0 {
+		cycle := append(slices.Clone(c.importing[i:]), name)
+		return nil, fmt.Errorf("import cycle: %s", strings.Join(cycle, " -> "))
+	}
+	src, err := c.loader.Load(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load module %s: %w", name, err)
+	}
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		return nil, fmt.Errorf("failed to parse module %s: %s", name, strings.Join(errs, "; "))
+	}
+	c.SetSourceMap(NewSourceMap(src, program))
+
+	// Module bindings are globals of their own namespace, allocated after the globals defined so far.
+	globals := c.symbolTable
+	for globals.Outer != nil {
+		globals = globals.Outer
+	}
+	modTable := NewSymbolTable()
+	modTable.numDefinitions = globals.numDefinitions
+	DefineBuiltins(modTable, c.builtins)
+
+	outer := c.symbolTable
+	c.scopes = append(c.scopes, CompilationScope{instructions: code.Instructions{}})
+	c.scopeIndex++
+	c.symbolTable = modTable
+	c.importing = append(c.importing, name)
+	leave := func() code.Instructions {
+		ins := c.currentInstructions()
+		c.scopes = c.scopes[:len(c.scopes)-1]
+		c.scopeIndex--
+		c.symbolTable = outer
+		c.importing = c.importing[:len(c.importing)-1]
+		return ins
+	}
+	err = c.Compile(program)
+	if err != nil {
+		leave()
+		return nil, fmt.Errorf("in module %s: %w", name, err)
+	}
+	exports := moduleExports(modTable)
+	for _, s := range exports {
+		c.emit(code.OpConstant, c.addConstant(&object.String{Value: s.Name}))
+		c.emit(code.OpGetGlobal, s.Index)
+	}
+	c.emit(code.OpHash, len(exports)*2)
+	c.emit(code.OpReturnValue)
+	handlers := c.scopes[c.scopeIndex].handlers
+	ins := leave()
+
+	globals.numDefinitions = modTable.numDefinitions
+	mod := &module{
+		fnIndex: c.addConstant(&obj.CompiledFunction{Instructions: ins, Handlers: handlers}),
+		slot:    globals.Define(moduleSlotPrefix + name),
+	}
+	c.modules[name] = mod
+	return mod, nil
+}
+
+// moduleExports returns the globals of a module visible to importers, sorted by name.
+// Names starting with an underscore are private to the module.
+func moduleExports(s *SymbolTable) []Symbol {
+	var exports []Symbol
+	for name, sym := range s.store {
+		if sym.Scope != GlobalScope || strings.HasPrefix(name, "_") || isHidden(name) {
+			continue
+		}
+		exports = append(exports, sym)
+	}
+	slices.SortFunc(exports, func(a, b Symbol) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return exports
+}
@@ -0,0 +1,75 @@
+package compiler_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taimats/sarupiler/compiler"
+)
+
+func TestImportErrors(t *testing.T) {
+	loader := compiler.MapLoader{
+		"a":       `let x = import("b");`,
+		"b":       `let y = import("c");`,
+		"c":       `let z = import("a");`,
+		"self":    `import("self");`,
+		"broken":  `let = 1;`,
+		"undef":   `missing;`,
+		"lib/one": `let two = import("./two");`,
+	}
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`import("a")`, "in module a: in module b: in module c: import cycle: a -> b -> c -> a"},
+		{`import("self")`, "in module self: import cycle: self -> self"},
+		{`import("missing")`, "cannot load module missing: module not found: missing"},
+		{`import("undef")`, "in module undef: undefined variable: missing"},
+		{`import("lib/one")`, "in module lib/one: cannot load module lib/two: module not found: lib/two"},
+		{`import(1)`, "import path must be a string literal: (got=1)"},
+		{`import("a", "b")`, "wrong number of args for import: (got=2 want=1)"},
+	}
+	for _, tt := range tests {
+		comp := compiler.New()
+		comp.SetLoader(loader)
+		err := comp.Compile(parse(tt.input))
+		assert.EqualError(t, err, tt.want, tt.input)
+	}
+
+	comp := compiler.New()
+	comp.SetLoader(loader)
+	err := comp.Compile(parse(`import("broken")`))
+	assert.ErrorContains(t, err, "failed to parse module broken: ")
+
+	comp = compiler.New()
+	err = comp.Compile(parse(`import("a")`))
+	assert.EqualError(t, err, `cannot import "a": no module loader`)
+}
+
+func TestFileLoader(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "lib"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "lib", "math.mk"), []byte(`let helper = import("./helper.mk");`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "lib", "helper.mk"), []byte(`let one = 1;`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader := compiler.FileLoader{Root: dir}
+
+	name, err := loader.Resolve("", "lib/math.mk")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "lib", "math.mk"), name)
+
+	comp := compiler.New()
+	comp.SetLoader(loader)
+	err = comp.Compile(parse(`import("lib/math.mk")`))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,460 @@
+package compiler
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/taimats/sarupiler/monkey/ast"
+	"github.com/taimats/sarupiler/monkey/lexer"
+	"github.com/taimats/sarupiler/monkey/parser"
+	"github.com/taimats/sarupiler/monkey/token"
+)
+
+// Position is a position in the source, counting lines and columns from 1.
+// The zero Position means that the position is unknown.
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	if p.Line == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// SourceMap relates the nodes of a program to its source, which the tokens of the parser know nothing of:
+// it finds the positions of the nodes and the source order of the pairs of hash literals.
+type SourceMap struct {
+	pos  map[ast.Node]Position
+	keys map[*ast.HashLiteral][]ast.Expression
+}
+
+// NewSourceMap maps the nodes of program to src, which program is parsed from.
+func NewSourceMap(src string, program *ast.Program) *SourceMap {
+	toks := scan(src)
+	l := &locator{
+		src:     src,
+		toks:    toks,
+		claimed: make([]bool, len(toks)),
+		m:       &SourceMap{pos: make(map[ast.Node]Position), keys: make(map[*ast.HashLiteral][]ast.Expression)},
+	}
+	l.walk(program, 0)
+	return l.m
+}
+
+// Position returns the position of the first token of node, or of its operator. It is the zero Position
+// if the node is not found in the source.
+func (m *SourceMap) Position(node ast.Node) Position {
+	if m == nil {
+		return Position{}
+	}
+	return m.pos[node]
+}
+
+// HashKeys returns the keys of a hash literal in the order of its pairs in the source. It falls back on
+// the package-level HashKeys if the pairs are not found in the source, or m is nil.
+func (m *SourceMap) HashKeys(node *ast.HashLiteral) []ast.Expression {
+	if m != nil {
+		if keys, ok := m.keys[node]; ok {
+			return keys
+		}
+	}
+	return HashKeys(node)
+}
+
+// SetSourceMap makes the compiler insert the pairs of the hash literals of the program m maps in their
+// source order. The order is kept for the programs compiled later, e.g. for functions inlined into them.
+func (c *Compiler) SetSourceMap(m *SourceMap) {
+	for node, keys := range m.keys {
+		c.hashKeys[node] = keys
+	}
+}
+
+func (c *Compiler) keysOf(node *ast.HashLiteral) []ast.Expression {
+	if keys, ok := c.hashKeys[node]; ok {
+		return keys
+	}
+	return HashKeys(node)
+}
+
+// HashKeys returns the keys of a hash literal in the order their pairs are inserted into the hash when
+// no source map is set. The parser keeps the pairs in a Go map, which loses the source order, so the keys
+// are sorted instead: integers by value, then booleans, then strings, then the other keys by their text.
+func HashKeys(node *ast.HashLiteral) []ast.Expression {
+	keys := make([]ast.Expression, 0, len(node.Pairs))
+	for k := range node.Pairs {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, compareKeys)
+	return keys
+}
+
+func compareKeys(a, b ast.Expression) int {
+	if c := cmp.Compare(keyRank(a), keyRank(b)); c != 0 {
+		return c
+	}
+	switch a := a.(type) {
+	case *ast.IntegerLiteral:
+		return cmp.Compare(a.Value, b.(*ast.IntegerLiteral).Value)
+	case *ast.Boolean:
+		if a.Value == b.(*ast.Boolean).Value {
+			return 0
+		}
+		if a.Value {
+			return 1
+		}
+		return -1
+	}
+	return cmp.Compare(a.String(), b.String())
+}
+
+func keyRank(k ast.Expression) int {
+	switch k.(type) {
+	case *ast.IntegerLiteral:
+		return 0
+	case *ast.Boolean:
+		return 1
+	case *ast.StringLiteral:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// located is a token with its offset and position in the source.
+type located struct {
+	tok    token.Token
+	offset int
+	pos    Position
+}
+
+// scan lexes src and finds the position of each token, by skipping the whitespace the lexer skips before it.
+// It stops at the first token not found where expected, leaving the positions of the rest unknown.
+func scan(src string) []located {
+	lineStarts := []int{0}
+	for i, ch := range src {
+		if ch == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	position := func(offset int) Position {
+		line := sort.SearchInts(lineStarts, offset+1)
+		return Position{Line: line, Column: offset - lineStarts[line-1] + 1}
+	}
+
+	var toks []located
+	l := lexer.New(src)
+	cursor := 0
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		for cursor < len(src) && strings.IndexByte(" \t\n\r", src[cursor]) >= 0 {
+			cursor++
+		}
+		text := tok.Literal
+		if tok.Type == token.STRING {
+			text = `"` + tok.Literal + `"`
+		}
+		if !strings.HasPrefix(src[cursor:], strings.TrimSuffix(text, `"`)) {
+			break
+		}
+		toks = append(toks, located{tok: tok, offset: cursor, pos: position(cursor)})
+		cursor += len(text)
+	}
+	return toks
+}
+
+// locator finds the tokens of AST nodes among the tokens of the source.
+type locator struct {
+	src     string
+	toks    []located
+	claimed []bool
+	m       *SourceMap
+}
+
+// find records the position of the first unclaimed token of node from the token at cur on,
+// and returns the index after it. The parser leaves a node its first token, or its operator.
+func (l *locator) find(node ast.Node, tok token.Token, cur int) int {
+	for i := cur; i < len(l.toks); i++ {
+		t := l.toks[i].tok
+		if !l.claimed[i] && t.Type == tok.Type && t.Literal == tok.Literal {
+			l.claimed[i] = true
+			l.m.pos[node] = l.toks[i].pos
+			return i + 1
+		}
+	}
+	return cur
+}
+
+// walk visits the nodes in the order of their tokens in the source, and returns the index of the token
+// after the last one found.
+func (l *locator) walk(node ast.Node, cur int) int {
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			cur = l.walk(s, cur)
+		}
+	case *ast.LetStatement:
+		cur = l.find(node, node.Token, cur)
+		cur = l.find(node.Name, node.Name.Token, cur)
+		cur = l.walk(node.Value, cur)
+	case *ast.ReturnStatement:
+		cur = l.find(node, node.Token, cur)
+		cur = l.walk(node.ReturnValue, cur)
+	case *ast.ExpressionStatement:
+		cur = l.walk(node.Expression, cur)
+	case *ast.BlockStatement:
+		cur = l.find(node, node.Token, cur)
+		for _, s := range node.Statements {
+			cur = l.walk(s, cur)
+		}
+	case *ast.Identifier:
+		cur = l.find(node, node.Token, cur)
+	case *ast.IntegerLiteral:
+		cur = l.find(node, node.Token, cur)
+	case *ast.StringLiteral:
+		cur = l.find(node, node.Token, cur)
+	case *ast.Boolean:
+		cur = l.find(node, node.Token, cur)
+	case *ast.PrefixExpression:
+		cur = l.find(node, node.Token, cur)
+		cur = l.walk(node.Right, cur)
+	case *ast.InfixExpression:
+		cur = l.walk(node.Left, cur)
+		cur = l.find(node, node.Token, cur)
+		cur = l.walk(node.Right, cur)
+	case *ast.IfExpression:
+		cur = l.find(node, node.Token, cur)
+		cur = l.walk(node.Condition, cur)
+		cur = l.walk(node.Consequence, cur)
+		if node.Alternative != nil {
+			cur = l.walk(node.Alternative, cur)
+		}
+	case *ast.FunctionLiteral:
+		cur = l.find(node, node.Token, cur)
+		for _, p := range node.Parameters {
+			cur = l.find(p, p.Token, cur)
+		}
+		cur = l.walk(node.Body, cur)
+	case *ast.CallExpression:
+		cur = l.walk(node.Function, cur)
+		cur = l.find(node, node.Token, cur)
+		for _, a := range node.Arguments {
+			cur = l.walk(a, cur)
+		}
+	case *ast.ArrayLiteral:
+		cur = l.find(node, node.Token, cur)
+		for _, el := range node.Elements {
+			cur = l.walk(el, cur)
+		}
+	case *ast.IndexExpression:
+		cur = l.walk(node.Left, cur)
+		cur = l.find(node, node.Token, cur)
+		cur = l.walk(node.Index, cur)
+	case *ast.HashLiteral:
+		next := l.find(node, node.Token, cur)
+		if next > cur {
+			if pairs, end, ok := l.pairs(node, next); ok {
+				keys := make([]ast.Expression, len(pairs))
+				for i, p := range pairs {
+					keys[i] = p.key
+					l.walk(p.key, p.keyStart)
+					l.walk(node.Pairs[p.key], p.valueStart)
+				}
+				l.m.keys[node] = keys
+				return end
+			}
+		}
+		//The pairs are not found in the source, so each pair is searched for from the start of the hash
+		//among the tokens not claimed by the other pairs yet.
+		end := next
+		for _, k := range HashKeys(node) {
+			c := l.walk(k, next)
+			end = max(end, l.walk(node.Pairs[k], c))
+		}
+		cur = end
+	}
+	return cur
+}
+
+// pair is a pair of a hash literal with the indices of the first tokens of its key and value.
+type pair struct {
+	key        ast.Expression
+	keyStart   int
+	valueStart int
+}
+
+// pairs splits the tokens of a hash literal from the token at cur, which follows its "{", into its pairs
+// at the commas and colons outside of brackets. Each pair is told by parsing its key and value again, and
+// comparing them with the pairs of node. pairs returns the pairs in the source order with the index after
+// the closing "}", or false if the tokens do not match the pairs of node.
+func (l *locator) pairs(node *ast.HashLiteral, cur int) ([]pair, int, bool) {
+	var pairs []pair
+	matched := make(map[ast.Expression]bool, len(node.Pairs))
+	start, colon, depth := cur, -1, 0
+	for i := cur; i < len(l.toks); i++ {
+		switch l.toks[i].tok.Type {
+		case token.LPAREN, token.LBRACE, token.LBRACKET:
+			depth++
+			continue
+		case token.RPAREN, token.RBRACE, token.RBRACKET:
+			if depth > 0 {
+				depth--
+				continue
+			}
+		case token.COLON:
+			if depth == 0 && colon < 0 {
+				colon = i
+			}
+			continue
+		case token.COMMA:
+			if depth > 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		//The token ends a pair, by a comma or the closing "}".
+		if i > start {
+			if colon < 0 {
+				return nil, 0, false
+			}
+			key := l.match(node, matched, l.text(start, colon), l.text(colon+1, i))
+			if key == nil {
+				return nil, 0, false
+			}
+			pairs = append(pairs, pair{key: key, keyStart: start, valueStart: colon + 1})
+		}
+		if l.toks[i].tok.Type == token.RBRACE {
+			if len(pairs) != len(node.Pairs) {
+				return nil, 0, false
+			}
+			return pairs, i + 1, true
+		}
+		start, colon = i+1, -1
+	}
+	return nil, 0, false
+}
+
+// text returns the source of the tokens from the one at start up to the one at end.
+func (l *locator) text(start, end int) string {
+	if start >= end {
+		return ""
+	}
+	return l.src[l.toks[start].offset:l.toks[end].offset]
+}
+
+// match returns the first key of node not matched yet whose pair is the same as key and value when they
+// are parsed.
+func (l *locator) match(node *ast.HashLiteral, matched map[ast.Expression]bool, key, value string) ast.Expression {
+	k, v := reparse(key), reparse(value)
+	if k == nil || v == nil {
+		return nil
+	}
+	for _, want := range HashKeys(node) {
+		if !matched[want] && sameNode(want, k) && sameNode(node.Pairs[want], v) {
+			matched[want] = true
+			return want
+		}
+	}
+	return nil
+}
+
+// reparse parses src as an expression, or returns nil on failure.
+func reparse(src string) ast.Expression {
+	p := parser.New(lexer.New("(" + src + ")"))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 || len(program.Statements) != 1 {
+		return nil
+	}
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		return nil
+	}
+	return stmt.Expression
+}
+
+// sameNode reports whether a and b are the same tree of nodes. The text of nodes cannot tell, since hash
+// literals print their pairs in the order of a Go map.
+func sameNode(a, b ast.Node) bool {
+	if isNil(a) || isNil(b) {
+		return isNil(a) == isNil(b)
+	}
+	switch a := a.(type) {
+	case *ast.ExpressionStatement:
+		b, ok := b.(*ast.ExpressionStatement)
+		return ok && sameNode(a.Expression, b.Expression)
+	case *ast.LetStatement:
+		b, ok := b.(*ast.LetStatement)
+		return ok && sameNode(a.Name, b.Name) && sameNode(a.Value, b.Value)
+	case *ast.ReturnStatement:
+		b, ok := b.(*ast.ReturnStatement)
+		return ok && sameNode(a.ReturnValue, b.ReturnValue)
+	case *ast.BlockStatement:
+		b, ok := b.(*ast.BlockStatement)
+		return ok && slices.EqualFunc(a.Statements, b.Statements, func(x, y ast.Statement) bool { return sameNode(x, y) })
+	case *ast.PrefixExpression:
+		b, ok := b.(*ast.PrefixExpression)
+		return ok && a.Operator == b.Operator && sameNode(a.Right, b.Right)
+	case *ast.InfixExpression:
+		b, ok := b.(*ast.InfixExpression)
+		return ok && a.Operator == b.Operator && sameNode(a.Left, b.Left) && sameNode(a.Right, b.Right)
+	case *ast.IfExpression:
+		b, ok := b.(*ast.IfExpression)
+		return ok && sameNode(a.Condition, b.Condition) && sameNode(a.Consequence, b.Consequence) &&
+			sameNode(a.Alternative, b.Alternative)
+	case *ast.FunctionLiteral:
+		b, ok := b.(*ast.FunctionLiteral)
+		return ok && slices.EqualFunc(a.Parameters, b.Parameters, func(x, y *ast.Identifier) bool { return x.Value == y.Value }) &&
+			sameNode(a.Body, b.Body)
+	case *ast.CallExpression:
+		b, ok := b.(*ast.CallExpression)
+		return ok && sameNode(a.Function, b.Function) && sameNodes(a.Arguments, b.Arguments)
+	case *ast.ArrayLiteral:
+		b, ok := b.(*ast.ArrayLiteral)
+		return ok && sameNodes(a.Elements, b.Elements)
+	case *ast.IndexExpression:
+		b, ok := b.(*ast.IndexExpression)
+		return ok && sameNode(a.Left, b.Left) && sameNode(a.Index, b.Index)
+	case *ast.HashLiteral:
+		b, ok := b.(*ast.HashLiteral)
+		if !ok || len(a.Pairs) != len(b.Pairs) {
+			return false
+		}
+		matched := make(map[ast.Expression]bool, len(b.Pairs))
+	pairs:
+		for ak, av := range a.Pairs {
+			for bk, bv := range b.Pairs {
+				if !matched[bk] && sameNode(ak, bk) && sameNode(av, bv) {
+					matched[bk] = true
+					continue pairs
+				}
+			}
+			return false
+		}
+		return true
+	}
+	//The other nodes are leaves, which their text tells apart.
+	return a.String() == b.String() && fmt.Sprintf("%T", a) == fmt.Sprintf("%T", b)
+}
+
+func sameNodes(a, b []ast.Expression) bool {
+	return slices.EqualFunc(a, b, func(x, y ast.Expression) bool { return sameNode(x, y) })
+}
+
+// isNil reports whether node is nil or a nil pointer, as an absent else block is.
+func isNil(node ast.Node) bool {
+	if node == nil {
+		return true
+	}
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		return node == nil
+	case *ast.Identifier:
+		return node == nil
+	}
+	return false
+}
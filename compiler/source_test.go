@@ -0,0 +1,106 @@
+package compiler_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taimats/sarupiler/compiler"
+	"github.com/taimats/sarupiler/monkey/ast"
+)
+
+// hashOf returns the first hash literal in program.
+func hashOf(t *testing.T, program *ast.Program) *ast.HashLiteral {
+	t.Helper()
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("not an expression statement: %s", program.Statements[0].String())
+	}
+	hash, ok := stmt.Expression.(*ast.HashLiteral)
+	if !ok {
+		t.Fatalf("not a hash literal: %s", stmt.Expression.String())
+	}
+	return hash
+}
+
+func keyTexts(keys []ast.Expression) []string {
+	texts := make([]string, len(keys))
+	for i, k := range keys {
+		texts[i] = k.String()
+	}
+	return texts
+}
+
+func TestHashKeys(t *testing.T) {
+	tests := []struct {
+		input    string
+		want     []string
+		fallback []string
+	}{
+		{`{"b": 1, "a": 2}`, []string{"b", "a"}, []string{"a", "b"}},
+		{`{10: 1, 9: 2, -1: 3}`, []string{"10", "9", "(-1)"}, []string{"9", "10", "(-1)"}},
+		{`{"s": 1, true: 2, 3: 4, false: 5}`, []string{"s", "true", "3", "false"}, []string{"3", "false", "true", "s"}},
+		{
+			"{\n  f(1, 2): {\"y\": 1, \"x\": 2},\n  [1, 2]: fn(a, b) { a },\n  g(): 3\n}",
+			[]string{"f(1, 2)", "[1, 2]", "g()"},
+			[]string{"[1, 2]", "f(1, 2)", "g()"},
+		},
+		{`{f(): 1, f(): 2}`, []string{"f()", "f()"}, []string{"f()", "f()"}},
+		{`{}`, []string{}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program := parse(tt.input)
+			hash := hashOf(t, program)
+			m := compiler.NewSourceMap(tt.input, program)
+			assert.Equal(t, tt.want, keyTexts(m.HashKeys(hash)))
+			assert.Equal(t, tt.fallback, keyTexts(compiler.HashKeys(hash)))
+		})
+	}
+
+	//Keys of the same text are told apart by their values.
+	input := `{f(): 1, f(): 2}`
+	program := parse(input)
+	hash := hashOf(t, program)
+	var values []string
+	for _, k := range compiler.NewSourceMap(input, program).HashKeys(hash) {
+		values = append(values, hash.Pairs[k].String())
+	}
+	assert.Equal(t, []string{"1", "2"}, values)
+
+	//A source which the program is not parsed from falls back on sorting.
+	program = parse(`{"b": 1, "a": 2}`)
+	hash = hashOf(t, program)
+	assert.Equal(t, []string{"a", "b"}, keyTexts(compiler.NewSourceMap(`{"x": 1}`, program).HashKeys(hash)))
+	var m *compiler.SourceMap
+	assert.Equal(t, []string{"a", "b"}, keyTexts(m.HashKeys(hash)))
+}
+
+func TestSourceMapPositions(t *testing.T) {
+	input := "{\"b\": x,\n \"a\": y}"
+	program := parse(input)
+	hash := hashOf(t, program)
+	m := compiler.NewSourceMap(input, program)
+	var got []string
+	for _, k := range m.HashKeys(hash) {
+		got = append(got, m.Position(k).String(), m.Position(hash.Pairs[k]).String())
+	}
+	assert.Equal(t, []string{"1:2", "1:7", "2:2", "2:7"}, got)
+	assert.Equal(t, "1:1", m.Position(hash).String())
+	assert.Equal(t, "-", m.Position(&ast.Identifier{}).String())
+}
+
+func TestCompileInSourceOrder(t *testing.T) {
+	input := `{"b": 1, "a": 2}`
+	program := parse(input)
+	comp := compiler.New()
+	comp.SetSourceMap(compiler.NewSourceMap(input, program))
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	var got []string
+	for _, c := range comp.Bytecode().Constants {
+		got = append(got, c.Inspect())
+	}
+	assert.Equal(t, []string{"b", "1", "a", "2"}, got)
+}
@@ -0,0 +1,60 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/monkey/ast"
+)
+
+// spreadFunc is the name of the call expression which spreads an array into call args or an array literal,
+// since the parser has no spread syntax: `f(1, spread(xs))` stands for `f(1, ...xs)`, and
+// `[spread(a), spread(b)]` for `[...a, ...b]`.
+const spreadFunc = "spread"
+
+func (c *Compiler) hasSpread(elems []ast.Expression) bool {
+	for _, el := range elems {
+		if call, ok := el.(*ast.CallExpression); ok && c.isIntrinsic(call, spreadFunc) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileSpreadElements emits instructions which push a new array of the elements, where each spread
+// element contributes the elements of its array. Runs of ordinary elements are collected by OpArray,
+// and OpConcat joins them with the spread arrays.
+func (c *Compiler) compileSpreadElements(elems []ast.Expression) error {
+	numArrays := 0
+	pending := 0
+	flush := func() {
+		if pending > 0 {
+			c.emit(code.OpArray, pending)
+			numArrays++
+			pending = 0
+		}
+	}
+	for _, el := range elems {
+		call, ok := el.(*ast.CallExpression)
+		if !ok || !c.isIntrinsic(call, spreadFunc) {
+			err := c.Compile(el)
+			if err != nil {
+				return err
+			}
+			pending++
+			continue
+		}
+		if len(call.Arguments) != 1 {
+			return fmt.Errorf("wrong number of args for spread: (got=%d want=1)", len(call.Arguments))
+		}
+		flush()
+		err := c.Compile(call.Arguments[0])
+		if err != nil {
+			return err
+		}
+		numArrays++
+	}
+	flush()
+	c.emit(code.OpConcat, numArrays)
+	return nil
+}
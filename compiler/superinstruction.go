@@ -0,0 +1,66 @@
+package compiler
+
+import (
+	"github.com/taimats/sarupiler/code"
+)
+
+// localConstantOps maps an arithmetic instruction to the superinstruction which applies it to a local and a constant.
+var localConstantOps = map[code.Opcode]code.Opcode{
+	code.OpAdd: code.OpAddLocalConstant,
+	code.OpSub: code.OpSubLocalConstant,
+}
+
+// comparisonJumps maps a comparison to the superinstruction which jumps unless the comparison holds.
+var comparisonJumps = map[code.Opcode]code.Opcode{
+	code.OpGreaterThan: code.OpJumpUnlessGreaterThan,
+	code.OpEqual:       code.OpJumpUnlessEqual,
+	code.OpNotEqual:    code.OpJumpUnlessNotEqual,
+}
+
+// emitFused emits op fused with the instructions just before it into a superinstruction, if they form one of
+// the sequences that dominate loops and recursive calls: `OpGetLocal; OpConstant; OpAdd` (e.g. `i + 1`) and
+// a comparison followed by OpJumpNotTruthy (e.g. `if (n < 2)`). It reports false if op cannot be fused.
+//
+// Instructions are never fused across a jump target, since the jump would land in the middle of the superinstruction.
+func (c *Compiler) emitFused(op code.Opcode, operands ...int) (int, bool) {
+	scope := &c.scopes[c.scopeIndex]
+	ins := scope.instructions
+	last := scope.lastInstruction
+	if c.plain || len(ins) == 0 {
+		return 0, false
+	}
+	if fused, ok := localConstantOps[op]; ok {
+		prev := scope.previousInstruction
+		if last.Opcode != code.OpConstant || prev.Opcode != code.OpGetLocal ||
+			prev.Position+2 != last.Position || last.Position+3 != len(ins) || prev.Position < scope.lastTarget {
+			return 0, false
+		}
+		local := int(code.ReadUint8(ins[prev.Position+1:]))
+		constant := int(code.ReadUint16(ins[last.Position+1:]))
+		return c.replaceTail(prev.Position, fused, local, constant), true
+	}
+	if fused, ok := comparisonJumps[last.Opcode]; ok && op == code.OpJumpNotTruthy {
+		if last.Position+1 != len(ins) || last.Position < scope.lastTarget {
+			return 0, false
+		}
+		return c.replaceTail(last.Position, fused, operands...), true
+	}
+	return 0, false
+}
+
+// replaceTail replaces the instructions from pos on with a single instruction.
+func (c *Compiler) replaceTail(pos int, op code.Opcode, operands ...int) int {
+	scope := &c.scopes[c.scopeIndex]
+	scope.instructions = append(scope.instructions[:pos], code.Make(op, operands...)...)
+	scope.previousInstruction = EmittedInstruction{}
+	scope.lastInstruction = EmittedInstruction{Opcode: op, Position: pos}
+	return pos
+}
+
+// jumpTarget returns the position of the next instruction to be jumped to,
+// and keeps the instructions before it from being fused with the ones from it on.
+func (c *Compiler) jumpTarget() int {
+	scope := &c.scopes[c.scopeIndex]
+	scope.lastTarget = len(scope.instructions)
+	return scope.lastTarget
+}
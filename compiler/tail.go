@@ -0,0 +1,121 @@
+package compiler
+
+import (
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/monkey/ast"
+)
+
+// compileTail compiles node in tail position, where its value is what the function returns.
+// Calls in tail position become OpTailCall, which lets the callee take over the frame of the caller,
+// so that recursion in tail position runs in constant frame and stack space. The tail positions are
+// the value of a return statement, the last statement of a function body, and the last statements of
+// the branches of an if expression in tail position.
+func (c *Compiler) compileTail(node ast.Node) error {
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		return c.compileStatements(node.Statements, c.compileTail)
+	case *ast.ExpressionStatement:
+		err := c.compileTail(node.Expression)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpPop)
+		return nil
+	case *ast.IfExpression:
+		return c.compileIf(node, true)
+	case *ast.CallExpression:
+		return c.compileTailCall(node)
+	default:
+		return c.Compile(node)
+	}
+}
+
+// compileTailCall emits OpTailCall for a plain call. Calls of intrinsics, calls with spread args and
+// calls of builtins, which need no frame, are compiled as usual.
+func (c *Compiler) compileTailCall(node *ast.CallExpression) error {
+	for _, name := range []string{importFunc, tryFunc, throwFunc, paramsFunc, spreadFunc} {
+		if c.isIntrinsic(node, name) {
+			return c.Compile(node)
+		}
+	}
+	if c.hasSpread(node.Arguments) {
+		return c.Compile(node)
+	}
+	if cand, ok := c.inlineCandidate(node); ok {
+		return c.compileInline(node, cand)
+	}
+	if ident, ok := node.Function.(*ast.Identifier); ok {
+		if s, ok := c.symbolTable.Resolve(ident.Value); ok && s.Scope == BuiltinScope {
+			return c.Compile(node)
+		}
+	}
+	err := c.Compile(node.Function)
+	if err != nil {
+		return err
+	}
+	for _, a := range node.Arguments {
+		err := c.Compile(a)
+		if err != nil {
+			return err
+		}
+	}
+	c.emit(code.OpTailCall, len(node.Arguments))
+	return nil
+}
+
+// compileReturnValue compiles the value of a return statement, which is in tail position inside a function.
+func (c *Compiler) compileReturnValue(node ast.Expression) error {
+	if c.scopeIndex == 0 {
+		return c.Compile(node)
+	}
+	return c.compileTail(node)
+}
+
+// compileIf compiles an if expression. In tail position, the last statements of both branches are
+// in tail position as well.
+func (c *Compiler) compileIf(node *ast.IfExpression, tail bool) error {
+	compileBranch := c.Compile
+	if tail {
+		compileBranch = c.compileTail
+	}
+	err := c.Compile(node.Condition)
+	if err != nil {
+		return err
+	}
+	jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	err = compileBranch(node.Consequence)
+	if err != nil {
+		return err
+	}
+	if c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	}
+	//A consequence which leaves the function needs no jump over the alternative.
+	jumpPos := -1
+	if !c.endsWithExit() {
+		jumpPos = c.emit(code.OpJump, 9999)
+	}
+	afterConsequencePos := c.jumpTarget()
+	c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
+
+	if node.Alternative == nil {
+		c.emit(code.OpNull)
+		if jumpPos >= 0 {
+			c.changeOperand(jumpPos, c.jumpTarget())
+		}
+		return nil
+	}
+	err = compileBranch(node.Alternative)
+	if err != nil {
+		return err
+	}
+	if c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	}
+	afterAlternativePos := c.jumpTarget()
+	if jumpPos >= 0 {
+		c.changeOperand(jumpPos, afterAlternativePos)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/monkey/ast"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// tryFunc and throwFunc are the names of the call expressions compiled as exception handling:
+// `try(fn() { body }, fn(e) { handler })` calls the body and, if it raises an exception, calls the handler
+// with the exception. An optional third function, `try(body, handler, fn() { cleanup })`, is called
+// whenever the body and the handler are done, even if they raise an exception. `throw(value)` raises value.
+const (
+	tryFunc   = "try"
+	throwFunc = "throw"
+)
+
+// isHidden reports whether name is a binding defined by the compiler itself.
+// Such names contain a colon, so that they can never clash with an identifier in a script.
+func isHidden(name string) bool {
+	return strings.Contains(name, ":")
+}
+
+// defineHidden defines a binding in the current scope which no script can refer to.
+func (c *Compiler) defineHidden(prefix string) Symbol {
+	c.numHidden++
+	return c.symbolTable.Define(fmt.Sprintf("%s:%d", prefix, c.numHidden))
+}
+
+func (c *Compiler) storeSymbol(s Symbol) {
+	if s.Scope == GlobalScope {
+		c.emit(code.OpSetGlobal, s.Index)
+	} else {
+		c.emit(code.OpSetLocal, s.Index)
+	}
+}
+
+// emitGuardedCall emits an OpCall guarded by a handler, and returns the index of the handler
+// so that its target can be set once it is known.
+func (c *Compiler) emitGuardedCall(numArgs int) int {
+	start := c.emit(code.OpCall, numArgs)
+	scope := &c.scopes[c.scopeIndex]
+	scope.handlers = append(scope.handlers, obj.Handler{Start: start, End: len(scope.instructions)})
+	return len(scope.handlers) - 1
+}
+
+func (c *Compiler) setHandlerTarget(handler int) {
+	target := c.jumpTarget()
+	c.scopes[c.scopeIndex].handlers[handler].Target = target
+}
+
+// compileTry emits the body call guarded by a handler which stores the exception and calls the catch
+// function with it. With a finally function, the catch call is guarded as well, and both the normal
+// and the exceptional exit call the finally function before going on with the result or the exception.
+func (c *Compiler) compileTry(node *ast.CallExpression) error {
+	if len(node.Arguments) != 2 && len(node.Arguments) != 3 {
+		return fmt.Errorf("wrong number of args for try: (got=%d want=2 or 3)", len(node.Arguments))
+	}
+	var finally Symbol
+	hasFinally := len(node.Arguments) == 3
+	if hasFinally {
+		finally = c.defineHidden("finally")
+		err := c.Compile(node.Arguments[2])
+		if err != nil {
+			return err
+		}
+		c.storeSymbol(finally)
+	}
+	exc := c.defineHidden("exception")
+
+	err := c.Compile(node.Arguments[0])
+	if err != nil {
+		return err
+	}
+	bodyHandler := c.emitGuardedCall(0)
+	jumpPos := c.emit(code.OpJump, 9999)
+
+	c.setHandlerTarget(bodyHandler)
+	c.storeSymbol(exc)
+	err = c.Compile(node.Arguments[1])
+	if err != nil {
+		return err
+	}
+	c.loadSymbol(exc)
+	if !hasFinally {
+		c.emit(code.OpCall, 1)
+		c.changeOperand(jumpPos, c.jumpTarget())
+		return nil
+	}
+	catchHandler := c.emitGuardedCall(1)
+	c.changeOperand(jumpPos, c.jumpTarget())
+
+	result := c.defineHidden("result")
+	c.storeSymbol(result)
+	c.callFinally(finally)
+	c.loadSymbol(result)
+	afterFinallyPos := c.emit(code.OpJump, 9999)
+
+	c.setHandlerTarget(catchHandler)
+	c.storeSymbol(exc)
+	c.callFinally(finally)
+	c.loadSymbol(exc)
+	c.emit(code.OpThrow)
+	c.changeOperand(afterFinallyPos, c.jumpTarget())
+	return nil
+}
+
+func (c *Compiler) callFinally(finally Symbol) {
+	c.loadSymbol(finally)
+	c.emit(code.OpCall, 0)
+	c.emit(code.OpPop)
+}
+
+func (c *Compiler) compileThrow(node *ast.CallExpression) error {
+	if len(node.Arguments) != 1 {
+		return fmt.Errorf("wrong number of args for throw: (got=%d want=1)", len(node.Arguments))
+	}
+	err := c.Compile(node.Arguments[0])
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpThrow)
+	return nil
+}
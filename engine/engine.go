@@ -0,0 +1,119 @@
+// Package engine embeds monkey scripts in Go programs.
+// A script is compiled and run once so that its global bindings get defined,
+// after which its functions can be called from Go any number of times.
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/taimats/sarupiler/compiler"
+	"github.com/taimats/sarupiler/monkey/lexer"
+	"github.com/taimats/sarupiler/monkey/object"
+	"github.com/taimats/sarupiler/monkey/parser"
+	obj "github.com/taimats/sarupiler/object"
+	"github.com/taimats/sarupiler/vm"
+)
+
+// Script is a compiled and initialized monkey program.
+// Calls share a single VM, so a Script must not be used by multiple goroutines at the same time.
+type Script struct {
+	symbols *compiler.SymbolTable
+	globals []object.Object
+	machine *vm.VM
+}
+
+// Compile compiles input with the default builtins and runs its top-level statements.
+func Compile(input string) (*Script, error) {
+	return CompileWithBuiltins(input, obj.DefaultRegistry())
+}
+
+// CompileWithBuiltins compiles input against the builtin registry r and runs its top-level statements.
+func CompileWithBuiltins(input string, r *obj.Registry) (*Script, error) {
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		return nil, fmt.Errorf("failed to parse: %s", strings.Join(errs, "; "))
+	}
+	comp := compiler.NewWithBuiltins(r)
+	comp.SetSourceMap(compiler.NewSourceMap(input, program))
+	err := comp.Compile(program)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile: %w", err)
+	}
+	globals := make([]object.Object, vm.GlobalSize)
+	machine := vm.NewWithGlobalStore(comp.Bytecode(), globals)
+	err = machine.Run()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run: %w", err)
+	}
+	return &Script{symbols: comp.SymbolTable(), globals: globals, machine: machine}, nil
+}
+
+// Global returns the value bound to a global name.
+func (s *Script) Global(name string) (object.Object, error) {
+	sym, ok := s.symbols.Resolve(name)
+	if !ok || sym.Scope != compiler.GlobalScope {
+		return nil, fmt.Errorf("undefined global: %s", name)
+	}
+	return s.globals[sym.Index], nil
+}
+
+// Function returns the closure bound to a global name.
+func (s *Script) Function(name string) (*obj.Closure, error) {
+	g, err := s.Global(name)
+	if err != nil {
+		return nil, err
+	}
+	cl, ok := g.(*obj.Closure)
+	if !ok {
+		return nil, fmt.Errorf("not a function: %s (type=%s)", name, g.Type())
+	}
+	return cl, nil
+}
+
+// Call calls the global function with args converted to monkey objects, and returns its return value.
+func (s *Script) Call(name string, args ...any) (object.Object, error) {
+	cl, err := s.Function(name)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]object.Object, len(args))
+	for i, a := range args {
+		o, err := obj.ToObject(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arg %d for %s: %w", i, name, err)
+		}
+		objs[i] = o
+	}
+	result, err := s.machine.Call(cl, objs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s: %w", name, err)
+	}
+	return result, nil
+}
+
+// CallValue is like Call, but converts the return value to a Go value.
+// An *object.Error returned by the function is reported as an error.
+func (s *Script) CallValue(name string, args ...any) (any, error) {
+	result, err := s.Call(name, args...)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := result.(*object.Error); ok {
+		return nil, fmt.Errorf("%s returned an error: %s", name, e.Message)
+	}
+	return obj.ToValue(result)
+}
+
+// CallInto is like Call, but decodes the return value into the value pointed to by out with object.FromObject.
+func (s *Script) CallInto(out any, name string, args ...any) error {
+	result, err := s.Call(name, args...)
+	if err != nil {
+		return err
+	}
+	if e, ok := result.(*object.Error); ok {
+		return fmt.Errorf("%s returned an error: %s", name, e.Message)
+	}
+	return obj.FromObject(result, out)
+}
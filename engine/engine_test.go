@@ -0,0 +1,151 @@
+package engine_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taimats/sarupiler/engine"
+	"github.com/taimats/sarupiler/monkey/object"
+)
+
+const scoringRule = `
+let base = 10;
+let score = fn(points, bonus) {
+	if (bonus) {
+		base + points * 2;
+	} else {
+		base + points;
+	}
+};
+let tags = fn(name) { [name, "scored"] };
+let notFunc = 1;
+`
+
+func TestScriptCall(t *testing.T) {
+	s, err := engine.Compile(scoringRule)
+	if err != nil {
+		t.Fatalf("failed to compile: (error: %s)", err)
+	}
+	a := assert.New(t)
+
+	got, err := s.Call("score", 5, false)
+	a.NoError(err)
+	a.Equal(&object.Integer{Value: 15}, got)
+
+	for range 3 {
+		got, err = s.Call("score", 5, true)
+		a.NoError(err)
+		a.Equal(&object.Integer{Value: 20}, got)
+	}
+}
+
+func TestScriptCallValue(t *testing.T) {
+	s, err := engine.Compile(scoringRule)
+	if err != nil {
+		t.Fatalf("failed to compile: (error: %s)", err)
+	}
+	a := assert.New(t)
+
+	got, err := s.CallValue("score", 1, true)
+	a.NoError(err)
+	a.Equal(int64(12), got)
+
+	got, err = s.CallValue("tags", "monkey")
+	a.NoError(err)
+	a.Equal([]any{"monkey", "scored"}, got)
+}
+
+func TestScriptHashOrder(t *testing.T) {
+	s, err := engine.Compile(`let point = fn() { {"y": 2, "x": 1} };`)
+	if err != nil {
+		t.Fatalf("failed to compile: (error: %s)", err)
+	}
+	got, err := s.Call("point")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "{y: 2, x: 1}", got.Inspect())
+	}
+}
+
+func TestScriptCallErrors(t *testing.T) {
+	s, err := engine.Compile(scoringRule)
+	if err != nil {
+		t.Fatalf("failed to compile: (error: %s)", err)
+	}
+	tests := []struct {
+		name string
+		args []any
+		want string
+	}{
+		{"missing", nil, "undefined global: missing"},
+		{"notFunc", nil, "not a function: notFunc (type=INTEGER)"},
+		{"score", []any{1}, "failed to call score: wrong number of args: (got=1, want=2)"},
+		{"score", []any{1.5, true}, "invalid arg 0 for score: unsupported Go type: float64"},
+	}
+	for _, tt := range tests {
+		_, err := s.Call(tt.name, tt.args...)
+		assert.EqualError(t, err, tt.want)
+	}
+
+	got, err := s.Call("score", 2, false)
+	assert.NoError(t, err)
+	assert.Equal(t, &object.Integer{Value: 12}, got)
+}
+
+func TestCompileErrors(t *testing.T) {
+	_, err := engine.Compile(`let = 1;`)
+	assert.ErrorContains(t, err, "failed to parse")
+
+	_, err = engine.Compile(`undefinedVar;`)
+	assert.EqualError(t, err, "failed to compile: undefined variable: undefinedVar")
+}
+
+type player struct {
+	Name   string `monkey:"name"`
+	Level  int    `monkey:"level"`
+	Tags   []string
+	secret string
+	Skip   bool `monkey:"-"`
+}
+
+func TestScriptConvertsGoValues(t *testing.T) {
+	s, err := engine.Compile(`
+	let levelUp = fn(p) { {"name": p["name"], "level": p["level"] + 1, "Tags": push(p["Tags"], "up")} };
+	let pick = fn(h, key) { h[key] };
+	let pair = fn(a, b) { [a, b] };
+	let describe = fn(h) { to_string(h) };
+	`)
+	if err != nil {
+		t.Fatalf("failed to compile: (error: %s)", err)
+	}
+	a := assert.New(t)
+
+	var got player
+	err = s.CallInto(&got, "levelUp", player{Name: "saru", Level: 1, Tags: []string{"new"}, secret: "x", Skip: true})
+	a.NoError(err)
+	a.Equal(player{Name: "saru", Level: 2, Tags: []string{"new", "up"}}, got)
+
+	v, err := s.CallValue("pick", map[string]uint8{"a": 1, "b": 2}, "b")
+	a.NoError(err)
+	a.Equal(int64(2), v)
+
+	v, err = s.CallValue("describe", map[string]int{"c": 3, "a": 1, "b": 2})
+	a.NoError(err)
+	a.Equal("{a: 1, b: 2, c: 3}", v)
+
+	v, err = s.CallValue("describe", player{Name: "saru", Level: 3})
+	a.NoError(err)
+	a.Equal("{name: saru, level: 3, Tags: null}", v)
+
+	var pair [2]*int8
+	err = s.CallInto(&pair, "pair", 1, nil)
+	a.NoError(err)
+	a.Equal(int8(1), *pair[0])
+	a.Nil(pair[1])
+
+	var small int8
+	err = s.CallInto(&small, "pick", map[int]int{1: 300}, 1)
+	a.EqualError(err, "integer overflow: 300 does not fit in int8")
+
+	_, err = s.Call("pick", map[float64]int{1.5: 1}, 1)
+	a.EqualError(err, "invalid arg 0 for pick: unsupported Go type: float64")
+}
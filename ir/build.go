@@ -0,0 +1,344 @@
+package ir
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/taimats/sarupiler/compiler"
+	"github.com/taimats/sarupiler/monkey/ast"
+	"github.com/taimats/sarupiler/monkey/object"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// unsupported are the intrinsics of the stack compiler which the IR does not implement yet.
+var unsupported = []string{"import", "try", "throw", "params", "spread"}
+
+// Builder builds the IR of a program from its AST.
+type Builder struct {
+	constants   []object.Object
+	functions   []*Function
+	symbolTable *compiler.SymbolTable
+	builtins    *obj.Registry
+	numGlobals  int
+	fn          *funcState
+	sources     *compiler.SourceMap //sources gives the source order of the pairs of hash literals, if set.
+}
+
+// funcState is the function being built. cur is the block instructions are appended to,
+// or nil after a terminator, until the next block gets started.
+type funcState struct {
+	f     *Function
+	cur   *Block
+	outer *funcState
+}
+
+func NewBuilder() *Builder {
+	return NewBuilderWithBuiltins(obj.DefaultRegistry())
+}
+
+func NewBuilderWithBuiltins(r *obj.Registry) *Builder {
+	symtable := compiler.NewSymbolTable()
+	compiler.DefineBuiltins(symtable, r)
+	return &Builder{
+		constants:   []object.Object{},
+		symbolTable: symtable,
+		builtins:    r,
+	}
+}
+
+// SetSourceMap makes the builder insert the pairs of hash literals in their source order, as the compiler
+// does with the same source map.
+func (b *Builder) SetSourceMap(m *compiler.SourceMap) {
+	b.sources = m
+}
+
+// Build builds a whole program. The value of each expression statement of the main program is an unused
+// temporary, so that the last of them is the value the VM pops last, as with the stack compiler.
+func (b *Builder) Build(program *ast.Program) (*Program, error) {
+	main := &Function{}
+	b.fn = &funcState{f: main}
+	b.start(&Block{})
+	for _, s := range program.Statements {
+		var err error
+		if es, ok := s.(*ast.ExpressionStatement); ok {
+			_, err = b.expr(es.Expression)
+		} else {
+			err = b.statement(s)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.terminate(&Instr{Op: OpReturn, Dst: NoTemp})
+	return &Program{
+		Main:       main,
+		Functions:  b.functions,
+		Constants:  b.constants,
+		Builtins:   b.builtins,
+		NumGlobals: b.numGlobals,
+	}, nil
+}
+
+// start makes blk the current block, placing it after the blocks of the function so far.
+func (b *Builder) start(blk *Block) {
+	blk.Index = len(b.fn.f.Blocks)
+	b.fn.f.Blocks = append(b.fn.f.Blocks, blk)
+	b.fn.cur = blk
+}
+
+func (b *Builder) emit(in *Instr) {
+	if b.fn.cur == nil {
+		//Code after a terminator is unreachable, but still gets a block of its own.
+		b.start(&Block{})
+	}
+	b.fn.cur.Instrs = append(b.fn.cur.Instrs, in)
+}
+
+// terminate ends the current block with the terminator in.
+func (b *Builder) terminate(in *Instr) {
+	b.emit(in)
+	for _, t := range in.Targets {
+		t.Preds = append(t.Preds, b.fn.cur)
+	}
+	b.fn.cur = nil
+}
+
+func (b *Builder) newTemp() Temp {
+	b.fn.f.NumTemps++
+	return Temp(b.fn.f.NumTemps - 1)
+}
+
+// add emits an instruction computing a new temporary, which it returns.
+func (b *Builder) add(in *Instr) Temp {
+	in.Dst = b.newTemp()
+	b.emit(in)
+	return in.Dst
+}
+
+func (b *Builder) value(op Op, args ...Temp) Temp {
+	return b.add(&Instr{Op: op, Args: args})
+}
+
+func (b *Builder) define(name string) compiler.Symbol {
+	s := b.symbolTable.Define(name)
+	if s.Scope == compiler.GlobalScope {
+		b.numGlobals = max(b.numGlobals, s.Index+1)
+	} else {
+		b.fn.f.NumLocals = max(b.fn.f.NumLocals, s.Index+1)
+	}
+	return s
+}
+
+func (b *Builder) load(s compiler.Symbol) Temp {
+	return b.add(&Instr{Op: OpLoad, Symbol: s})
+}
+
+func (b *Builder) statement(node ast.Statement) error {
+	switch node := node.(type) {
+	case *ast.ExpressionStatement:
+		_, err := b.expr(node.Expression)
+		return err
+	case *ast.LetStatement:
+		s := b.define(node.Name.Value)
+		v, err := b.expr(node.Value)
+		if err != nil {
+			return err
+		}
+		b.emit(&Instr{Op: OpStore, Dst: NoTemp, Args: []Temp{v}, Symbol: s})
+		return nil
+	case *ast.ReturnStatement:
+		v, err := b.expr(node.ReturnValue)
+		if err != nil {
+			return err
+		}
+		b.terminate(&Instr{Op: OpReturn, Dst: NoTemp, Args: []Temp{v}})
+		return nil
+	default:
+		return fmt.Errorf("unsupported statement: %T", node)
+	}
+}
+
+// block builds a block and returns its value, the value of its last expression statement.
+func (b *Builder) block(node *ast.BlockStatement) (Temp, error) {
+	for i, s := range node.Statements {
+		if es, ok := s.(*ast.ExpressionStatement); ok && i == len(node.Statements)-1 {
+			return b.expr(es.Expression)
+		}
+		err := b.statement(s)
+		if err != nil {
+			return NoTemp, err
+		}
+	}
+	return b.value(OpNull), nil
+}
+
+func (b *Builder) expr(node ast.Expression) (Temp, error) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return b.constant(obj.NativeInt(node.Value)), nil
+	case *ast.StringLiteral:
+		return b.constant(&object.String{Value: node.Value}), nil
+	case *ast.Boolean:
+		if node.Value {
+			return b.value(OpTrue), nil
+		}
+		return b.value(OpFalse), nil
+	case *ast.Identifier:
+		s, ok := b.symbolTable.Resolve(node.Value)
+		if !ok {
+			if slices.Contains(unsupported, node.Value) {
+				return NoTemp, fmt.Errorf("unsupported intrinsic: %s is only implemented by the stack compiler", node.Value)
+			}
+			return NoTemp, fmt.Errorf("undefined variable: %s", node.Value)
+		}
+		return b.load(s), nil
+	case *ast.PrefixExpression:
+		r, err := b.expr(node.Right)
+		if err != nil {
+			return NoTemp, err
+		}
+		switch node.Operator {
+		case "!":
+			return b.value(OpBang, r), nil
+		case "-":
+			return b.value(OpMinus, r), nil
+		}
+		return NoTemp, fmt.Errorf("unkown operator: %s", node.Operator)
+	case *ast.InfixExpression:
+		return b.infix(node)
+	case *ast.IfExpression:
+		return b.ifExpr(node)
+	case *ast.ArrayLiteral:
+		elems, err := b.exprs(node.Elements)
+		if err != nil {
+			return NoTemp, err
+		}
+		return b.value(OpArray, elems...), nil
+	case *ast.HashLiteral:
+		keys := b.sources.HashKeys(node)
+		elems := make([]ast.Expression, 0, len(keys)*2)
+		for _, k := range keys {
+			elems = append(elems, k, node.Pairs[k])
+		}
+		pairs, err := b.exprs(elems)
+		if err != nil {
+			return NoTemp, err
+		}
+		return b.value(OpHash, pairs...), nil
+	case *ast.IndexExpression:
+		operands, err := b.exprs([]ast.Expression{node.Left, node.Index})
+		if err != nil {
+			return NoTemp, err
+		}
+		return b.value(OpIndex, operands...), nil
+	case *ast.FunctionLiteral:
+		return b.function(node)
+	case *ast.CallExpression:
+		operands, err := b.exprs(append([]ast.Expression{node.Function}, node.Arguments...))
+		if err != nil {
+			return NoTemp, err
+		}
+		return b.value(OpCall, operands...), nil
+	}
+	return NoTemp, fmt.Errorf("unsupported expression: %T", node)
+}
+
+func (b *Builder) exprs(nodes []ast.Expression) ([]Temp, error) {
+	temps := make([]Temp, len(nodes))
+	for i, n := range nodes {
+		t, err := b.expr(n)
+		if err != nil {
+			return nil, err
+		}
+		temps[i] = t
+	}
+	return temps, nil
+}
+
+func (b *Builder) constant(o object.Object) Temp {
+	b.constants = append(b.constants, o)
+	return b.add(&Instr{Op: OpConst, Index: len(b.constants) - 1})
+}
+
+var infixOps = map[string]Op{
+	"+": OpAdd, "-": OpSub, "*": OpMul, "/": OpDiv,
+	">": OpGreaterThan, "<": OpGreaterThan, "==": OpEqual, "!=": OpNotEqual,
+}
+
+// infix builds an infix expression. `a < b` is `b > a`, whose right operand is evaluated first.
+func (b *Builder) infix(node *ast.InfixExpression) (Temp, error) {
+	op, ok := infixOps[node.Operator]
+	if !ok {
+		return NoTemp, fmt.Errorf("unkown operator: %s", node.Operator)
+	}
+	operands := []ast.Expression{node.Left, node.Right}
+	if node.Operator == "<" {
+		operands = []ast.Expression{node.Right, node.Left}
+	}
+	temps, err := b.exprs(operands)
+	if err != nil {
+		return NoTemp, err
+	}
+	return b.value(op, temps...), nil
+}
+
+// ifExpr builds an if expression, whose branches both move their value into the temporary of the result.
+func (b *Builder) ifExpr(node *ast.IfExpression) (Temp, error) {
+	cond, err := b.expr(node.Condition)
+	if err != nil {
+		return NoTemp, err
+	}
+	then, els, join := &Block{}, &Block{}, &Block{}
+	result := b.newTemp()
+	b.terminate(&Instr{Op: OpBranch, Dst: NoTemp, Args: []Temp{cond}, Targets: []*Block{then, els}})
+
+	b.start(then)
+	v, err := b.block(node.Consequence)
+	if err != nil {
+		return NoTemp, err
+	}
+	b.emit(&Instr{Op: OpMove, Dst: result, Args: []Temp{v}})
+	b.terminate(&Instr{Op: OpJump, Dst: NoTemp, Targets: []*Block{join}})
+
+	b.start(els)
+	if node.Alternative == nil {
+		v = b.value(OpNull)
+	} else {
+		v, err = b.block(node.Alternative)
+		if err != nil {
+			return NoTemp, err
+		}
+	}
+	b.emit(&Instr{Op: OpMove, Dst: result, Args: []Temp{v}})
+	b.terminate(&Instr{Op: OpJump, Dst: NoTemp, Targets: []*Block{join}})
+
+	b.start(join)
+	return result, nil
+}
+
+// function builds a function literal into a function of its own, and returns the closure over its free variables.
+func (b *Builder) function(node *ast.FunctionLiteral) (Temp, error) {
+	f := &Function{NumParameters: len(node.Parameters)}
+	index := len(b.functions)
+	b.functions = append(b.functions, f)
+	b.fn = &funcState{f: f, outer: b.fn}
+	b.symbolTable = compiler.NewEnclosedSymbolTable(b.symbolTable)
+	b.start(&Block{})
+	for _, p := range node.Parameters {
+		b.define(p.Value)
+	}
+	v, err := b.block(node.Body)
+	if err != nil {
+		return NoTemp, err
+	}
+	b.terminate(&Instr{Op: OpReturn, Dst: NoTemp, Args: []Temp{v}})
+
+	free := b.symbolTable.FreeSymbols
+	b.fn = b.fn.outer
+	b.symbolTable = b.symbolTable.Outer
+	temps := make([]Temp, len(free))
+	for i, s := range free {
+		temps[i] = b.load(s)
+	}
+	return b.add(&Instr{Op: OpClosure, Args: temps, Index: index}), nil
+}
@@ -0,0 +1,177 @@
+// Package ir is a three-address intermediate representation of monkey programs between the AST and
+// the bytecode. A function is a control-flow graph of basic blocks, whose instructions compute their
+// result into a temporary from other temporaries, so that passes can analyze and rewrite programs
+// without caring about the operand stack of the VM.
+package ir
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/taimats/sarupiler/compiler"
+	"github.com/taimats/sarupiler/monkey/object"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// Op is the operation of an instruction.
+type Op byte
+
+const (
+	OpConst       Op = iota //Dst = Constants[Index]
+	OpTrue                  //Dst = true
+	OpFalse                 //Dst = false
+	OpNull                  //Dst = null
+	OpLoad                  //Dst = Symbol
+	OpStore                 //Symbol = Args[0]
+	OpMove                  //Dst = Args[0]
+	OpAdd                   //Dst = Args[0] + Args[1]
+	OpSub                   //Dst = Args[0] - Args[1]
+	OpMul                   //Dst = Args[0] * Args[1]
+	OpDiv                   //Dst = Args[0] / Args[1]
+	OpEqual                 //Dst = Args[0] == Args[1]
+	OpNotEqual              //Dst = Args[0] != Args[1]
+	OpGreaterThan           //Dst = Args[0] > Args[1]
+	OpMinus                 //Dst = -Args[0]
+	OpBang                  //Dst = !Args[0]
+	OpArray                 //Dst = [Args[0], ..., Args[n-1]]
+	OpHash                  //Dst = {Args[0]: Args[1], ..., Args[n-2]: Args[n-1]}
+	OpIndex                 //Dst = Args[0][Args[1]]
+	OpCall                  //Dst = Args[0](Args[1], ..., Args[n-1])
+	OpClosure               //Dst = closure of Functions[Index] over the free variables Args
+	OpJump                  //go to Targets[0]
+	OpBranch                //go to Targets[0] if Args[0] is truthy, or else to Targets[1]
+	OpReturn                //return Args[0], or leave the main program if there are no args
+)
+
+var opNames = map[Op]string{
+	OpConst: "const", OpTrue: "true", OpFalse: "false", OpNull: "null", OpLoad: "load", OpStore: "store",
+	OpMove: "move", OpAdd: "add", OpSub: "sub", OpMul: "mul", OpDiv: "div", OpEqual: "eq", OpNotEqual: "ne",
+	OpGreaterThan: "gt", OpMinus: "neg", OpBang: "not", OpArray: "array", OpHash: "hash", OpIndex: "index",
+	OpCall: "call", OpClosure: "closure", OpJump: "jump", OpBranch: "branch", OpReturn: "return",
+}
+
+func (op Op) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("op(%d)", op)
+}
+
+// IsTerminator reports whether op ends a basic block.
+func (op Op) IsTerminator() bool {
+	return op == OpJump || op == OpBranch || op == OpReturn
+}
+
+// Temp is a temporary holding the result of an instruction.
+type Temp int
+
+// NoTemp is the Dst of an instruction without a result.
+const NoTemp Temp = -1
+
+func (t Temp) String() string {
+	return fmt.Sprintf("t%d", t)
+}
+
+// Instr is an instruction, which computes its result into Dst from Args.
+type Instr struct {
+	Op      Op
+	Dst     Temp
+	Args    []Temp
+	Symbol  compiler.Symbol //Symbol is the binding of OpLoad and OpStore.
+	Index   int             //Index is the constant of OpConst or the function of OpClosure.
+	Targets []*Block        //Targets are the successors of a terminator.
+}
+
+// Block is a basic block: a sequence of instructions entered at the first one and left at the last one,
+// which is a terminator.
+type Block struct {
+	Index  int
+	Instrs []*Instr
+	Preds  []*Block
+}
+
+// Terminator returns the last instruction of b, or nil if b is not complete yet.
+func (b *Block) Terminator() *Instr {
+	if len(b.Instrs) == 0 || !b.Instrs[len(b.Instrs)-1].Op.IsTerminator() {
+		return nil
+	}
+	return b.Instrs[len(b.Instrs)-1]
+}
+
+// Succs returns the blocks that control goes to from b.
+func (b *Block) Succs() []*Block {
+	if t := b.Terminator(); t != nil {
+		return t.Targets
+	}
+	return nil
+}
+
+// Function is a function, or the main program, as a control-flow graph whose entry is Blocks[0].
+type Function struct {
+	Blocks        []*Block
+	NumParameters int
+	NumLocals     int //NumLocals is the number of local bindings, the parameters included.
+	NumTemps      int
+}
+
+// Program is the output of the builder. The closures of Functions refer to them by their index.
+type Program struct {
+	Main       *Function
+	Functions  []*Function
+	Constants  []object.Object
+	Builtins   *obj.Registry
+	NumGlobals int
+}
+
+func (p *Program) String() string {
+	var out strings.Builder
+	out.WriteString("main:\n")
+	p.writeFunction(&out, p.Main)
+	for i, f := range p.Functions {
+		fmt.Fprintf(&out, "fn%d(params=%d, locals=%d):\n", i, f.NumParameters, f.NumLocals)
+		p.writeFunction(&out, f)
+	}
+	return out.String()
+}
+
+func (p *Program) writeFunction(out *strings.Builder, f *Function) {
+	for _, b := range f.Blocks {
+		fmt.Fprintf(out, "b%d:", b.Index)
+		for i, pred := range b.Preds {
+			if i == 0 {
+				out.WriteString(" ; preds")
+			}
+			fmt.Fprintf(out, " b%d", pred.Index)
+		}
+		out.WriteString("\n")
+		for _, in := range b.Instrs {
+			fmt.Fprintf(out, "  %s\n", p.formatInstr(in))
+		}
+	}
+}
+
+func (p *Program) formatInstr(in *Instr) string {
+	operands := make([]string, 0, len(in.Args)+2)
+	switch in.Op {
+	case OpConst:
+		operands = append(operands, p.Constants[in.Index].Inspect())
+	case OpLoad, OpStore:
+		operands = append(operands, fmt.Sprintf("%s(%s %d)", in.Symbol.Name, strings.ToLower(string(in.Symbol.Scope)), in.Symbol.Index))
+	case OpClosure:
+		operands = append(operands, fmt.Sprintf("fn%d", in.Index))
+	}
+	for _, a := range in.Args {
+		operands = append(operands, a.String())
+	}
+	for _, t := range in.Targets {
+		operands = append(operands, fmt.Sprintf("b%d", t.Index))
+	}
+	s := in.Op.String()
+	if len(operands) > 0 {
+		s += " " + strings.Join(operands, ", ")
+	}
+	if in.Dst != NoTemp {
+		s = in.Dst.String() + " = " + s
+	}
+	return s
+}
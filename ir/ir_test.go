@@ -0,0 +1,219 @@
+package ir_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/compiler"
+	"github.com/taimats/sarupiler/ir"
+	"github.com/taimats/sarupiler/monkey/ast"
+	"github.com/taimats/sarupiler/monkey/lexer"
+	"github.com/taimats/sarupiler/monkey/object"
+	"github.com/taimats/sarupiler/monkey/parser"
+	obj "github.com/taimats/sarupiler/object"
+	"github.com/taimats/sarupiler/vm"
+)
+
+func parse(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
+
+func build(t testing.TB, input string) *ir.Program {
+	t.Helper()
+	p := parse(input)
+	b := ir.NewBuilder()
+	b.SetSourceMap(compiler.NewSourceMap(input, p))
+	program, err := b.Build(p)
+	if err != nil {
+		t.Fatalf("builder failed to build: (error: %s)", err)
+	}
+	return program
+}
+
+func runLowered(t testing.TB, input string) (object.Object, error) {
+	t.Helper()
+	bytecode, err := ir.Lower(build(t, input))
+	if err != nil {
+		t.Fatalf("failed to lower: (error: %s)", err)
+	}
+	m := vm.New(bytecode)
+	err = m.Run()
+	return m.LastPoppedStackElem(), err
+}
+
+func runStack(t testing.TB, input string) (object.Object, error) {
+	t.Helper()
+	p := parse(input)
+	comp := compiler.New()
+	comp.SetSourceMap(compiler.NewSourceMap(input, p))
+	err := comp.Compile(p)
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	m := vm.New(comp.Bytecode())
+	err = m.Run()
+	return m.LastPoppedStackElem(), err
+}
+
+// TestParity runs programs compiled directly and through the IR, which must agree on their results.
+func TestParity(t *testing.T) {
+	inputs := []string{
+		"1", "1 + 2", "50 / 2 * 2 + 10 - 5", "-50 + 100 + -50", "(5 + 10 * 2 + 15 / 3) * 2 + -10",
+		"1 < 2", "1 > 2", "1 == 1", "1 != 2", "true == false", "(1 < 2) == true", "!true", "!!5", "!(if (false) { 5; })",
+		`"mon" + "key" == "monkey"`, `"a" < "b"`, `[1, [2]] == [1, [2]]`, `{"a": 1} != {"a": 2}`,
+		"if (true) { 10 } else { 20 }", "if (1 > 2) { 10 }", "if ((if (false) { 10 })) { 10 } else { 20 }",
+		"1; if (true) { 2 }", "if (true) { 2 }; 3", "let x = if (1 < 2) { 3 } else { 4 }; x * 2",
+		"let one = 1; let two = one + one; one + two",
+		`"mon" + "key" + "banana"`,
+		"[]", "[1 + 2, 3 - 4, 5 * 6]", "{1 + 1: 2 * 2, 3 + 3: 4 * 4}", "[if (true) { 1 }, if (false) { 2 } else { 3 }, 4]",
+		"[1, 2, 3][0 + 2]", "[[1, 1, 1]][0][0]", "[1][-1]", "{1: 1, 2: 2}[2]", "{}[0]",
+		"let fivePlusTen = fn() { 5 + 10 }; fivePlusTen();",
+		"let earlyExit = fn() { return 99; 100; }; earlyExit();",
+		"let f = fn(x) { if (x) { return 1; } else { return 2; } 3 }; [f(true), f(false)]",
+		"let noReturn = fn() { }; noReturn();",
+		"let f = fn() { let a = 1; }; f();",
+		"let globalSeed = 50; let minusOne = fn() { let num = 1; globalSeed - num; }; minusOne();",
+		"let sum = fn(a, b) { let c = a + b; c; }; let outer = fn() { sum(1, 2) + sum(3, 4); }; outer();",
+		"let f = fn(x) { let y = if (x > 1) { let z = x * 2; z + 1 } else { 0 }; [x, y] }; f(5)",
+		"let newAdder = fn(a, b) { let c = a + b; fn(d) { let e = d + c; fn(f) { e + f; }; }; }; newAdder(1, 2)(3)(8);",
+		"let a = 1; let newAdderOuter = fn(b) { fn(c) { fn(d) { a + b + c + d }; }; }; newAdderOuter(2)(3)(8);",
+		"let fibonacci = fn(x) { if (x == 0) { return 0; } if (x == 1) { return 1; } fibonacci(x - 1) + fibonacci(x - 2) }; fibonacci(15);",
+		`len("four") + len([1, 2])`, "first([]) ", "rest([1, 2, 3])", "push([], 1)",
+		`len(1)`, `join(split("a,b", ","), "-")`,
+		"map([1, 2, 3], fn(x) { x * 2 })", "filter([1, 2, 3, 4], fn(x) { x > 2 })",
+		"reduce([1, 2, 3], 0, fn(acc, x) { acc + x })", "let k = 3; map([1, 2], fn(x) { x + k })",
+		`keys(merge({"b": 1}, {"a": 2}))`, `keys({"b": 1, "a": 2, 10: 3, 9: 4})`,
+	}
+	for _, input := range inputs {
+		want, err := runStack(t, input)
+		if err != nil {
+			t.Fatalf("stack vm failed to run %q: (error: %s)", input, err)
+		}
+		got, err := runLowered(t, input)
+		if assert.NoError(t, err, input) {
+			assert.Equal(t, want, got, input)
+		}
+	}
+}
+
+func TestReturnFromMain(t *testing.T) {
+	got, err := runLowered(t, "let x = 1; if (x > 0) { return x + 1; } 3")
+	assert.NoError(t, err)
+	assert.Equal(t, &object.Integer{Value: 2}, got)
+}
+
+func TestParityOfErrors(t *testing.T) {
+	inputs := []string{
+		`fn() { 1; }(1);`,
+		`fn(a, b) { a + b; }(1);`,
+		`1 + "a"`,
+		`-"a"`,
+		`1(2)`,
+		`1[0]`,
+		`{}[fn() {}]`,
+		`map([1, 2], fn(a, b) { a })`,
+	}
+	for _, input := range inputs {
+		_, want := runStack(t, input)
+		if want == nil {
+			t.Fatalf("stack vm did not fail on %q", input)
+		}
+		_, got := runLowered(t, input)
+		assert.EqualError(t, got, want.Error(), input)
+	}
+}
+
+func TestString(t *testing.T) {
+	program := build(t, `let f = fn(a) { if (a > 1) { a } else { -a } }; f(2)`)
+	assert.Equal(t, `main:
+b0:
+  t0 = closure fn0
+  store f(global 0), t0
+  t1 = load f(global 0)
+  t2 = const 2
+  t3 = call t1, t2
+  return
+fn0(params=1, locals=1):
+b0:
+  t0 = load a(local 0)
+  t1 = const 1
+  t2 = gt t0, t1
+  branch t2, b1, b2
+b1: ; preds b0
+  t4 = load a(local 0)
+  t3 = move t4
+  jump b3
+b2: ; preds b0
+  t5 = load a(local 0)
+  t6 = neg t5
+  t3 = move t6
+  jump b3
+b3: ; preds b1 b2
+  return t3
+`, program.String())
+	assert.Equal(t, []*ir.Block{program.Functions[0].Blocks[1], program.Functions[0].Blocks[2]}, program.Functions[0].Blocks[0].Succs())
+}
+
+func TestLower(t *testing.T) {
+	bytecode, err := ir.Lower(build(t, `let f = fn(a) { if (a > 1) { a } else { -a } }; f(2)`))
+	if err != nil {
+		t.Fatalf("failed to lower: (error: %s)", err)
+	}
+	fn := bytecode.Constants[2].(*obj.CompiledFunction)
+	want := concatInstructions(
+		code.Make(code.OpGetLocal, 0),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpGreaterThan),
+		code.Make(code.OpJumpNotTruthy, 16),
+		code.Make(code.OpGetLocal, 0),
+		code.Make(code.OpSetLocal, 1),
+		code.Make(code.OpJump, 21),
+		code.Make(code.OpGetLocal, 0),
+		code.Make(code.OpMinus),
+		code.Make(code.OpSetLocal, 1),
+		code.Make(code.OpGetLocal, 1),
+		code.Make(code.OpReturnValue),
+	)
+	assert.Equal(t, want.String(), fn.Instructions.String())
+	assert.Equal(t, 2, fn.NumLocals)
+	assert.Equal(t, 1, fn.NumParameters)
+
+	want = concatInstructions(
+		code.Make(code.OpClosure, 2, 0),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpPop),
+	)
+	assert.Equal(t, want.String(), bytecode.Instructions.String())
+}
+
+func concatInstructions(ins ...code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, item := range ins {
+		out = append(out, item...)
+	}
+	return out
+}
+
+func TestBuildErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`undefinedVar`, "undefined variable: undefinedVar"},
+		{`try(fn() { 1 }, fn(e) { e })`, "unsupported intrinsic: try is only implemented by the stack compiler"},
+		{`import("math")`, "unsupported intrinsic: import is only implemented by the stack compiler"},
+		{`throw(1)`, "unsupported intrinsic: throw is only implemented by the stack compiler"},
+		{`params(fn(a) { a }, {"a": 1})`, "unsupported intrinsic: params is only implemented by the stack compiler"},
+		{`[spread([1])]`, "unsupported intrinsic: spread is only implemented by the stack compiler"},
+	}
+	for _, tt := range tests {
+		_, err := ir.NewBuilder().Build(parse(tt.input))
+		assert.EqualError(t, err, tt.want)
+	}
+}
@@ -0,0 +1,303 @@
+package ir
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/compiler"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// MaxLocals is the number of local slots a function can use, which is limited by the width of the operands.
+const MaxLocals = 256
+
+var binaryOps = map[Op]code.Opcode{
+	OpAdd: code.OpAdd, OpSub: code.OpSub, OpMul: code.OpMul, OpDiv: code.OpDiv,
+	OpEqual: code.OpEqual, OpNotEqual: code.OpNotEqual, OpGreaterThan: code.OpGreaterThan,
+	OpMinus: code.OpMinus, OpBang: code.OpBang, OpIndex: code.OpIndex,
+}
+
+// Lower translates a program into bytecode for the stack VM.
+//
+// A temporary used once, by a later instruction of the same block, stays on the operand stack from
+// its definition to its use, as long as the use finds it on top of the stack. The other temporaries
+// are spilled into slots: extra locals in functions, and extra globals in the main program.
+// Blocks unreachable from the entry are left out.
+func Lower(p *Program) (*compiler.Bytecode, error) {
+	constants := slices.Clone(p.Constants)
+	fnBase := len(constants)
+	for i, f := range p.Functions {
+		l := &lowering{f: f, fnBase: fnBase, slotBase: f.NumLocals}
+		ins, err := l.lower()
+		if err != nil {
+			return nil, fmt.Errorf("in fn%d: %w", i, err)
+		}
+		if l.slotBase+l.numSlots > MaxLocals {
+			return nil, fmt.Errorf("in fn%d: too many locals: a function can use at most %d", i, MaxLocals)
+		}
+		constants = append(constants, &obj.CompiledFunction{
+			Instructions:  ins,
+			NumLocals:     l.slotBase + l.numSlots,
+			NumParameters: f.NumParameters,
+		})
+	}
+	l := &lowering{f: p.Main, fnBase: fnBase, slotBase: p.NumGlobals, main: true}
+	ins, err := l.lower()
+	if err != nil {
+		return nil, err
+	}
+	return &compiler.Bytecode{Instructions: ins, Constants: constants, Builtins: p.Builtins}, nil
+}
+
+// lowering is the state of lowering a single function.
+type lowering struct {
+	f        *Function
+	main     bool
+	fnBase   int //fnBase is the constant index of the first function of the program.
+	slotBase int //slotBase is the first slot which spilled temporaries are stored into.
+	numSlots int
+
+	layout  []*Block
+	uses    []int
+	stacked []bool //stacked reports for each temporary whether it stays on the operand stack.
+	slots   map[Temp]int
+
+	ins       code.Instructions
+	blockPos  map[*Block]int
+	jumpFixes map[int]*Block //jumpFixes maps the position of a jump to its target block, or to nil for the end.
+}
+
+func (l *lowering) lower() (code.Instructions, error) {
+	l.layout = reachable(l.f)
+	l.analyze()
+	for l.demote() {
+	}
+	l.slots = make(map[Temp]int)
+	for t := range l.f.NumTemps {
+		if l.uses[t] > 0 && !l.stacked[t] {
+			l.slots[Temp(t)] = l.slotBase + l.numSlots
+			l.numSlots++
+		}
+	}
+
+	l.ins = code.Instructions{}
+	l.blockPos = make(map[*Block]int)
+	l.jumpFixes = make(map[int]*Block)
+	for i, b := range l.layout {
+		l.blockPos[b] = len(l.ins)
+		var next *Block
+		if i+1 < len(l.layout) {
+			next = l.layout[i+1]
+		}
+		for _, in := range b.Instrs {
+			err := l.instr(in, next)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for pos, target := range l.jumpFixes {
+		to := len(l.ins)
+		if target != nil {
+			to = l.blockPos[target]
+		}
+		op := code.Opcode(l.ins[pos])
+		copy(l.ins[pos:], code.Make(op, to))
+	}
+	return l.ins, nil
+}
+
+// reachable returns the blocks of f reachable from its entry, in the order of f.Blocks.
+func reachable(f *Function) []*Block {
+	seen := make(map[*Block]bool)
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		if seen[b] {
+			return
+		}
+		seen[b] = true
+		for _, s := range b.Succs() {
+			visit(s)
+		}
+	}
+	visit(f.Blocks[0])
+	var blocks []*Block
+	for _, b := range f.Blocks {
+		if seen[b] {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// analyze counts the uses of the temporaries, and marks the ones defined once and used once in the
+// same block as candidates for staying on the stack.
+func (l *lowering) analyze() {
+	l.uses = make([]int, l.f.NumTemps)
+	defs := make([]int, l.f.NumTemps)
+	defBlock := make([]*Block, l.f.NumTemps)
+	useBlock := make([]*Block, l.f.NumTemps)
+	for _, b := range l.layout {
+		for _, in := range b.Instrs {
+			for _, a := range in.Args {
+				l.uses[a]++
+				useBlock[a] = b
+			}
+			if in.Dst != NoTemp {
+				defs[in.Dst]++
+				defBlock[in.Dst] = b
+			}
+		}
+	}
+	l.stacked = make([]bool, l.f.NumTemps)
+	for t := range l.stacked {
+		l.stacked[t] = defs[t] == 1 && l.uses[t] == 1 && defBlock[t] == useBlock[t]
+	}
+}
+
+// demote simulates the operand stack and spills the first candidate found out of place, reporting
+// whether it has spilled one. An instruction takes its leading args off the stack and loads the rest
+// from their slots, so the candidates among its args must lead and be on top of the stack in order.
+func (l *lowering) demote() bool {
+	for _, b := range l.layout {
+		var pending []Temp
+		for _, in := range b.Instrs {
+			lead := l.lead(in)
+			for _, a := range in.Args[lead:] {
+				if l.stacked[a] {
+					l.stacked[a] = false
+					return true
+				}
+			}
+			if len(pending) < lead || !slices.Equal(pending[len(pending)-lead:], in.Args[:lead]) {
+				l.stacked[in.Args[0]] = false
+				return true
+			}
+			pending = pending[:len(pending)-lead]
+			if in.Dst != NoTemp && l.stacked[in.Dst] {
+				pending = append(pending, in.Dst)
+			}
+		}
+		if len(pending) > 0 {
+			l.stacked[pending[0]] = false
+			return true
+		}
+	}
+	return false
+}
+
+// lead returns the number of leading args of in which stay on the stack.
+func (l *lowering) lead(in *Instr) int {
+	n := 0
+	for n < len(in.Args) && l.stacked[in.Args[n]] {
+		n++
+	}
+	return n
+}
+
+func (l *lowering) emit(op code.Opcode, operands ...int) int {
+	pos := len(l.ins)
+	l.ins = append(l.ins, code.Make(op, operands...)...)
+	return pos
+}
+
+func (l *lowering) jump(op code.Opcode, target *Block) {
+	l.jumpFixes[l.emit(op, 9999)] = target
+}
+
+// instr lowers an instruction of the block followed by next in the layout.
+func (l *lowering) instr(in *Instr, next *Block) error {
+	for _, a := range in.Args[l.lead(in):] {
+		l.loadSlot(l.slots[a])
+	}
+	switch in.Op {
+	case OpConst:
+		l.emit(code.OpConstant, in.Index)
+	case OpTrue:
+		l.emit(code.OpTrue)
+	case OpFalse:
+		l.emit(code.OpFalse)
+	case OpNull:
+		l.emit(code.OpNull)
+	case OpLoad:
+		switch in.Symbol.Scope {
+		case compiler.GlobalScope:
+			l.emit(code.OpGetGlobal, in.Symbol.Index)
+		case compiler.LocalScope:
+			l.emit(code.OpGetLocal, in.Symbol.Index)
+		case compiler.BuiltinScope:
+			l.emit(code.OpGetBuiltin, in.Symbol.Index)
+		case compiler.FreeScope:
+			l.emit(code.OpGetFree, in.Symbol.Index)
+		}
+	case OpStore:
+		if in.Symbol.Scope == compiler.GlobalScope {
+			l.emit(code.OpSetGlobal, in.Symbol.Index)
+		} else {
+			l.emit(code.OpSetLocal, in.Symbol.Index)
+		}
+	case OpMove:
+	case OpArray:
+		l.emit(code.OpArray, len(in.Args))
+	case OpHash:
+		l.emit(code.OpHash, len(in.Args))
+	case OpCall:
+		l.emit(code.OpCall, len(in.Args)-1)
+	case OpClosure:
+		l.emit(code.OpClosure, l.fnBase+in.Index, len(in.Args))
+	case OpJump:
+		if in.Targets[0] != next {
+			l.jump(code.OpJump, in.Targets[0])
+		}
+	case OpBranch:
+		l.jump(code.OpJumpNotTruthy, in.Targets[1])
+		if in.Targets[0] != next {
+			l.jump(code.OpJump, in.Targets[0])
+		}
+	case OpReturn:
+		if !l.main {
+			l.emit(code.OpReturnValue)
+			break
+		}
+		//The main program ends at the end of its instructions, leaving its value as the last one popped.
+		if len(in.Args) > 0 {
+			l.emit(code.OpPop)
+		}
+		if next != nil {
+			l.jump(code.OpJump, nil)
+		}
+	default:
+		op, ok := binaryOps[in.Op]
+		if !ok {
+			return fmt.Errorf("unknown op: %s", in.Op)
+		}
+		l.emit(op)
+	}
+
+	if in.Dst == NoTemp || l.stacked[in.Dst] {
+		return nil
+	}
+	if l.uses[in.Dst] == 0 {
+		l.emit(code.OpPop)
+		return nil
+	}
+	l.storeSlot(l.slots[in.Dst])
+	return nil
+}
+
+func (l *lowering) loadSlot(slot int) {
+	if l.main {
+		l.emit(code.OpGetGlobal, slot)
+	} else {
+		l.emit(code.OpGetLocal, slot)
+	}
+}
+
+func (l *lowering) storeSlot(slot int) {
+	if l.main {
+		l.emit(code.OpSetGlobal, slot)
+	} else {
+		l.emit(code.OpSetLocal, slot)
+	}
+}
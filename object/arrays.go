@@ -0,0 +1,231 @@
+package object
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/taimats/sarupiler/monkey/object"
+)
+
+// arrayAndFunc checks that args are an array followed by n-1 arbitrary args and a function as the last arg.
+func arrayAndFunc(args []object.Object, n int) (*object.Array, object.Object, *object.Error) {
+	if len(args) != n {
+		return nil, nil, newError("wrong number of args: (got=%d want=%d)", len(args), n)
+	}
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return nil, nil, newError("an arg must be ARRAY_OBJ: (got=%s)", args[0].Type())
+	}
+	fn := args[n-1]
+	switch fn.Type() {
+	case CLOSURE_OBJ, object.BUILTIN_OBJ:
+		return arr, fn, nil
+	default:
+		return nil, nil, newError("an arg must be a function: (got=%s)", fn.Type())
+	}
+}
+
+func nativeMap(c Caller, args ...object.Object) (object.Object, error) {
+	arr, fn, argErr := arrayAndFunc(args, 2)
+	if argErr != nil {
+		return argErr, nil
+	}
+	elems := make([]object.Object, len(arr.Elements))
+	for i, el := range arr.Elements {
+		result, err := c.Call(fn, el)
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = result
+	}
+	return &object.Array{Elements: elems}, nil
+}
+
+func nativeFilter(c Caller, args ...object.Object) (object.Object, error) {
+	arr, fn, argErr := arrayAndFunc(args, 2)
+	if argErr != nil {
+		return argErr, nil
+	}
+	elems := []object.Object{}
+	for _, el := range arr.Elements {
+		result, err := c.Call(fn, el)
+		if err != nil {
+			return nil, err
+		}
+		if IsTruthy(result) {
+			elems = append(elems, el)
+		}
+	}
+	return &object.Array{Elements: elems}, nil
+}
+
+// nativeReduce folds an array from the left: reduce([1, 2], init, fn(acc, x) { ... }).
+func nativeReduce(c Caller, args ...object.Object) (object.Object, error) {
+	arr, fn, argErr := arrayAndFunc(args, 3)
+	if argErr != nil {
+		return argErr, nil
+	}
+	acc := args[1]
+	for _, el := range arr.Elements {
+		result, err := c.Call(fn, acc, el)
+		if err != nil {
+			return nil, err
+		}
+		acc = result
+	}
+	return acc, nil
+}
+
+func nativeAny(c Caller, args ...object.Object) (object.Object, error) {
+	arr, fn, argErr := arrayAndFunc(args, 2)
+	if argErr != nil {
+		return argErr, nil
+	}
+	for _, el := range arr.Elements {
+		result, err := c.Call(fn, el)
+		if err != nil {
+			return nil, err
+		}
+		if IsTruthy(result) {
+			return True, nil
+		}
+	}
+	return False, nil
+}
+
+func nativeAll(c Caller, args ...object.Object) (object.Object, error) {
+	arr, fn, argErr := arrayAndFunc(args, 2)
+	if argErr != nil {
+		return argErr, nil
+	}
+	for _, el := range arr.Elements {
+		result, err := c.Call(fn, el)
+		if err != nil {
+			return nil, err
+		}
+		if !IsTruthy(result) {
+			return False, nil
+		}
+	}
+	return True, nil
+}
+
+// nativeSort returns a sorted copy of an array. Without a function, integers and strings are sorted
+// in ascending order. With a function, it is called as less(a, b) and must return true if a goes before b.
+// The sort is stable.
+func nativeSort(c Caller, args ...object.Object) (object.Object, error) {
+	if len(args) == 1 {
+		arr, ok := args[0].(*object.Array)
+		if !ok {
+			return newError("an arg must be ARRAY_OBJ: (got=%s)", args[0].Type()), nil
+		}
+		return sortArray(arr, func(a, b object.Object) (int, error) {
+			return compareObjects(a, b)
+		})
+	}
+	arr, fn, argErr := arrayAndFunc(args, 2)
+	if argErr != nil {
+		return argErr, nil
+	}
+	return sortArray(arr, func(a, b object.Object) (int, error) {
+		less, err := c.Call(fn, a, b)
+		if err != nil {
+			return 0, err
+		}
+		if IsTruthy(less) {
+			return -1, nil
+		}
+		less, err = c.Call(fn, b, a)
+		if err != nil {
+			return 0, err
+		}
+		if IsTruthy(less) {
+			return 1, nil
+		}
+		return 0, nil
+	})
+}
+
+// nativeSortBy returns a copy of an array sorted by the keys which the function computes for each element.
+// The function is called exactly once per element, and the sort is stable.
+func nativeSortBy(c Caller, args ...object.Object) (object.Object, error) {
+	arr, fn, argErr := arrayAndFunc(args, 2)
+	if argErr != nil {
+		return argErr, nil
+	}
+	type keyed struct {
+		key   object.Object
+		value object.Object
+	}
+	pairs := make([]keyed, len(arr.Elements))
+	for i, el := range arr.Elements {
+		key, err := c.Call(fn, el)
+		if err != nil {
+			return nil, err
+		}
+		pairs[i] = keyed{key: key, value: el}
+	}
+	var cmpErr error
+	slices.SortStableFunc(pairs, func(a, b keyed) int {
+		if cmpErr != nil {
+			return 0
+		}
+		var n int
+		n, cmpErr = compareObjects(a.key, b.key)
+		return n
+	})
+	if cmpErr != nil {
+		return newError("%s", cmpErr), nil
+	}
+	elems := make([]object.Object, len(pairs))
+	for i, p := range pairs {
+		elems[i] = p.value
+	}
+	return &object.Array{Elements: elems}, nil
+}
+
+// sortArray sorts a copy of arr with compare. An error returned by compare stops the sort:
+// a comparison error is reported as an ERROR object, and any other error is returned as it is.
+func sortArray(arr *object.Array, compare func(a, b object.Object) (int, error)) (object.Object, error) {
+	elems := slices.Clone(arr.Elements)
+	var sortErr error
+	slices.SortStableFunc(elems, func(a, b object.Object) int {
+		if sortErr != nil {
+			return 0
+		}
+		var n int
+		n, sortErr = compare(a, b)
+		return n
+	})
+	if sortErr != nil {
+		if cmpErr, ok := sortErr.(*compareError); ok {
+			return newError("%s", cmpErr), nil
+		}
+		return nil, sortErr
+	}
+	return &object.Array{Elements: elems}, nil
+}
+
+type compareError struct {
+	left, right object.ObjectType
+}
+
+func (e *compareError) Error() string {
+	return fmt.Sprintf("cannot compare %s and %s", e.left, e.right)
+}
+
+// compareObjects orders integers and strings by value.
+func compareObjects(a, b object.Object) (int, error) {
+	switch a := a.(type) {
+	case *object.Integer:
+		if b, ok := b.(*object.Integer); ok {
+			return cmp.Compare(a.Value, b.Value), nil
+		}
+	case *object.String:
+		if b, ok := b.(*object.String); ok {
+			return cmp.Compare(a.Value, b.Value), nil
+		}
+	}
+	return 0, &compareError{left: a.Type(), right: b.Type()}
+}
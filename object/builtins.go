@@ -2,14 +2,14 @@ package object
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/taimats/sarupiler/monkey/object"
 )
 
-var Builtins = []struct {
-	Name    string
-	Builtin *object.Builtin
-}{
+// Builtins are the builtin functions available to every script by default.
+// Their order determines the index of each builtin in DefaultRegistry.
+var Builtins = []BuiltinDef{
 	{
 		"len",
 		&object.Builtin{Fn: func(args ...object.Object) object.Object {
@@ -18,9 +18,9 @@ var Builtins = []struct {
 			}
 			switch arg := args[0].(type) {
 			case *object.Array:
-				return &object.Integer{Value: int64(len(arg.Elements))}
+				return NativeInt(int64(len(arg.Elements)))
 			case *object.String:
-				return &object.Integer{Value: int64(len(arg.Value))}
+				return NativeInt(int64(len(arg.Value)))
 			default:
 				return newError("unsupported type for len(): (type=%s)", arg.Type())
 			}
@@ -107,13 +107,51 @@ var Builtins = []struct {
 			return nil
 		}},
 	},
+	{"split", &object.Builtin{Fn: builtinSplit}},
+	{"join", &object.Builtin{Fn: builtinJoin}},
+	{"trim", stringFunc(strings.TrimSpace)},
+	{"contains", stringPredicate(strings.Contains)},
+	{"index_of", &object.Builtin{Fn: builtinIndexOf}},
+	{"replace", &object.Builtin{Fn: builtinReplace}},
+	{"upper", stringFunc(strings.ToUpper)},
+	{"lower", stringFunc(strings.ToLower)},
+	{"substring", &object.Builtin{Fn: builtinSubstring}},
+	{"starts_with", stringPredicate(strings.HasPrefix)},
+	{"ends_with", stringPredicate(strings.HasSuffix)},
+	{"format", &object.Builtin{Fn: builtinFormat}},
+	{"to_int", &object.Builtin{Fn: builtinToInt}},
+	{"to_string", &object.Builtin{Fn: builtinToString}},
+	{"map", &Native{Fn: nativeMap}},
+	{"filter", &Native{Fn: nativeFilter}},
+	{"reduce", &Native{Fn: nativeReduce}},
+	{"sort", &Native{Fn: nativeSort}},
+	{"sort_by", &Native{Fn: nativeSortBy}},
+	{"any", &Native{Fn: nativeAny}},
+	{"all", &Native{Fn: nativeAll}},
+	{"keys", &object.Builtin{Fn: builtinKeys}},
+	{"values", &object.Builtin{Fn: builtinValues}},
+	{"has_key", &object.Builtin{Fn: builtinHasKey}},
+	{"delete", &object.Builtin{Fn: builtinDelete}},
+	{"merge", &object.Builtin{Fn: builtinMerge}},
+	{"entries", &object.Builtin{Fn: builtinEntries}},
+	{"is_error", &object.Builtin{Fn: builtinIsError}},
 }
 
 func newError(format string, a ...any) *object.Error {
 	return &object.Error{Message: fmt.Sprintf(format, a...)}
 }
 
-func GetBuiltinByName(name string) *object.Builtin {
+// builtinIsError reports whether its arg is an ERROR object, such as one returned by a failed builtin
+// or a runtime error caught by try.
+func builtinIsError(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of args: (got=%d want=1)", len(args))
+	}
+	_, ok := args[0].(*object.Error)
+	return NativeBool(ok)
+}
+
+func GetBuiltinByName(name string) object.Object {
 	for _, def := range Builtins {
 		if def.Name == name {
 			return def.Builtin
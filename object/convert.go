@@ -0,0 +1,359 @@
+package object
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/taimats/sarupiler/monkey/object"
+)
+
+// The tag key for struct fields, e.g. `monkey:"name"`. A field tagged `monkey:"-"` is skipped.
+const structTag = "monkey"
+
+var objectType = reflect.TypeOf((*object.Object)(nil)).Elem()
+
+// ToObject converts a Go value to a monkey object.
+//
+// Integers, strings and bools become INTEGER, STRING and BOOLEAN; slices and arrays become ARRAY;
+// maps and structs become HASH, where struct fields are keyed by their name or their `monkey` tag
+// in the order of declaration, and map keys are sorted. Map keys converting to the same hash key, such as
+// 1 and int64(1), are an error, and fields promoted through a nil embedded pointer are left out.
+// Nil pointers, maps, slices and interfaces become NULL, and monkey objects are returned as they are.
+func ToObject(v any) (object.Object, error) {
+	if v == nil {
+		return Null, nil
+	}
+	if o, ok := v.(object.Object); ok {
+		return o, nil
+	}
+	return toObject(reflect.ValueOf(v))
+}
+
+func toObject(rv reflect.Value) (object.Object, error) {
+	if rv.Type().Implements(objectType) && !isNil(rv) {
+		return rv.Interface().(object.Object), nil
+	}
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NativeInt(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if u > math.MaxInt64 {
+			return nil, fmt.Errorf("integer overflow: %d", u)
+		}
+		return NativeInt(int64(u)), nil
+	case reflect.String:
+		return &object.String{Value: rv.String()}, nil
+	case reflect.Bool:
+		return NativeBool(rv.Bool()), nil
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return Null, nil
+		}
+		return toObject(rv.Elem())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return Null, nil
+		}
+		elems := make([]object.Object, rv.Len())
+		for i := range rv.Len() {
+			o, err := toObject(rv.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = o
+		}
+		return &object.Array{Elements: elems}, nil
+	case reflect.Map:
+		if rv.IsNil() {
+			return Null, nil
+		}
+		keys := make([]object.Object, 0, rv.Len())
+		values := make(map[object.Object]reflect.Value, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			key, err := toObject(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+			values[key] = iter.Value()
+		}
+		//Go maps have no order, so the keys are sorted to make the order of the hash deterministic.
+		slices.SortFunc(keys, func(a, b object.Object) int {
+			if n, err := compareObjects(a, b); err == nil {
+				return n
+			}
+			return cmp.Or(cmp.Compare(a.Type(), b.Type()), cmp.Compare(a.Inspect(), b.Inspect()))
+		})
+		hash := NewOrderedHash(len(keys))
+		for _, key := range keys {
+			//Distinct Go keys, such as 1 and int64(1), can convert to the same hash key.
+			if _, found, _ := hash.Get(key); found {
+				return nil, fmt.Errorf("duplicate hash key: %s", key.Inspect())
+			}
+			value, err := toObject(values[key])
+			if err != nil {
+				return nil, err
+			}
+			err = hash.Set(key, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return hash, nil
+	case reflect.Struct:
+		fields := structFields(rv.Type())
+		hash := NewOrderedHash(len(fields))
+		for _, f := range fields {
+			//Fields promoted through a nil embedded pointer do not exist, so they are left out.
+			field, err := rv.FieldByIndexErr(f.index)
+			if err != nil {
+				continue
+			}
+			value, err := toObject(field)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", f.name, err)
+			}
+			hash.Set(&object.String{Value: f.name}, value)
+		}
+		return hash, nil
+	default:
+		return nil, fmt.Errorf("unsupported Go type: %s", rv.Type())
+	}
+}
+
+// ToValue converts a monkey object to a plain Go value.
+// INTEGER becomes int64, ARRAY []any and HASH map[any]any, while NULL becomes nil.
+func ToValue(o object.Object) (any, error) {
+	switch o := o.(type) {
+	case nil, *object.Null:
+		return nil, nil
+	case *object.Integer:
+		return o.Value, nil
+	case *object.String:
+		return o.Value, nil
+	case *object.Boolean:
+		return o.Value, nil
+	case *object.Array:
+		values := make([]any, len(o.Elements))
+		for i, e := range o.Elements {
+			v, err := ToValue(e)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return values, nil
+	case *object.Hash, *OrderedHash:
+		pairs, _ := hashPairs(o)
+		values := make(map[any]any, len(pairs))
+		for _, pair := range pairs {
+			k, err := ToValue(pair.Key)
+			if err != nil {
+				return nil, err
+			}
+			v, err := ToValue(pair.Value)
+			if err != nil {
+				return nil, err
+			}
+			values[k] = v
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported object type: %s", o.Type())
+	}
+}
+
+// FromObject stores the Go representation of o in the value pointed to by target.
+// It is the inverse of ToObject: a HASH can be decoded into a map or a struct, and NULL resets
+// the target to its zero value. Integers are checked for overflow of the target type.
+func FromObject(o object.Object, target any) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("target must be a non-nil pointer: (got=%T)", target)
+	}
+	return fromObject(o, rv.Elem())
+}
+
+func fromObject(o object.Object, rv reflect.Value) error {
+	if o == nil || o.Type() == object.NULL_OBJ {
+		rv.Set(reflect.Zero(rv.Type()))
+		return nil
+	}
+	if rv.Type() == objectType {
+		rv.Set(reflect.ValueOf(o))
+		return nil
+	}
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.NumMethod() > 0 {
+			break
+		}
+		v, err := ToValue(o)
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(&v).Elem())
+		return nil
+	case reflect.Pointer:
+		elem := reflect.New(rv.Type().Elem())
+		err := fromObject(o, elem.Elem())
+		if err != nil {
+			return err
+		}
+		rv.Set(elem)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := o.(*object.Integer)
+		if !ok {
+			break
+		}
+		if rv.OverflowInt(i.Value) {
+			return fmt.Errorf("integer overflow: %d does not fit in %s", i.Value, rv.Type())
+		}
+		rv.SetInt(i.Value)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, ok := o.(*object.Integer)
+		if !ok {
+			break
+		}
+		if i.Value < 0 || rv.OverflowUint(uint64(i.Value)) {
+			return fmt.Errorf("integer overflow: %d does not fit in %s", i.Value, rv.Type())
+		}
+		rv.SetUint(uint64(i.Value))
+		return nil
+	case reflect.String:
+		s, ok := o.(*object.String)
+		if !ok {
+			break
+		}
+		rv.SetString(s.Value)
+		return nil
+	case reflect.Bool:
+		b, ok := o.(*object.Boolean)
+		if !ok {
+			break
+		}
+		rv.SetBool(b.Value)
+		return nil
+	case reflect.Slice, reflect.Array:
+		arr, ok := o.(*object.Array)
+		if !ok {
+			break
+		}
+		if rv.Kind() == reflect.Slice {
+			rv.Set(reflect.MakeSlice(rv.Type(), len(arr.Elements), len(arr.Elements)))
+		} else if rv.Len() != len(arr.Elements) {
+			return fmt.Errorf("array length mismatch: (got=%d want=%d)", len(arr.Elements), rv.Len())
+		}
+		for i, e := range arr.Elements {
+			err := fromObject(e, rv.Index(i))
+			if err != nil {
+				return fmt.Errorf("index %d: %w", i, err)
+			}
+		}
+		return nil
+	case reflect.Map:
+		pairs, ok := hashPairs(o)
+		if !ok {
+			break
+		}
+		m := reflect.MakeMapWithSize(rv.Type(), len(pairs))
+		for _, pair := range pairs {
+			k := reflect.New(rv.Type().Key()).Elem()
+			err := fromObject(pair.Key, k)
+			if err != nil {
+				return fmt.Errorf("key %s: %w", pair.Key.Inspect(), err)
+			}
+			v := reflect.New(rv.Type().Elem()).Elem()
+			err = fromObject(pair.Value, v)
+			if err != nil {
+				return fmt.Errorf("key %s: %w", pair.Key.Inspect(), err)
+			}
+			m.SetMapIndex(k, v)
+		}
+		rv.Set(m)
+		return nil
+	case reflect.Struct:
+		hash, ok := toOrderedHash(o)
+		if !ok {
+			break
+		}
+		for _, f := range structFields(rv.Type()) {
+			value, ok, _ := hash.Get(&object.String{Value: f.name})
+			if !ok {
+				continue
+			}
+			field, err := fieldByIndexAlloc(rv, f.index)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", f.name, err)
+			}
+			err = fromObject(value, field)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", f.name, err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported Go type: %s", rv.Type())
+	}
+	return fmt.Errorf("cannot convert %s to %s", o.Type(), rv.Type())
+}
+
+// fieldByIndexAlloc returns the nested field of rv at index, allocating the nil embedded pointers on the way.
+func fieldByIndexAlloc(rv reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				if !rv.CanSet() {
+					return reflect.Value{}, fmt.Errorf("cannot set embedded pointer to unexported struct: %s", rv.Type())
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, nil
+}
+
+func isNil(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+		return rv.IsNil()
+	}
+	return false
+}
+
+type structField struct {
+	name  string
+	index []int
+}
+
+// structFields lists the exported fields of t with the keys they are converted to.
+func structFields(t reflect.Type) []structField {
+	var fields []structField
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup(structTag); ok {
+			tag, _, _ = strings.Cut(tag, ",")
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		fields = append(fields, structField{name: name, index: f.Index})
+	}
+	return fields
+}
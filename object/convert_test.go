@@ -0,0 +1,112 @@
+package object_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taimats/sarupiler/monkey/object"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+type Inner struct {
+	X int
+}
+
+type Outer struct {
+	*Inner
+	Y int
+}
+
+type inner struct {
+	X int
+}
+
+type hidden struct {
+	*inner
+	Y int
+}
+
+type tagged struct {
+	Name string `monkey:"name"`
+	Skip int    `monkey:"-"`
+	Age  int
+}
+
+func TestToObject(t *testing.T) {
+	tests := []struct {
+		name string
+		in   any
+		want string
+	}{
+		{"nil", nil, "null"},
+		{"int", 5, "5"},
+		{"uint", uint8(7), "7"},
+		{"slice", []int{1, 2}, "[1, 2]"},
+		{"nil slice", []int(nil), "null"},
+		{"map", map[string]int{"b": 1, "a": 2}, "{a: 2, b: 1}"},
+		{"map with integer keys", map[int]string{10: "x", 9: "y"}, "{9: y, 10: x}"},
+		{"struct", tagged{Name: "monkey", Skip: 1, Age: 3}, "{name: monkey, Age: 3}"},
+		{"embedded pointer", Outer{Inner: &Inner{X: 1}, Y: 2}, "{X: 1, Y: 2}"},
+		{"nil embedded pointer", Outer{Y: 2}, "{Y: 2}"},
+		{"nil unexported embedded pointer", hidden{Y: 2}, "{Y: 2}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := obj.ToObject(tt.in)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got.Inspect())
+			}
+		})
+	}
+}
+
+func TestToObjectErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   any
+		want string
+	}{
+		{"duplicate keys", map[any]int{1: 1, int64(1): 2}, "duplicate hash key: 1"},
+		{"duplicate large keys", map[any]int{5000: 1, int8(0): 0, int64(5000): 2}, "duplicate hash key: 5000"},
+		{"overflow", uint64(math.MaxUint64), "integer overflow: 18446744073709551615"},
+		{"unsupported", make(chan int), "unsupported Go type: chan int"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := obj.ToObject(tt.in)
+			assert.EqualError(t, err, tt.want)
+		})
+	}
+}
+
+func TestFromObject(t *testing.T) {
+	a := assert.New(t)
+	hash := func(v map[string]any) object.Object {
+		o, err := obj.ToObject(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+
+	var outer Outer
+	a.NoError(obj.FromObject(hash(map[string]any{"X": 1, "Y": 2}), &outer))
+	a.Equal(Outer{Inner: &Inner{X: 1}, Y: 2}, outer)
+
+	outer = Outer{}
+	a.NoError(obj.FromObject(hash(map[string]any{"Y": 2}), &outer))
+	a.Equal(Outer{Y: 2}, outer)
+
+	var h hidden
+	err := obj.FromObject(hash(map[string]any{"X": 1}), &h)
+	a.EqualError(err, "field X: cannot set embedded pointer to unexported struct: *object_test.inner")
+
+	var tg tagged
+	a.NoError(obj.FromObject(hash(map[string]any{"name": "monkey", "Skip": 1, "Age": 3}), &tg))
+	a.Equal(tagged{Name: "monkey", Age: 3}, tg)
+
+	var small int8
+	a.EqualError(obj.FromObject(obj.NativeInt(300), &small), "integer overflow: 300 does not fit in int8")
+	a.EqualError(obj.FromObject(obj.NativeInt(1), small), "target must be a non-nil pointer: (got=int8)")
+}
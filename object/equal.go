@@ -0,0 +1,86 @@
+package object
+
+import (
+	"github.com/taimats/sarupiler/monkey/object"
+)
+
+// Equal reports whether a and b are structurally equal. Integers, booleans and strings are compared by value,
+// arrays element by element and hashes pair by pair regardless of their order. Any other objects,
+// such as functions, are equal only if they are identical.
+func Equal(a, b object.Object) bool {
+	return equal(a, b, nil)
+}
+
+// equal compares a and b, where seen holds the pairs of arrays and hashes being compared further up.
+// A pair which is met again is a cycle, and it is assumed to be equal so that the comparison terminates.
+// seen is nil until the comparison first recurses, so that comparing scalars allocates nothing.
+func equal(a, b object.Object, seen map[[2]object.Object]bool) bool {
+	if a == b {
+		return true
+	}
+	if a == nil || b == nil || a.Type() != b.Type() {
+		return false
+	}
+	switch a := a.(type) {
+	case *object.Integer:
+		return a.Value == b.(*object.Integer).Value
+	case *object.Boolean:
+		b, ok := b.(*object.Boolean)
+		return ok && a.Value == b.Value
+	case *object.String:
+		return a.Value == b.(*object.String).Value
+	case *object.Null:
+		return true
+	case *object.Array:
+		b, ok := b.(*object.Array)
+		if !ok || len(a.Elements) != len(b.Elements) {
+			return false
+		}
+		pair := [2]object.Object{a, b}
+		if seen[pair] {
+			return true
+		}
+		if seen == nil {
+			seen = make(map[[2]object.Object]bool)
+		}
+		seen[pair] = true
+		defer delete(seen, pair)
+		for i := range a.Elements {
+			if !equal(a.Elements[i], b.Elements[i], seen) {
+				return false
+			}
+		}
+		return true
+	case *OrderedHash, *object.Hash:
+		return equalHashes(a, b, seen)
+	default:
+		return false
+	}
+}
+
+func equalHashes(a, b object.Object, seen map[[2]object.Object]bool) bool {
+	ap, ok := hashPairs(a)
+	if !ok {
+		return false
+	}
+	bh, ok := toOrderedHash(b)
+	if !ok || len(ap) != bh.Len() {
+		return false
+	}
+	pair := [2]object.Object{a, b}
+	if seen[pair] {
+		return true
+	}
+	if seen == nil {
+		seen = make(map[[2]object.Object]bool)
+	}
+	seen[pair] = true
+	defer delete(seen, pair)
+	for _, p := range ap {
+		v, found, err := bh.Get(p.Key)
+		if err != nil || !found || !equal(p.Value, v, seen) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,247 @@
+package object
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/taimats/sarupiler/monkey/object"
+)
+
+// OrderedHash is a HASH object which remembers the order in which its keys were inserted.
+// Lookups go through a map from hash keys to positions, so they stay O(1), while iteration,
+// Inspect and the hash builtins follow the insertion order.
+type OrderedHash struct {
+	index map[object.HashKey]int
+	pairs []object.HashPair
+}
+
+func NewOrderedHash(size int) *OrderedHash {
+	return &OrderedHash{
+		index: make(map[object.HashKey]int, size),
+		pairs: make([]object.HashPair, 0, size),
+	}
+}
+
+func (h *OrderedHash) Type() object.ObjectType {
+	return object.HASH_OBJ
+}
+
+func (h *OrderedHash) Inspect() string {
+	var out bytes.Buffer
+	out.WriteString("{")
+	for i, pair := range h.pairs {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		fmt.Fprintf(&out, "%s: %s", pair.Key.Inspect(), pair.Value.Inspect())
+	}
+	out.WriteString("}")
+	return out.String()
+}
+
+// Set binds key to value. A new key is appended, while an existing key keeps its position.
+func (h *OrderedHash) Set(key, value object.Object) error {
+	hashable, ok := key.(object.Hashable)
+	if !ok {
+		return fmt.Errorf("invalid hash key: %s", key.Type())
+	}
+	hk := hashable.HashKey()
+	if i, ok := h.index[hk]; ok {
+		h.pairs[i].Value = value
+		return nil
+	}
+	h.index[hk] = len(h.pairs)
+	h.pairs = append(h.pairs, object.HashPair{Key: key, Value: value})
+	return nil
+}
+
+// Get returns the value bound to key.
+func (h *OrderedHash) Get(key object.Object) (object.Object, bool, error) {
+	hashable, ok := key.(object.Hashable)
+	if !ok {
+		return nil, false, fmt.Errorf("invalid hash key: %s", key.Type())
+	}
+	i, ok := h.index[hashable.HashKey()]
+	if !ok {
+		return nil, false, nil
+	}
+	return h.pairs[i].Value, true, nil
+}
+
+// Position returns the position of the pair of the hash key hk in insertion order.
+func (h *OrderedHash) Position(hk object.HashKey) (int, bool) {
+	i, ok := h.index[hk]
+	return i, ok
+}
+
+// Delete removes key, and reports whether it was present.
+func (h *OrderedHash) Delete(key object.Object) (bool, error) {
+	hashable, ok := key.(object.Hashable)
+	if !ok {
+		return false, fmt.Errorf("invalid hash key: %s", key.Type())
+	}
+	hk := hashable.HashKey()
+	i, ok := h.index[hk]
+	if !ok {
+		return false, nil
+	}
+	delete(h.index, hk)
+	h.pairs = slices.Delete(h.pairs, i, i+1)
+	for j := i; j < len(h.pairs); j++ {
+		h.index[h.pairs[j].Key.(object.Hashable).HashKey()] = j
+	}
+	return true, nil
+}
+
+func (h *OrderedHash) Len() int {
+	return len(h.pairs)
+}
+
+// Pairs returns the pairs in insertion order. The returned slice must not be modified.
+func (h *OrderedHash) Pairs() []object.HashPair {
+	return h.pairs
+}
+
+func (h *OrderedHash) Copy() *OrderedHash {
+	c := NewOrderedHash(len(h.pairs))
+	for _, pair := range h.pairs {
+		c.index[pair.Key.(object.Hashable).HashKey()] = len(c.pairs)
+		c.pairs = append(c.pairs, pair)
+	}
+	return c
+}
+
+// hashPairs returns the pairs of a HASH object in a deterministic order: insertion order for an
+// OrderedHash, and the order of the inspected keys for an *object.Hash whose pairs live in a Go map.
+func hashPairs(o object.Object) ([]object.HashPair, bool) {
+	switch h := o.(type) {
+	case *OrderedHash:
+		return h.pairs, true
+	case *object.Hash:
+		pairs := make([]object.HashPair, 0, len(h.Pairs))
+		for _, pair := range h.Pairs {
+			pairs = append(pairs, pair)
+		}
+		slices.SortFunc(pairs, func(a, b object.HashPair) int {
+			return cmp.Or(cmp.Compare(a.Key.Type(), b.Key.Type()), cmp.Compare(a.Key.Inspect(), b.Key.Inspect()))
+		})
+		return pairs, true
+	default:
+		return nil, false
+	}
+}
+
+// toOrderedHash returns a HASH object as an OrderedHash, copying it if it is an *object.Hash.
+func toOrderedHash(o object.Object) (*OrderedHash, bool) {
+	if h, ok := o.(*OrderedHash); ok {
+		return h, true
+	}
+	pairs, ok := hashPairs(o)
+	if !ok {
+		return nil, false
+	}
+	h := NewOrderedHash(len(pairs))
+	for _, pair := range pairs {
+		h.Set(pair.Key, pair.Value)
+	}
+	return h, true
+}
+
+func builtinKeys(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of args: (got=%d want=1)", len(args))
+	}
+	pairs, ok := hashPairs(args[0])
+	if !ok {
+		return newError("an arg must be HASH_OBJ: (got=%s)", args[0].Type())
+	}
+	elems := make([]object.Object, len(pairs))
+	for i, pair := range pairs {
+		elems[i] = pair.Key
+	}
+	return &object.Array{Elements: elems}
+}
+
+func builtinValues(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of args: (got=%d want=1)", len(args))
+	}
+	pairs, ok := hashPairs(args[0])
+	if !ok {
+		return newError("an arg must be HASH_OBJ: (got=%s)", args[0].Type())
+	}
+	elems := make([]object.Object, len(pairs))
+	for i, pair := range pairs {
+		elems[i] = pair.Value
+	}
+	return &object.Array{Elements: elems}
+}
+
+// builtinEntries returns the pairs of a hash as an array of [key, value] arrays.
+func builtinEntries(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of args: (got=%d want=1)", len(args))
+	}
+	pairs, ok := hashPairs(args[0])
+	if !ok {
+		return newError("an arg must be HASH_OBJ: (got=%s)", args[0].Type())
+	}
+	elems := make([]object.Object, len(pairs))
+	for i, pair := range pairs {
+		elems[i] = &object.Array{Elements: []object.Object{pair.Key, pair.Value}}
+	}
+	return &object.Array{Elements: elems}
+}
+
+func builtinHasKey(args ...object.Object) object.Object {
+	if len(args) != 2 {
+		return newError("wrong number of args: (got=%d want=2)", len(args))
+	}
+	h, ok := toOrderedHash(args[0])
+	if !ok {
+		return newError("an arg must be HASH_OBJ: (got=%s)", args[0].Type())
+	}
+	_, found, err := h.Get(args[1])
+	if err != nil {
+		return newError("%s", err)
+	}
+	return NativeBool(found)
+}
+
+// builtinDelete returns a copy of a hash without the key. Like push, it leaves the original untouched.
+func builtinDelete(args ...object.Object) object.Object {
+	if len(args) != 2 {
+		return newError("wrong number of args: (got=%d want=2)", len(args))
+	}
+	h, ok := toOrderedHash(args[0])
+	if !ok {
+		return newError("an arg must be HASH_OBJ: (got=%s)", args[0].Type())
+	}
+	result := h.Copy()
+	_, err := result.Delete(args[1])
+	if err != nil {
+		return newError("%s", err)
+	}
+	return result
+}
+
+// builtinMerge returns a new hash with the pairs of all args. When a key appears more than once,
+// the last value wins and the key keeps the position of its first appearance.
+func builtinMerge(args ...object.Object) object.Object {
+	if len(args) < 1 {
+		return newError("wrong number of args: (got=%d want>=1)", len(args))
+	}
+	result := NewOrderedHash(0)
+	for _, arg := range args {
+		pairs, ok := hashPairs(arg)
+		if !ok {
+			return newError("an arg must be HASH_OBJ: (got=%s)", arg.Type())
+		}
+		for _, pair := range pairs {
+			result.Set(pair.Key, pair.Value)
+		}
+	}
+	return result
+}
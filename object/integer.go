@@ -0,0 +1,28 @@
+package object
+
+import (
+	"github.com/taimats/sarupiler/monkey/object"
+)
+
+// Integers from minSmallInt to maxSmallInt are preallocated, so that counters, indices and the results
+// of arithmetic on them do not allocate. Integer objects are never modified, so they can be shared.
+const (
+	minSmallInt = -256
+	maxSmallInt = 1024
+)
+
+var smallInts = func() []object.Integer {
+	ints := make([]object.Integer, maxSmallInt-minSmallInt+1)
+	for i := range ints {
+		ints[i].Value = int64(i + minSmallInt)
+	}
+	return ints
+}()
+
+// NativeInt returns an Integer object of v, which is shared with every other use of v if v is small.
+func NativeInt(v int64) *object.Integer {
+	if v >= minSmallInt && v <= maxSmallInt {
+		return &smallInts[v-minSmallInt]
+	}
+	return &object.Integer{Value: v}
+}
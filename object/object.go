@@ -12,10 +12,64 @@ const (
 	CLOSURE_OBJ           = "CLOSURE"
 )
 
+// Null, True and False are the only instances of their types, so that they can be compared by identity.
+var (
+	Null  = &object.Null{}
+	True  = &object.Boolean{Value: true}
+	False = &object.Boolean{Value: false}
+)
+
+func NativeBool(b bool) *object.Boolean {
+	if b {
+		return True
+	}
+	return False
+}
+
+// IsTruthy reports whether o counts as true in conditions. Only false and null are falsy.
+func IsTruthy(o object.Object) bool {
+	switch o := o.(type) {
+	case *object.Boolean:
+		return o.Value
+	case *object.Null:
+		return false
+	case nil: //a global which has never been set
+		return false
+	default:
+		return true
+	}
+}
+
 type CompiledFunction struct {
 	Instructions  code.Instructions
 	NumLocals     int
-	NumParameters int
+	NumParameters int       //NumParameters counts every parameter, including optional and rest ones.
+	NumOptional   int       //NumOptional is the number of parameters with a default value.
+	Variadic      bool      //Variadic tells if the last parameter gathers the extra args into an array.
+	Entries       []int     //Entries[k] is where a call passing k optional args starts. It is nil without optional parameters.
+	Handlers      []Handler //Handlers is the exception-handler table of the function.
+}
+
+// Arity returns the minimum number of args of the function, and the maximum number or -1 if it is variadic.
+func (cf *CompiledFunction) Arity() (int, int) {
+	fixed := cf.NumParameters
+	if cf.Variadic {
+		fixed--
+	}
+	required := fixed - cf.NumOptional
+	if cf.Variadic {
+		return required, -1
+	}
+	return required, fixed
+}
+
+// Handler guards the OpCall of a try body or catch function, which spans the instructions from Start up to End.
+// When the call raises an exception, the frames above are discarded, the callee and its args are removed
+// from the stack, the exception is pushed and execution goes on at Target.
+type Handler struct {
+	Start  int
+	End    int
+	Target int
 }
 
 func (cf *CompiledFunction) Type() object.ObjectType {
@@ -42,3 +96,27 @@ func (c *Closure) Type() object.ObjectType {
 func (c *Closure) Inspect() string {
 	return fmt.Sprintf("CompiledFunction[%p]", c)
 }
+
+// Caller calls a closure or a builtin and returns its return value. The VM implements Caller,
+// so that builtins can call functions passed to them while the VM is running.
+type Caller interface {
+	Call(fn object.Object, args ...object.Object) (object.Object, error)
+}
+
+// NativeFunction is a builtin which receives a Caller. Invalid args are reported by returning an ERROR
+// object like ordinary builtins, while errors returned by the Caller are returned as Go errors so that
+// the VM aborts as it would have done if the script had called the function itself.
+type NativeFunction func(c Caller, args ...object.Object) (object.Object, error)
+
+// Native is a builtin which can call back into the VM.
+type Native struct {
+	Fn NativeFunction
+}
+
+func (n *Native) Type() object.ObjectType {
+	return object.BUILTIN_OBJ
+}
+
+func (n *Native) Inspect() string {
+	return "builtin function"
+}
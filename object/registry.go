@@ -0,0 +1,166 @@
+package object
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/taimats/sarupiler/monkey/object"
+)
+
+// BuiltinDef binds a Go function to the name under which scripts call it.
+// Builtin is either an *object.Builtin or a *Native.
+type BuiltinDef struct {
+	Name    string
+	Builtin object.Object
+}
+
+// Registry is an ordered set of builtin functions. The compiler resolves builtin names
+// to their index in a registry, and the VM fetches builtins by that index at runtime.
+// Builtins can only be appended, so an index once handed out to the compiler never changes.
+type Registry struct {
+	defs  []BuiltinDef
+	index map[string]int
+}
+
+func NewRegistry() *Registry {
+	return &Registry{index: make(map[string]int)}
+}
+
+// DefaultRegistry returns a new registry holding Builtins.
+// Every call returns a fresh registry, so that registering functions to it never affects other embeddings.
+func DefaultRegistry() *Registry {
+	r := NewRegistry()
+	for _, def := range Builtins {
+		r.defs = append(r.defs, def)
+		r.index[def.Name] = len(r.defs) - 1
+	}
+	return r
+}
+
+// MaxBuiltins is the number of builtins a registry can hold, which is limited by the one-byte operand of
+// OpGetBuiltin.
+const MaxBuiltins = 256
+
+// Register appends fn to the registry under the given name.
+func (r *Registry) Register(name string, fn object.BuiltinFunction) error {
+	return r.add(name, &object.Builtin{Fn: fn})
+}
+
+// RegisterNative appends a builtin which can call back into the VM, e.g. to call closures passed as args.
+func (r *Registry) RegisterNative(name string, fn NativeFunction) error {
+	return r.add(name, &Native{Fn: fn})
+}
+
+func (r *Registry) add(name string, builtin object.Object) error {
+	if _, ok := r.index[name]; ok {
+		return fmt.Errorf("builtin already registered: %s", name)
+	}
+	if len(r.defs) >= MaxBuiltins {
+		return fmt.Errorf("too many builtins: a registry holds at most %d: %s", MaxBuiltins, name)
+	}
+	r.defs = append(r.defs, BuiltinDef{Name: name, Builtin: builtin})
+	r.index[name] = len(r.defs) - 1
+	return nil
+}
+
+// RegisterFunc registers an ordinary Go function as a builtin.
+// Arguments are converted with FromObject and the return value with ToObject. The function may
+// return nothing, a single value, or a value followed by an error, which is reported as an ERROR object.
+func (r *Registry) RegisterFunc(name string, fn any) error {
+	builtin, err := wrapFunc(name, fn)
+	if err != nil {
+		return err
+	}
+	return r.Register(name, builtin)
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+func wrapFunc(name string, fn any) (object.BuiltinFunction, error) {
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func {
+		return nil, fmt.Errorf("builtin %s must be a function: (got=%T)", name, fn)
+	}
+	ft := fv.Type()
+	numOut := ft.NumOut()
+	returnsErr := numOut > 0 && ft.Out(numOut-1) == errorType
+	if numOut > 2 || (numOut == 2 && !returnsErr) {
+		return nil, fmt.Errorf("builtin %s must return at most a value and an error: (got=%s)", name, ft)
+	}
+
+	return func(args ...object.Object) object.Object {
+		numIn := ft.NumIn()
+		if ft.IsVariadic() {
+			if len(args) < numIn-1 {
+				return newError("wrong number of args: (got=%d want>=%d)", len(args), numIn-1)
+			}
+		} else if len(args) != numIn {
+			return newError("wrong number of args: (got=%d want=%d)", len(args), numIn)
+		}
+		in := make([]reflect.Value, len(args))
+		for i, a := range args {
+			var t reflect.Type
+			if ft.IsVariadic() && i >= numIn-1 {
+				t = ft.In(numIn - 1).Elem()
+			} else {
+				t = ft.In(i)
+			}
+			v := reflect.New(t).Elem()
+			if err := fromObject(a, v); err != nil {
+				return newError("invalid arg %d for %s(): %s", i, name, err)
+			}
+			in[i] = v
+		}
+		out := fv.Call(in)
+		if returnsErr {
+			if err, _ := out[numOut-1].Interface().(error); err != nil {
+				return newError("%s", err)
+			}
+			out = out[:numOut-1]
+		}
+		if len(out) == 0 {
+			return nil
+		}
+		result, err := toObject(out[0])
+		if err != nil {
+			return newError("invalid return value of %s(): %s", name, err)
+		}
+		return result
+	}, nil
+}
+
+// Definitions returns the registered builtins in the order of their indices.
+func (r *Registry) Definitions() []BuiltinDef {
+	return r.defs
+}
+
+// At returns the builtin registered at index i.
+func (r *Registry) At(i int) (BuiltinDef, bool) {
+	if i < 0 || i >= len(r.defs) {
+		return BuiltinDef{}, false
+	}
+	return r.defs[i], true
+}
+
+// Lookup returns the builtin registered under the name and its index.
+func (r *Registry) Lookup(name string) (object.Object, int, bool) {
+	i, ok := r.index[name]
+	if !ok {
+		return nil, -1, false
+	}
+	return r.defs[i].Builtin, i, true
+}
+
+// NameOf returns the name under which b is registered.
+func (r *Registry) NameOf(b object.Object) (string, bool) {
+	for _, def := range r.defs {
+		if def.Builtin == b {
+			return def.Name, true
+		}
+	}
+	return "", false
+}
+
+func (r *Registry) Len() int {
+	return len(r.defs)
+}
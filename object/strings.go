@@ -0,0 +1,198 @@
+package object
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/taimats/sarupiler/monkey/object"
+)
+
+// stringArgs checks that args are n STRING objects and returns their values.
+func stringArgs(args []object.Object, n int) ([]string, *object.Error) {
+	if len(args) != n {
+		return nil, newError("wrong number of args: (got=%d want=%d)", len(args), n)
+	}
+	values := make([]string, n)
+	for i, arg := range args {
+		s, ok := arg.(*object.String)
+		if !ok {
+			return nil, newError("an arg must be STRING_OBJ: (got=%s)", arg.Type())
+		}
+		values[i] = s.Value
+	}
+	return values, nil
+}
+
+func stringFunc(fn func(s string) string) *object.Builtin {
+	return &object.Builtin{Fn: func(args ...object.Object) object.Object {
+		values, err := stringArgs(args, 1)
+		if err != nil {
+			return err
+		}
+		return &object.String{Value: fn(values[0])}
+	}}
+}
+
+func stringPredicate(fn func(s, substr string) bool) *object.Builtin {
+	return &object.Builtin{Fn: func(args ...object.Object) object.Object {
+		values, err := stringArgs(args, 2)
+		if err != nil {
+			return err
+		}
+		return NativeBool(fn(values[0], values[1]))
+	}}
+}
+
+func builtinSplit(args ...object.Object) object.Object {
+	values, err := stringArgs(args, 2)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(values[0], values[1])
+	elems := make([]object.Object, len(parts))
+	for i, p := range parts {
+		elems[i] = &object.String{Value: p}
+	}
+	return &object.Array{Elements: elems}
+}
+
+func builtinJoin(args ...object.Object) object.Object {
+	if len(args) != 2 {
+		return newError("wrong number of args: (got=%d want=2)", len(args))
+	}
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return newError("an arg must be ARRAY_OBJ: (got=%s)", args[0].Type())
+	}
+	sep, ok := args[1].(*object.String)
+	if !ok {
+		return newError("an arg must be STRING_OBJ: (got=%s)", args[1].Type())
+	}
+	parts := make([]string, len(arr.Elements))
+	for i, el := range arr.Elements {
+		s, ok := el.(*object.String)
+		if !ok {
+			return newError("an element must be STRING_OBJ: (got=%s)", el.Type())
+		}
+		parts[i] = s.Value
+	}
+	return &object.String{Value: strings.Join(parts, sep.Value)}
+}
+
+func builtinIndexOf(args ...object.Object) object.Object {
+	values, err := stringArgs(args, 2)
+	if err != nil {
+		return err
+	}
+	return NativeInt(int64(strings.Index(values[0], values[1])))
+}
+
+func builtinReplace(args ...object.Object) object.Object {
+	values, err := stringArgs(args, 3)
+	if err != nil {
+		return err
+	}
+	return &object.String{Value: strings.ReplaceAll(values[0], values[1], values[2])}
+}
+
+// builtinSubstring returns the bytes of a string from start up to, but not including, end.
+// Like len(), indices count bytes.
+func builtinSubstring(args ...object.Object) object.Object {
+	if len(args) != 3 {
+		return newError("wrong number of args: (got=%d want=3)", len(args))
+	}
+	s, ok := args[0].(*object.String)
+	if !ok {
+		return newError("an arg must be STRING_OBJ: (got=%s)", args[0].Type())
+	}
+	start, ok := args[1].(*object.Integer)
+	if !ok {
+		return newError("an arg must be INTEGER_OBJ: (got=%s)", args[1].Type())
+	}
+	end, ok := args[2].(*object.Integer)
+	if !ok {
+		return newError("an arg must be INTEGER_OBJ: (got=%s)", args[2].Type())
+	}
+	if start.Value < 0 || end.Value > int64(len(s.Value)) || start.Value > end.Value {
+		return newError("substring out of range: (start=%d end=%d len=%d)", start.Value, end.Value, len(s.Value))
+	}
+	return &object.String{Value: s.Value[start.Value:end.Value]}
+}
+
+// builtinFormat formats a string like fmt.Sprintf. Supported verbs are %d for integers, %t for booleans,
+// %s for strings, %v for any object and %% for a literal percent sign.
+func builtinFormat(args ...object.Object) object.Object {
+	if len(args) < 1 {
+		return newError("wrong number of args: (got=%d want>=1)", len(args))
+	}
+	f, ok := args[0].(*object.String)
+	if !ok {
+		return newError("an arg must be STRING_OBJ: (got=%s)", args[0].Type())
+	}
+	rest := args[1:]
+	var out strings.Builder
+	format := f.Value
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			out.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			return newError("format: missing verb at the end of %q", format)
+		}
+		verb := format[i]
+		if verb == '%' {
+			out.WriteByte('%')
+			continue
+		}
+		if len(rest) == 0 {
+			return newError("format: missing arg for %%%c", verb)
+		}
+		arg := rest[0]
+		rest = rest[1:]
+		var want object.ObjectType
+		switch verb {
+		case 'd':
+			want = object.INTEGER_OBJ
+		case 't':
+			want = object.BOOLEAN_OBJ
+		case 's':
+			want = object.STRING_OBJ
+		case 'v':
+			want = arg.Type()
+		default:
+			return newError("format: unknown verb %%%c", verb)
+		}
+		if arg.Type() != want {
+			return newError("format: %%%c expects %s: (got=%s)", verb, want, arg.Type())
+		}
+		out.WriteString(arg.Inspect())
+	}
+	if len(rest) > 0 {
+		return newError("format: too many args: (got=%d want=%d)", len(args)-1, len(args)-1-len(rest))
+	}
+	return &object.String{Value: out.String()}
+}
+
+func builtinToInt(args ...object.Object) object.Object {
+	values, err := stringArgs(args, 1)
+	if err != nil {
+		return err
+	}
+	n, perr := strconv.ParseInt(strings.TrimSpace(values[0]), 10, 64)
+	if perr != nil {
+		return newError("could not parse %q as integer", values[0])
+	}
+	return NativeInt(n)
+}
+
+func builtinToString(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of args: (got=%d want=1)", len(args))
+	}
+	if s, ok := args[0].(*object.String); ok {
+		return s
+	}
+	return &object.String{Value: args[0].Inspect()}
+}
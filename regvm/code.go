@@ -0,0 +1,158 @@
+package regvm
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Instruction is an instruction of the register machine. The lowest byte holds the opcode, followed by
+// the operand A in the next byte, and either two more byte-sized operands B and C or a 16-bit operand Bx.
+type Instruction uint32
+
+type Opcode byte
+
+const (
+	OpLoadConstant  Opcode = iota //R[A] = K[Bx]
+	OpLoadTrue                    //R[A] = true
+	OpLoadFalse                   //R[A] = false
+	OpLoadNull                    //R[A] = null
+	OpMove                        //R[A] = R[B]
+	OpGetGlobal                   //R[A] = G[Bx]
+	OpSetGlobal                   //G[Bx] = R[A]
+	OpGetBuiltin                  //R[A] = builtin Bx
+	OpGetFree                     //R[A] = free variable B of the current closure
+	OpAdd                         //R[A] = R[B] + R[C]
+	OpSub                         //R[A] = R[B] - R[C]
+	OpMul                         //R[A] = R[B] * R[C]
+	OpDiv                         //R[A] = R[B] / R[C]
+	OpEqual                       //R[A] = R[B] == R[C]
+	OpNotEqual                    //R[A] = R[B] != R[C]
+	OpGreaterThan                 //R[A] = R[B] > R[C]
+	OpMinus                       //R[A] = -R[B]
+	OpBang                        //R[A] = !R[B]
+	OpJump                        //jump to Bx
+	OpJumpNotTruthy               //jump to Bx unless R[A] is truthy
+	OpArray                       //R[A] = [R[B], ..., R[B+C-1]]
+	OpHash                        //R[A] = {R[B]: R[B+1], ..., R[B+C-2]: R[B+C-1]}
+	OpIndex                       //R[A] = R[B][R[C]]
+	OpCall                        //R[A] = R[A](R[A+1], ..., R[A+B])
+	OpReturn                      //return R[A]
+	OpReturnNull                  //return null
+	OpClosure                     //R[A] = closure of the function K[Bx], capturing R[A+1], ..., R[A+n] as free variables
+)
+
+// format tells which operands an instruction uses.
+type format int
+
+const (
+	formatA format = iota
+	formatAB
+	formatABC
+	formatABx
+	formatBx
+	formatNone
+)
+
+type Definition struct {
+	Name   string
+	format format
+}
+
+var definitions = map[Opcode]*Definition{
+	OpLoadConstant:  {"OpLoadConstant", formatABx},
+	OpLoadTrue:      {"OpLoadTrue", formatA},
+	OpLoadFalse:     {"OpLoadFalse", formatA},
+	OpLoadNull:      {"OpLoadNull", formatA},
+	OpMove:          {"OpMove", formatAB},
+	OpGetGlobal:     {"OpGetGlobal", formatABx},
+	OpSetGlobal:     {"OpSetGlobal", formatABx},
+	OpGetBuiltin:    {"OpGetBuiltin", formatABx},
+	OpGetFree:       {"OpGetFree", formatAB},
+	OpAdd:           {"OpAdd", formatABC},
+	OpSub:           {"OpSub", formatABC},
+	OpMul:           {"OpMul", formatABC},
+	OpDiv:           {"OpDiv", formatABC},
+	OpEqual:         {"OpEqual", formatABC},
+	OpNotEqual:      {"OpNotEqual", formatABC},
+	OpGreaterThan:   {"OpGreaterThan", formatABC},
+	OpMinus:         {"OpMinus", formatAB},
+	OpBang:          {"OpBang", formatAB},
+	OpJump:          {"OpJump", formatBx},
+	OpJumpNotTruthy: {"OpJumpNotTruthy", formatABx},
+	OpArray:         {"OpArray", formatABC},
+	OpHash:          {"OpHash", formatABC},
+	OpIndex:         {"OpIndex", formatABC},
+	OpCall:          {"OpCall", formatAB},
+	OpReturn:        {"OpReturn", formatA},
+	OpReturnNull:    {"OpReturnNull", formatNone},
+	OpClosure:       {"OpClosure", formatABx},
+}
+
+func Lookup(op Opcode) (*Definition, error) {
+	def, ok := definitions[op]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+	return def, nil
+}
+
+// MakeABC makes an instruction with byte-sized operands. Unused operands are 0.
+func MakeABC(op Opcode, a, b, c int) Instruction {
+	return Instruction(op) | Instruction(a&0xff)<<8 | Instruction(b&0xff)<<16 | Instruction(c&0xff)<<24
+}
+
+// MakeABx makes an instruction with a byte-sized operand A and a 16-bit operand Bx.
+func MakeABx(op Opcode, a, bx int) Instruction {
+	return Instruction(op) | Instruction(a&0xff)<<8 | Instruction(bx&0xffff)<<16
+}
+
+func (ins Instruction) Opcode() Opcode {
+	return Opcode(ins)
+}
+
+func (ins Instruction) A() int {
+	return int(ins >> 8 & 0xff)
+}
+
+func (ins Instruction) B() int {
+	return int(ins >> 16 & 0xff)
+}
+
+func (ins Instruction) C() int {
+	return int(ins >> 24)
+}
+
+func (ins Instruction) Bx() int {
+	return int(ins >> 16)
+}
+
+func (ins Instruction) String() string {
+	def, err := Lookup(ins.Opcode())
+	if err != nil {
+		return fmt.Sprintf("ERROR: %s", err)
+	}
+	switch def.format {
+	case formatA:
+		return fmt.Sprintf("%s %d", def.Name, ins.A())
+	case formatAB:
+		return fmt.Sprintf("%s %d %d", def.Name, ins.A(), ins.B())
+	case formatABC:
+		return fmt.Sprintf("%s %d %d %d", def.Name, ins.A(), ins.B(), ins.C())
+	case formatABx:
+		return fmt.Sprintf("%s %d %d", def.Name, ins.A(), ins.Bx())
+	case formatBx:
+		return fmt.Sprintf("%s %d", def.Name, ins.Bx())
+	default:
+		return def.Name
+	}
+}
+
+type Instructions []Instruction
+
+func (ins Instructions) String() string {
+	var out bytes.Buffer
+	for i, in := range ins {
+		fmt.Fprintf(&out, "%04d %s\n", i, in)
+	}
+	return out.String()
+}
@@ -0,0 +1,472 @@
+package regvm
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/taimats/sarupiler/compiler"
+	"github.com/taimats/sarupiler/monkey/ast"
+	"github.com/taimats/sarupiler/monkey/object"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// MaxRegisters is the number of registers a function can use, which is limited by the width of the operands.
+const MaxRegisters = 256
+
+// unsupported are the intrinsics of the stack compiler which the register backend does not implement yet.
+var unsupported = []string{"import", "try", "throw", "params", "spread"}
+
+// Function is a function compiled for the register machine. Its parameters occupy the first registers,
+// followed by its local bindings and the temporary registers of its expressions.
+type Function struct {
+	Instructions  Instructions
+	NumRegisters  int
+	NumParameters int
+	NumFree       int
+}
+
+func (f *Function) Type() object.ObjectType {
+	return obj.COMPILED_FUNCTION_OBJ
+}
+
+func (f *Function) Inspect() string {
+	return fmt.Sprintf("Function[%p]", f)
+}
+
+// Program is the output of the compiler. Main is the top-level program, which keeps the value of
+// the last expression statement in its register 0.
+type Program struct {
+	Main      *Function
+	Constants []object.Object
+	Builtins  *obj.Registry
+}
+
+type Compiler struct {
+	constants   []object.Object
+	symbolTable *compiler.SymbolTable
+	builtins    *obj.Registry
+	scope       *funcScope
+	sources     *compiler.SourceMap //sources gives the source order of the pairs of hash literals, if set.
+}
+
+// funcScope is the function being compiled. Registers below top are in use, and temporary registers
+// are released by resetting top once the expression using them is done.
+type funcScope struct {
+	instructions Instructions
+	top          int
+	maxTop       int
+	outer        *funcScope
+}
+
+func NewCompiler() *Compiler {
+	return NewCompilerWithBuiltins(obj.DefaultRegistry())
+}
+
+func NewCompilerWithBuiltins(r *obj.Registry) *Compiler {
+	symtable := compiler.NewSymbolTable()
+	compiler.DefineBuiltins(symtable, r)
+	return &Compiler{
+		constants:   []object.Object{},
+		symbolTable: symtable,
+		builtins:    r,
+	}
+}
+
+// SetSourceMap makes the compiler insert the pairs of hash literals in their source order, as the stack
+// compiler does with the same source map.
+func (c *Compiler) SetSourceMap(m *compiler.SourceMap) {
+	c.sources = m
+}
+
+// Compile compiles a whole program.
+func (c *Compiler) Compile(program *ast.Program) (*Program, error) {
+	c.scope = &funcScope{top: 1, maxTop: 1} //register 0 holds the value of the last expression statement.
+	for _, s := range program.Statements {
+		err := c.statement(s, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.emitABC(OpReturn, 0, 0, 0)
+	return &Program{
+		Main:      &Function{Instructions: c.scope.instructions, NumRegisters: c.scope.maxTop},
+		Constants: c.constants,
+		Builtins:  c.builtins,
+	}, nil
+}
+
+// statement compiles a statement. The value of an expression statement goes to the register result.
+func (c *Compiler) statement(node ast.Statement, result int) error {
+	switch node := node.(type) {
+	case *ast.ExpressionStatement:
+		return c.expr(node.Expression, result)
+	case *ast.LetStatement:
+		symbol := c.symbolTable.Define(node.Name.Value)
+		if symbol.Scope == compiler.LocalScope {
+			return c.expr(node.Value, symbol.Index)
+		}
+		top := c.scope.top
+		r, err := c.operand(node.Value)
+		if err != nil {
+			return err
+		}
+		c.emitABx(OpSetGlobal, r, symbol.Index)
+		c.scope.top = top
+		return nil
+	case *ast.ReturnStatement:
+		if c.scope.outer == nil {
+			err := c.expr(node.ReturnValue, result)
+			if err != nil {
+				return err
+			}
+			c.emitABC(OpReturn, result, 0, 0)
+			return nil
+		}
+		top := c.scope.top
+		r, err := c.operand(node.ReturnValue)
+		if err != nil {
+			return err
+		}
+		c.emitABC(OpReturn, r, 0, 0)
+		c.scope.top = top
+		return nil
+	default:
+		return fmt.Errorf("unsupported statement: %T", node)
+	}
+}
+
+// block compiles a block whose value, the value of its last expression statement, goes to the register dst.
+func (c *Compiler) block(node *ast.BlockStatement, dst int) error {
+	for i, s := range node.Statements {
+		err := c.statement(s, dst)
+		if err != nil {
+			return err
+		}
+		if _, ok := s.(*ast.ExpressionStatement); !ok && i == len(node.Statements)-1 {
+			c.emitABC(OpLoadNull, dst, 0, 0)
+		}
+	}
+	if len(node.Statements) == 0 {
+		c.emitABC(OpLoadNull, dst, 0, 0)
+	}
+	return nil
+}
+
+// operand returns a register holding the value of node: the register of a local binding as it is,
+// or else a new temporary register.
+func (c *Compiler) operand(node ast.Expression) (int, error) {
+	if ident, ok := node.(*ast.Identifier); ok {
+		if s, ok := c.symbolTable.Resolve(ident.Value); ok && s.Scope == compiler.LocalScope {
+			return s.Index, nil
+		}
+	}
+	r, err := c.alloc(1)
+	if err != nil {
+		return 0, err
+	}
+	return r, c.expr(node, r)
+}
+
+// alloc reserves n consecutive temporary registers and returns the first of them.
+func (c *Compiler) alloc(n int) (int, error) {
+	r := c.scope.top
+	c.scope.top += n
+	if c.scope.top > MaxRegisters {
+		return 0, fmt.Errorf("too many registers: a function can use at most %d", MaxRegisters)
+	}
+	c.scope.maxTop = max(c.scope.maxTop, c.scope.top)
+	return r, nil
+}
+
+// expr compiles an expression whose value goes to the register dst.
+func (c *Compiler) expr(node ast.Expression, dst int) error {
+	top := c.scope.top
+	defer func() { c.scope.top = top }()
+
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		c.emitABx(OpLoadConstant, dst, c.addConstant(obj.NativeInt(node.Value)))
+	case *ast.StringLiteral:
+		c.emitABx(OpLoadConstant, dst, c.addConstant(&object.String{Value: node.Value}))
+	case *ast.Boolean:
+		if node.Value {
+			c.emitABC(OpLoadTrue, dst, 0, 0)
+		} else {
+			c.emitABC(OpLoadFalse, dst, 0, 0)
+		}
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(node.Value)
+		if !ok {
+			if slices.Contains(unsupported, node.Value) {
+				return fmt.Errorf("unsupported intrinsic: %s is only implemented by the stack compiler", node.Value)
+			}
+			return fmt.Errorf("undefined variable: %s", node.Value)
+		}
+		c.load(symbol, dst)
+	case *ast.PrefixExpression:
+		r, err := c.operand(node.Right)
+		if err != nil {
+			return err
+		}
+		switch node.Operator {
+		case "!":
+			c.emitABC(OpBang, dst, r, 0)
+		case "-":
+			c.emitABC(OpMinus, dst, r, 0)
+		default:
+			return fmt.Errorf("unkown operator: %s", node.Operator)
+		}
+	case *ast.InfixExpression:
+		return c.infix(node, dst)
+	case *ast.IfExpression:
+		cond, err := c.operand(node.Condition)
+		if err != nil {
+			return err
+		}
+		jumpNotTruthyPos := c.emitABx(OpJumpNotTruthy, cond, 0)
+		c.scope.top = top
+		err = c.block(node.Consequence, dst)
+		if err != nil {
+			return err
+		}
+		jumpPos := c.emitABx(OpJump, 0, 0)
+		c.patchJump(jumpNotTruthyPos)
+		if node.Alternative == nil {
+			c.emitABC(OpLoadNull, dst, 0, 0)
+		} else {
+			err = c.block(node.Alternative, dst)
+			if err != nil {
+				return err
+			}
+		}
+		c.patchJump(jumpPos)
+	case *ast.ArrayLiteral:
+		base, err := c.exprs(node.Elements)
+		if err != nil {
+			return err
+		}
+		c.emitABC(OpArray, dst, base, len(node.Elements))
+	case *ast.HashLiteral:
+		keys := c.sources.HashKeys(node)
+		elems := make([]ast.Expression, 0, len(keys)*2)
+		for _, k := range keys {
+			elems = append(elems, k, node.Pairs[k])
+		}
+		base, err := c.exprs(elems)
+		if err != nil {
+			return err
+		}
+		c.emitABC(OpHash, dst, base, len(elems))
+	case *ast.IndexExpression:
+		left, err := c.operand(node.Left)
+		if err != nil {
+			return err
+		}
+		index, err := c.operand(node.Index)
+		if err != nil {
+			return err
+		}
+		c.emitABC(OpIndex, dst, left, index)
+	case *ast.FunctionLiteral:
+		return c.function(node, dst)
+	case *ast.CallExpression:
+		if len(node.Arguments) > MaxRegisters-1 {
+			return fmt.Errorf("too many args: (got=%d max=%d)", len(node.Arguments), MaxRegisters-1)
+		}
+		base, err := c.exprs(append([]ast.Expression{node.Function}, node.Arguments...))
+		if err != nil {
+			return err
+		}
+		c.emitABC(OpCall, base, len(node.Arguments), 0)
+		c.move(dst, base)
+	default:
+		return fmt.Errorf("unsupported expression: %T", node)
+	}
+	return nil
+}
+
+func (c *Compiler) infix(node *ast.InfixExpression, dst int) error {
+	left, right := node.Left, node.Right
+	if node.Operator == "<" {
+		left, right = right, left
+	}
+	l, err := c.operand(left)
+	if err != nil {
+		return err
+	}
+	r, err := c.operand(right)
+	if err != nil {
+		return err
+	}
+	var op Opcode
+	switch node.Operator {
+	case "+":
+		op = OpAdd
+	case "-":
+		op = OpSub
+	case "*":
+		op = OpMul
+	case "/":
+		op = OpDiv
+	case ">", "<":
+		op = OpGreaterThan
+	case "==":
+		op = OpEqual
+	case "!=":
+		op = OpNotEqual
+	default:
+		return fmt.Errorf("unkown operator: %s", node.Operator)
+	}
+	c.emitABC(op, dst, l, r)
+	return nil
+}
+
+// exprs compiles expressions into consecutive new registers and returns the first of them.
+func (c *Compiler) exprs(nodes []ast.Expression) (int, error) {
+	if len(nodes) >= MaxRegisters {
+		return 0, fmt.Errorf("too many elements: (got=%d max=%d)", len(nodes), MaxRegisters-1)
+	}
+	base, err := c.alloc(len(nodes))
+	if err != nil {
+		return 0, err
+	}
+	for i, n := range nodes {
+		err := c.expr(n, base+i)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return base, nil
+}
+
+// function compiles a function literal. Registers of the parameters and of every let statement
+// in the body are reserved up front, so that temporary registers never overlap local bindings.
+func (c *Compiler) function(node *ast.FunctionLiteral, dst int) error {
+	numLocals := len(node.Parameters) + countLets(node.Body)
+	if numLocals > MaxRegisters {
+		return fmt.Errorf("too many registers: a function can use at most %d", MaxRegisters)
+	}
+	c.scope = &funcScope{top: numLocals, maxTop: numLocals, outer: c.scope}
+	c.symbolTable = compiler.NewEnclosedSymbolTable(c.symbolTable)
+	for _, p := range node.Parameters {
+		c.symbolTable.Define(p.Value)
+	}
+
+	result, err := c.alloc(1)
+	if err != nil {
+		return err
+	}
+	err = c.block(node.Body, result)
+	if err != nil {
+		return err
+	}
+	c.emitABC(OpReturn, result, 0, 0)
+
+	fn := &Function{
+		Instructions:  c.scope.instructions,
+		NumRegisters:  c.scope.maxTop,
+		NumParameters: len(node.Parameters),
+		NumFree:       len(c.symbolTable.FreeSymbols),
+	}
+	free := c.symbolTable.FreeSymbols
+	c.scope = c.scope.outer
+	c.symbolTable = c.symbolTable.Outer
+
+	fnIndex := c.addConstant(fn)
+	if len(free) == 0 {
+		c.emitABx(OpClosure, dst, fnIndex)
+		return nil
+	}
+	base, err := c.alloc(1 + len(free))
+	if err != nil {
+		return err
+	}
+	for i, s := range free {
+		c.load(s, base+1+i)
+	}
+	c.emitABx(OpClosure, base, fnIndex)
+	c.move(dst, base)
+	return nil
+}
+
+// countLets counts the let statements of a function body outside nested function literals.
+func countLets(node ast.Node) int {
+	n := 0
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			n += countLets(s)
+		}
+	case *ast.LetStatement:
+		n = 1 + countLets(node.Value)
+	case *ast.ExpressionStatement:
+		n = countLets(node.Expression)
+	case *ast.ReturnStatement:
+		n = countLets(node.ReturnValue)
+	case *ast.PrefixExpression:
+		n = countLets(node.Right)
+	case *ast.InfixExpression:
+		n = countLets(node.Left) + countLets(node.Right)
+	case *ast.IfExpression:
+		n = countLets(node.Condition) + countLets(node.Consequence)
+		if node.Alternative != nil {
+			n += countLets(node.Alternative)
+		}
+	case *ast.IndexExpression:
+		n = countLets(node.Left) + countLets(node.Index)
+	case *ast.CallExpression:
+		n = countLets(node.Function)
+		for _, a := range node.Arguments {
+			n += countLets(a)
+		}
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			n += countLets(el)
+		}
+	case *ast.HashLiteral:
+		for k, v := range node.Pairs {
+			n += countLets(k) + countLets(v)
+		}
+	}
+	return n
+}
+
+func (c *Compiler) load(s compiler.Symbol, dst int) {
+	switch s.Scope {
+	case compiler.GlobalScope:
+		c.emitABx(OpGetGlobal, dst, s.Index)
+	case compiler.LocalScope:
+		c.move(dst, s.Index)
+	case compiler.BuiltinScope:
+		c.emitABx(OpGetBuiltin, dst, s.Index)
+	case compiler.FreeScope:
+		c.emitABC(OpGetFree, dst, s.Index, 0)
+	}
+}
+
+func (c *Compiler) move(dst, src int) {
+	if dst != src {
+		c.emitABC(OpMove, dst, src, 0)
+	}
+}
+
+func (c *Compiler) addConstant(o object.Object) int {
+	c.constants = append(c.constants, o)
+	return len(c.constants) - 1
+}
+
+func (c *Compiler) emitABC(op Opcode, a, b, cc int) int {
+	c.scope.instructions = append(c.scope.instructions, MakeABC(op, a, b, cc))
+	return len(c.scope.instructions) - 1
+}
+
+func (c *Compiler) emitABx(op Opcode, a, bx int) int {
+	c.scope.instructions = append(c.scope.instructions, MakeABx(op, a, bx))
+	return len(c.scope.instructions) - 1
+}
+
+// patchJump makes the jump at pos jump to the next instruction.
+func (c *Compiler) patchJump(pos int) {
+	ins := c.scope.instructions[pos]
+	c.scope.instructions[pos] = MakeABx(ins.Opcode(), ins.A(), len(c.scope.instructions))
+}
@@ -0,0 +1,240 @@
+package regvm_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taimats/sarupiler/compiler"
+	"github.com/taimats/sarupiler/monkey/ast"
+	"github.com/taimats/sarupiler/monkey/lexer"
+	"github.com/taimats/sarupiler/monkey/object"
+	"github.com/taimats/sarupiler/monkey/parser"
+	"github.com/taimats/sarupiler/regvm"
+	"github.com/taimats/sarupiler/vm"
+)
+
+func parse(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
+
+func runRegister(t testing.TB, input string) (object.Object, error) {
+	t.Helper()
+	p := parse(input)
+	comp := regvm.NewCompiler()
+	comp.SetSourceMap(compiler.NewSourceMap(input, p))
+	program, err := comp.Compile(p)
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	m := regvm.New(program)
+	err = m.Run()
+	return m.LastValue(), err
+}
+
+func runStack(t testing.TB, input string) (object.Object, error) {
+	t.Helper()
+	p := parse(input)
+	comp := compiler.New()
+	comp.SetSourceMap(compiler.NewSourceMap(input, p))
+	err := comp.Compile(p)
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	m := vm.New(comp.Bytecode())
+	err = m.Run()
+	return m.LastPoppedStackElem(), err
+}
+
+// TestParity runs programs on both backends, which must agree on their results.
+func TestParity(t *testing.T) {
+	inputs := []string{
+		"1", "1 + 2", "50 / 2 * 2 + 10 - 5", "-50 + 100 + -50", "(5 + 10 * 2 + 15 / 3) * 2 + -10",
+		"1 < 2", "1 > 2", "1 == 1", "1 != 2", "true == false", "(1 < 2) == true", "!true", "!!5", "!(if (false) { 5; })",
+		`"mon" + "key" == "monkey"`, `"a" < "b"`, `[1, [2]] == [1, [2]]`, `{"a": 1} != {"a": 2}`,
+		"if (true) { 10 } else { 20 }", "if (1 > 2) { 10 }", "if ((if (false) { 10 })) { 10 } else { 20 }",
+		"let one = 1; let two = one + one; one + two",
+		`"mon" + "key" + "banana"`,
+		"[]", "[1 + 2, 3 - 4, 5 * 6]", "{1 + 1: 2 * 2, 3 + 3: 4 * 4}",
+		"[1, 2, 3][0 + 2]", "[[1, 1, 1]][0][0]", "[1][-1]", "{1: 1, 2: 2}[2]", "{}[0]",
+		"let fivePlusTen = fn() { 5 + 10 }; fivePlusTen();",
+		"let earlyExit = fn() { return 99; 100; }; earlyExit();",
+		"let noReturn = fn() { }; noReturn();",
+		"let f = fn() { let a = 1; }; f();",
+		"let globalSeed = 50; let minusOne = fn() { let num = 1; globalSeed - num; }; minusOne();",
+		"let sum = fn(a, b) { let c = a + b; c; }; let outer = fn() { sum(1, 2) + sum(3, 4); }; outer();",
+		"let f = fn(x) { let y = if (x > 1) { let z = x * 2; z + 1 } else { 0 }; [x, y] }; f(5)",
+		"let newAdder = fn(a, b) { let c = a + b; fn(d) { let e = d + c; fn(f) { e + f; }; }; }; newAdder(1, 2)(3)(8);",
+		"let a = 1; let newAdderOuter = fn(b) { fn(c) { fn(d) { a + b + c + d }; }; }; newAdderOuter(2)(3)(8);",
+		"let fibonacci = fn(x) { if (x == 0) { return 0; } if (x == 1) { return 1; } fibonacci(x - 1) + fibonacci(x - 2) }; fibonacci(15);",
+		`len("four") + len([1, 2])`, "first([]) ", "rest([1, 2, 3])", "push([], 1)",
+		`len(1)`, `join(split("a,b", ","), "-")`,
+		"map([1, 2, 3], fn(x) { x * 2 })", "filter([1, 2, 3, 4], fn(x) { x > 2 })",
+		"reduce([1, 2, 3], 0, fn(acc, x) { acc + x })", "let k = 3; map([1, 2], fn(x) { x + k })",
+		`keys(merge({"b": 1}, {"a": 2}))`, `keys({"b": 1, "a": 2, 10: 3, 9: 4})`,
+	}
+	for _, input := range inputs {
+		want, err := runStack(t, input)
+		if err != nil {
+			t.Fatalf("stack vm failed to run %q: (error: %s)", input, err)
+		}
+		got, err := runRegister(t, input)
+		if assert.NoError(t, err, input) {
+			assert.Equal(t, want, got, input)
+		}
+	}
+}
+
+func TestParityOfErrors(t *testing.T) {
+	inputs := []string{
+		`fn() { 1; }(1);`,
+		`fn(a, b) { a + b; }(1);`,
+		`1 + "a"`,
+		`-"a"`,
+		`"a" - "b"`,
+		`1(2)`,
+		`1[0]`,
+		`{}[fn() {}]`,
+		`map([1, 2], fn(a, b) { a })`,
+	}
+	for _, input := range inputs {
+		_, want := runStack(t, input)
+		if want == nil {
+			t.Fatalf("stack vm did not fail on %q", input)
+		}
+		_, got := runRegister(t, input)
+		if want.Error() == "unknown string operator: 3" {
+			assert.ErrorContains(t, got, "unknown string operator: ", input)
+			continue
+		}
+		assert.EqualError(t, got, want.Error(), input)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	program, err := regvm.NewCompiler().Compile(parse(`let f = fn(a, b) { a + b }; f(1, 2)`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	fn := program.Constants[0].(*regvm.Function)
+	assert.Equal(t, regvm.Instructions{
+		regvm.MakeABC(regvm.OpAdd, 2, 0, 1),
+		regvm.MakeABC(regvm.OpReturn, 2, 0, 0),
+	}, fn.Instructions, fn.Instructions.String())
+	assert.Equal(t, 3, fn.NumRegisters)
+
+	assert.Equal(t, regvm.Instructions{
+		regvm.MakeABx(regvm.OpClosure, 1, 0),
+		regvm.MakeABx(regvm.OpSetGlobal, 1, 0),
+		regvm.MakeABx(regvm.OpGetGlobal, 1, 0),
+		regvm.MakeABx(regvm.OpLoadConstant, 2, 1),
+		regvm.MakeABx(regvm.OpLoadConstant, 3, 2),
+		regvm.MakeABC(regvm.OpCall, 1, 2, 0),
+		regvm.MakeABC(regvm.OpMove, 0, 1, 0),
+		regvm.MakeABC(regvm.OpReturn, 0, 0, 0),
+	}, program.Main.Instructions, program.Main.Instructions.String())
+	assert.Equal(t, "0000 OpClosure 1 0\n0001 OpSetGlobal 1 0\n", program.Main.Instructions[:2].String())
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`undefinedVar`, "undefined variable: undefinedVar"},
+		{`try(fn() { 1 }, fn(e) { e })`, "unsupported intrinsic: try is only implemented by the stack compiler"},
+		{`import("math")`, "unsupported intrinsic: import is only implemented by the stack compiler"},
+		{`throw(1)`, "unsupported intrinsic: throw is only implemented by the stack compiler"},
+		{`params(fn(a) { a }, {"a": 1})`, "unsupported intrinsic: params is only implemented by the stack compiler"},
+		{`[spread([1])]`, "unsupported intrinsic: spread is only implemented by the stack compiler"},
+	}
+	for _, tt := range tests {
+		_, err := regvm.NewCompiler().Compile(parse(tt.input))
+		assert.EqualError(t, err, tt.want)
+	}
+}
+
+func TestCall(t *testing.T) {
+	program, err := regvm.NewCompiler().Compile(parse(`let add = fn(a, b) { a + b };`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	m := regvm.New(program)
+	err = m.Run()
+	if err != nil {
+		t.Fatalf("vm failed to run: (error: %s)", err)
+	}
+	add, err := m.Call(&object.Builtin{Fn: func(args ...object.Object) object.Object { return args[0] }}, &object.Integer{Value: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, &object.Integer{Value: 1}, add)
+}
+
+// benchmark runs input, whose last value is a function, once on each backend, and then times calls of the
+// function with args, so that neither parsing, compiling nor allocating the machine is timed.
+func benchmark(b *testing.B, input string, args ...object.Object) {
+	b.Run("stack", func(b *testing.B) {
+		comp := compiler.New()
+		err := comp.Compile(parse(input))
+		if err != nil {
+			b.Fatalf("compiler failed to compile: (error: %s)", err)
+		}
+		m := vm.New(comp.Bytecode())
+		err = m.Run()
+		if err != nil {
+			b.Fatalf("vm failed to run: (error: %s)", err)
+		}
+		fn := m.LastPoppedStackElem()
+		b.ResetTimer()
+		for range b.N {
+			_, err := m.Call(fn, args...)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("register", func(b *testing.B) {
+		program, err := regvm.NewCompiler().Compile(parse(input))
+		if err != nil {
+			b.Fatalf("compiler failed to compile: (error: %s)", err)
+		}
+		m := regvm.New(program)
+		err = m.Run()
+		if err != nil {
+			b.Fatalf("vm failed to run: (error: %s)", err)
+		}
+		fn := m.LastValue()
+		b.ResetTimer()
+		for range b.N {
+			_, err := m.Call(fn, args...)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+const fibonacci = `
+let fibonacci = fn(x) {
+	if (x < 2) {
+		return x;
+	}
+	fibonacci(x - 1) + fibonacci(x - 2)
+};
+fibonacci;
+`
+
+func BenchmarkFibonacci(b *testing.B) {
+	benchmark(b, fibonacci, &object.Integer{Value: 20})
+}
+
+const closures = `
+let makeAdder = fn(a) { fn(b) { let c = a + b; c * 2 - a } };
+let add = makeAdder(3);
+let loop = fn(n, acc) { if (n == 0) { acc } else { loop(n - 1, acc + add(n)) } };
+loop;
+`
+
+func BenchmarkClosures(b *testing.B) {
+	benchmark(b, closures, &object.Integer{Value: 500}, &object.Integer{Value: 0})
+}
@@ -0,0 +1,59 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/taimats/sarupiler/monkey/object"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// BuiltinErrorMode decides what happens when a builtin returns an ERROR object.
+type BuiltinErrorMode int
+
+const (
+	// BuiltinErrorValues pushes the ERROR object like any other return value, so that scripts can check it
+	// with is_error. It is the default.
+	BuiltinErrorValues BuiltinErrorMode = iota
+	// BuiltinErrorRaise turns the ERROR object into a *BuiltinError, which aborts the VM unless it is caught by try.
+	BuiltinErrorRaise
+)
+
+// SetBuiltinErrorMode sets how the VM treats ERROR objects returned by builtins.
+func (vm *VM) SetBuiltinErrorMode(m BuiltinErrorMode) {
+	vm.builtinErrors = m
+}
+
+// BuiltinError is the runtime error raised for a failed builtin under BuiltinErrorRaise.
+type BuiltinError struct {
+	Builtin  string
+	Message  string
+	Function string //Function is the calling function, named like in profiles (e.g. "fn#3" or "<main>").
+	Position int    //Position is the offset of the calling instruction in Function.
+}
+
+func (e *BuiltinError) Error() string {
+	return fmt.Sprintf("%s: %s (at %s:%04d)", e.Builtin, e.Message, e.Function, e.Position)
+}
+
+func (vm *VM) checkBuiltinResult(builtin, result object.Object) error {
+	errObj, ok := result.(*object.Error)
+	if !ok || vm.builtinErrors != BuiltinErrorRaise {
+		return nil
+	}
+	return &BuiltinError{
+		Builtin:  vm.builtinName(builtin),
+		Message:  errObj.Message,
+		Function: vm.functionName(vm.currentFrame().cl.Fn),
+		Position: vm.callSite,
+	}
+}
+
+// functionName names fn after its constant index, like the profiler does.
+func (vm *VM) functionName(fn *obj.CompiledFunction) string {
+	for i, c := range vm.constants {
+		if c == fn {
+			return fmt.Sprintf("fn#%d", i)
+		}
+	}
+	return mainFunctionName
+}
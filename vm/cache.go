@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"github.com/taimats/sarupiler/monkey/object"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// inlineCache remembers what an instruction looked up the last time it ran, so that running it again on the
+// same operands skips the lookup. Every entry is checked against the operands before it is used, so a cache
+// never changes what an instruction does: when a hash or a global changes, the check fails and the
+// instruction falls back to the full lookup and refills its cache.
+type inlineCache struct {
+	//for OpIndexConstant
+	key     *object.String //key is the constant the cache was filled for.
+	hashKey object.HashKey //hashKey is the hash key of key, computed once.
+	hash    *obj.OrderedHash
+	pos     int //pos is the position of key in hash.
+
+	//for OpCallCached
+	callee object.Object
+}
+
+// cache returns the inline cache in slot. The slots are allocated on first use, since functions compiled
+// separately, like the ones of earlier lines in the REPL, may use slots beyond those of the bytecode.
+func (vm *VM) cache(slot int) *inlineCache {
+	if slot >= len(vm.caches) {
+		caches := make([]inlineCache, max(slot+1, 2*len(vm.caches)))
+		copy(caches, vm.caches)
+		vm.caches = caches
+	}
+	return &vm.caches[slot]
+}
+
+// executeIndexConstant indexes left with the string constant key. Indexing the same hash as last time
+// costs a string comparison, and indexing another hash needs no hashing of the key.
+func (vm *VM) executeIndexConstant(left object.Object, key *object.String, slot int) error {
+	hash, ok := left.(*obj.OrderedHash)
+	if !ok {
+		return vm.executeIndexExpression(left, key)
+	}
+	c := vm.cache(slot)
+	if c.key != key {
+		*c = inlineCache{key: key, hashKey: key.HashKey()}
+	}
+	if c.hash == hash && c.pos < hash.Len() {
+		pair := hash.Pairs()[c.pos]
+		if k, ok := pair.Key.(*object.String); ok && k.Value == key.Value {
+			return vm.push(pair.Value)
+		}
+	}
+	pos, found := hash.Position(c.hashKey)
+	if !found {
+		return vm.push(Null)
+	}
+	c.hash = hash
+	c.pos = pos
+	return vm.push(hash.Pairs()[pos].Value)
+}
+
+// executeCachedCall calls the function below the args like OpCall. A closure which was called here last time
+// and accepted the args then is entered right away, since a call site always passes the same number of args.
+func (vm *VM) executeCachedCall(numArgs int, slot int) error {
+	callee := vm.stack[vm.sp-1-numArgs]
+	c := vm.cache(slot)
+	if c.callee != nil && callee == c.callee {
+		return vm.enterFunction(callee.(*obj.Closure), numArgs, 0)
+	}
+	cl, ok := callee.(*obj.Closure)
+	if ok && cl.Fn.NumOptional == 0 && !cl.Fn.Variadic && cl.Fn.NumParameters == numArgs {
+		c.callee = cl
+	}
+	return vm.executeCall(numArgs)
+}
@@ -0,0 +1,75 @@
+package vm
+
+import (
+	"errors"
+
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/monkey/object"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+// Exception is the error of a value raised by throw. Any other error raised while running is caught
+// as an ERROR object holding its message, and rethrowing such an object raises the original message again.
+type Exception struct {
+	Value object.Object
+}
+
+func (e *Exception) Error() string {
+	if err, ok := e.Value.(*object.Error); ok {
+		return err.Message
+	}
+	return "uncaught exception: " + e.Value.Inspect()
+}
+
+// exceptionValue returns the value which a handler receives for err.
+func exceptionValue(err error) object.Object {
+	var exc *Exception
+	if errors.As(err, &exc) {
+		return exc.Value
+	}
+	return &object.Error{Message: err.Error()}
+}
+
+// catch looks for a handler of err from the current frame down to the given depth. If it finds one,
+// the frames above the handler's frame are discarded, the stack is reset to where the guarded call was made,
+// the exception is pushed and execution resumes at the handler. Otherwise, it leaves the VM untouched and
+// reports false, so that err is returned as it is.
+func (vm *VM) catch(err error, depth int) bool {
+	for i := vm.framesIndex - 1; i >= depth; i-- {
+		frame := vm.frames[i]
+		h, ok := findHandler(frame.cl.Fn, frame.ip)
+		if !ok {
+			continue
+		}
+		if i < vm.framesIndex-1 {
+			vm.sp = vm.frames[i+1].bp - 1
+		} else {
+			//The guarded call itself has failed, so the callee and its args are still on the stack.
+			numArgs := int(code.ReadUint8(frame.Instructions()[h.Start+1:]))
+			vm.sp = vm.sp - numArgs - 1
+		}
+		vm.unwind(i + 1)
+		frame.ip = h.Target - 1
+		return vm.push(exceptionValue(err)) == nil
+	}
+	return false
+}
+
+// unwind discards the frames above depth.
+func (vm *VM) unwind(depth int) {
+	for vm.framesIndex > depth {
+		vm.popFrame()
+		if vm.profiler != nil {
+			vm.profiler.leave()
+		}
+	}
+}
+
+func findHandler(fn *obj.CompiledFunction, ip int) (obj.Handler, bool) {
+	for _, h := range fn.Handlers {
+		if h.Start <= ip && ip < h.End {
+			return h, true
+		}
+	}
+	return obj.Handler{}, false
+}
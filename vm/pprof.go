@@ -0,0 +1,180 @@
+package vm
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// Field numbers of the messages in the pprof profile.proto
+// (https://github.com/google/pprof/blob/main/proto/profile.proto) that WritePprof emits.
+const (
+	profileSampleType    = 1
+	profileSample        = 2
+	profileLocation      = 4
+	profileFunction      = 5
+	profileStringTable   = 6
+	profileDurationNanos = 10
+	profilePeriodType    = 11
+	profilePeriod        = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+
+	functionID   = 1
+	functionName = 2
+)
+
+// WritePprof writes the call tree as a gzip-compressed pprof profile, which can be
+// inspected with `go tool pprof`. Each sample is a unique call stack carrying three values:
+// the number of calls, the number of executed instructions and the exclusive time in nanoseconds.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	b := &pprofBuilder{strings: map[string]int{"": 0}, stringTable: []string{""}, functions: map[string]uint64{}}
+
+	for _, vt := range [][2]string{{"calls", "count"}, {"instructions", "count"}, {"time", "nanoseconds"}} {
+		var msg protoBuffer
+		msg.int64(valueTypeType, int64(b.str(vt[0])))
+		msg.int64(valueTypeUnit, int64(b.str(vt[1])))
+		b.out.message(profileSampleType, msg)
+	}
+
+	var walk func(n *profileNode, stack []uint64)
+	walk = func(n *profileNode, stack []uint64) {
+		stack = append([]uint64{b.location(n.name)}, stack...)
+		var msg protoBuffer
+		msg.packedUint64(sampleLocationID, stack)
+		msg.packedInt64(sampleValue, []int64{n.calls, n.instructions, n.self.Nanoseconds()})
+		b.out.message(profileSample, msg)
+		for _, child := range n.order {
+			walk(child, stack)
+		}
+	}
+	walk(p.root, nil)
+
+	for i, name := range b.functionOrder {
+		id := uint64(i + 1)
+		var line protoBuffer
+		line.uint64(lineFunctionID, id)
+		var loc protoBuffer
+		loc.uint64(locationID, id)
+		loc.message(locationLine, line)
+		b.out.message(profileLocation, loc)
+
+		var fn protoBuffer
+		fn.uint64(functionID, id)
+		fn.int64(functionName, int64(b.str(name)))
+		b.out.message(profileFunction, fn)
+	}
+
+	var period protoBuffer
+	period.int64(valueTypeType, int64(b.str("instructions")))
+	period.int64(valueTypeUnit, int64(b.str("count")))
+	b.out.message(profilePeriodType, period)
+	b.out.int64(profilePeriod, 1)
+	b.out.int64(profileDurationNanos, p.elapsed.Nanoseconds())
+
+	for _, s := range b.stringTable {
+		b.out.bytes(profileStringTable, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b.out); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+type pprofBuilder struct {
+	out protoBuffer
+
+	strings     map[string]int
+	stringTable []string
+
+	functions     map[string]uint64
+	functionOrder []string
+}
+
+func (b *pprofBuilder) str(s string) int {
+	if i, ok := b.strings[s]; ok {
+		return i
+	}
+	b.strings[s] = len(b.stringTable)
+	b.stringTable = append(b.stringTable, s)
+	return b.strings[s]
+}
+
+// location returns the id of the location for the function name.
+// Every function has exactly one location, and both share the same id.
+func (b *pprofBuilder) location(name string) uint64 {
+	if id, ok := b.functions[name]; ok {
+		return id
+	}
+	b.functionOrder = append(b.functionOrder, name)
+	b.functions[name] = uint64(len(b.functionOrder))
+	return b.functions[name]
+}
+
+// protoBuffer is a minimal protocol buffers encoder which supports the wire types used by profile.proto.
+type protoBuffer []byte
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (pb *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		*pb = append(*pb, byte(x)|0x80)
+		x >>= 7
+	}
+	*pb = append(*pb, byte(x))
+}
+
+func (pb *protoBuffer) key(field int, wire int) {
+	pb.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (pb *protoBuffer) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	pb.key(field, wireVarint)
+	pb.varint(x)
+}
+
+func (pb *protoBuffer) int64(field int, x int64) {
+	pb.uint64(field, uint64(x))
+}
+
+func (pb *protoBuffer) bytes(field int, b []byte) {
+	pb.key(field, wireBytes)
+	pb.varint(uint64(len(b)))
+	*pb = append(*pb, b...)
+}
+
+func (pb *protoBuffer) message(field int, msg protoBuffer) {
+	pb.bytes(field, msg)
+}
+
+func (pb *protoBuffer) packedUint64(field int, xs []uint64) {
+	var packed protoBuffer
+	for _, x := range xs {
+		packed.varint(x)
+	}
+	pb.bytes(field, packed)
+}
+
+func (pb *protoBuffer) packedInt64(field int, xs []int64) {
+	var packed protoBuffer
+	for _, x := range xs {
+		packed.varint(uint64(x))
+	}
+	pb.bytes(field, packed)
+}
@@ -0,0 +1,195 @@
+package vm
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/compiler"
+	"github.com/taimats/sarupiler/monkey/object"
+	obj "github.com/taimats/sarupiler/object"
+)
+
+const mainFunctionName = "<main>"
+
+// Profiler counts executed instructions per opcode and per function, and measures
+// call counts and time spent in every function. Install it on a VM with SetProfiler.
+//
+// Measurements are kept in a call tree, so that each node corresponds to a unique
+// call stack. Functions are named after the constant index of their CompiledFunction
+// (e.g. "fn#3"), the top-level program is named "<main>" and builtins keep their names.
+type Profiler struct {
+	names map[*obj.CompiledFunction]string
+
+	opCounts [256]int64
+
+	root    *profileNode
+	current *profileNode
+	last    time.Time //the last time at which elapsed time was attributed to the current node.
+	started time.Time
+	elapsed time.Duration
+	active  int //the number of nested runs of the VM, which are started by builtins and VM.Call.
+}
+
+type profileNode struct {
+	name         string
+	parent       *profileNode
+	children     map[string]*profileNode
+	order        []*profileNode //children in the order of the first call, for a stable output.
+	calls        int64
+	instructions int64
+	self         time.Duration
+}
+
+// FunctionProfile is the aggregated measurement of a single function.
+// Inclusive time includes callees while Exclusive time does not.
+// Recursive calls are not counted twice in Inclusive time.
+type FunctionProfile struct {
+	Name         string
+	Calls        int64
+	Instructions int64
+	Inclusive    time.Duration
+	Exclusive    time.Duration
+}
+
+func NewProfiler(bytecode *compiler.Bytecode) *Profiler {
+	names := make(map[*obj.CompiledFunction]string)
+	for i, c := range bytecode.Constants {
+		if fn, ok := c.(*obj.CompiledFunction); ok {
+			names[fn] = fmt.Sprintf("fn#%d", i)
+		}
+	}
+	root := newProfileNode(mainFunctionName, nil)
+	return &Profiler{names: names, root: root, current: root}
+}
+
+// SetProfiler installs p as the profiler of the VM. Passing nil disables profiling.
+// A tail call of a closure replaces the frame of the function making it, in the call tree as well: the callee
+// shows up as called by the caller of that function, and deep tail recursion stays a single node.
+func (vm *VM) SetProfiler(p *Profiler) {
+	vm.profiler = p
+}
+
+func newProfileNode(name string, parent *profileNode) *profileNode {
+	return &profileNode{name: name, parent: parent, children: make(map[string]*profileNode)}
+}
+
+func (p *Profiler) start() {
+	p.active++
+	if p.active > 1 {
+		return
+	}
+	p.last = time.Now()
+	p.started = p.last
+	if p.current == p.root {
+		p.root.calls++
+	}
+}
+
+// stop attributes the remaining time and unwinds the frames left open by a runtime error.
+func (p *Profiler) stop() {
+	p.active--
+	if p.active > 0 {
+		return
+	}
+	p.flush()
+	p.current = p.root
+	p.elapsed += p.last.Sub(p.started)
+}
+
+func (p *Profiler) flush() {
+	now := time.Now()
+	p.current.self += now.Sub(p.last)
+	p.last = now
+}
+
+func (p *Profiler) instruction(op code.Opcode) {
+	p.opCounts[op]++
+	p.current.instructions++
+}
+
+func (p *Profiler) enterFunction(fn *obj.CompiledFunction) {
+	name, ok := p.names[fn]
+	if !ok {
+		name = fmt.Sprintf("fn[%p]", fn)
+	}
+	p.enter(name)
+}
+
+func (p *Profiler) enter(name string) {
+	p.flush()
+	child, ok := p.current.children[name]
+	if !ok {
+		child = newProfileNode(name, p.current)
+		p.current.children[name] = child
+		p.current.order = append(p.current.order, child)
+	}
+	child.calls++
+	p.current = child
+}
+
+func (p *Profiler) leave() {
+	p.flush()
+	if p.current.parent != nil {
+		p.current = p.current.parent
+	}
+}
+
+// OpCounts returns the number of executed instructions per opcode.
+func (p *Profiler) OpCounts() map[code.Opcode]int64 {
+	counts := make(map[code.Opcode]int64)
+	for op, n := range p.opCounts {
+		if n > 0 {
+			counts[code.Opcode(op)] = n
+		}
+	}
+	return counts
+}
+
+// Functions returns the measurements aggregated per function, sorted by inclusive time in descending order.
+func (p *Profiler) Functions() []FunctionProfile {
+	stats := make(map[string]*FunctionProfile)
+	var order []string
+	var walk func(n *profileNode, onStack map[string]int) time.Duration
+	walk = func(n *profileNode, onStack map[string]int) time.Duration {
+		fp, ok := stats[n.name]
+		if !ok {
+			fp = &FunctionProfile{Name: n.name}
+			stats[n.name] = fp
+			order = append(order, n.name)
+		}
+		fp.Calls += n.calls
+		fp.Instructions += n.instructions
+		fp.Exclusive += n.self
+
+		onStack[n.name]++
+		inclusive := n.self
+		for _, child := range n.order {
+			inclusive += walk(child, onStack)
+		}
+		onStack[n.name]--
+		if onStack[n.name] == 0 {
+			fp.Inclusive += inclusive
+		}
+		return inclusive
+	}
+	walk(p.root, make(map[string]int))
+
+	fps := make([]FunctionProfile, 0, len(order))
+	for _, name := range order {
+		fps = append(fps, *stats[name])
+	}
+	slices.SortStableFunc(fps, func(a, b FunctionProfile) int {
+		return cmp.Compare(b.Inclusive, a.Inclusive)
+	})
+	return fps
+}
+
+func (vm *VM) builtinName(b object.Object) string {
+	if name, ok := vm.builtins.NameOf(b); ok {
+		return name
+	}
+	return "<builtin>"
+}
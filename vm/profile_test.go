@@ -0,0 +1,136 @@
+package vm_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/compiler"
+	"github.com/taimats/sarupiler/vm"
+)
+
+func runProfiled(t *testing.T, input string) *vm.Profiler {
+	t.Helper()
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	bytecode := comp.Bytecode()
+	prof := vm.NewProfiler(bytecode)
+	sut := vm.New(bytecode)
+	sut.SetProfiler(prof)
+
+	err = sut.Run()
+	if err != nil {
+		t.Fatalf("vm failed to run: (error: %s)", err)
+	}
+	return prof
+}
+
+func findFunction(fps []vm.FunctionProfile, name string) (vm.FunctionProfile, bool) {
+	for _, fp := range fps {
+		if fp.Name == name {
+			return fp, true
+		}
+	}
+	return vm.FunctionProfile{}, false
+}
+
+func TestProfilerOpCounts(t *testing.T) {
+	prof := runProfiled(t, `1 + 2; 3 + 4;`)
+
+	want := map[code.Opcode]int64{
+		code.OpConstant: 4,
+		code.OpAdd:      2,
+		code.OpPop:      2,
+	}
+	assert.Equal(t, want, prof.OpCounts())
+}
+
+func TestProfilerFunctions(t *testing.T) {
+	//wrapper adds to the result of countDown, so that the call is no tail call and countDown runs under wrapper.
+	prof := runProfiled(t, `
+	let countDown = fn(x) {
+		if (x == 0) {
+			return 0;
+		} else {
+			countDown(x - 1);
+		}
+	};
+	let wrapper = fn() { len([]); countDown(2) + 0; };
+	wrapper();
+	wrapper();
+	`)
+	fps := prof.Functions()
+	a := assert.New(t)
+
+	main, ok := findFunction(fps, "<main>")
+	a.True(ok)
+	a.Equal(int64(1), main.Calls)
+	a.Equal(int64(10), main.Instructions)
+
+	countDown, ok := findFunction(fps, "fn#3")
+	a.True(ok)
+	a.Equal(int64(6), countDown.Calls)
+
+	wrapper, ok := findFunction(fps, "fn#6")
+	a.True(ok)
+	a.Equal(int64(2), wrapper.Calls)
+	a.Equal(int64(20), wrapper.Instructions)
+	a.GreaterOrEqual(wrapper.Inclusive, wrapper.Exclusive+countDown.Inclusive)
+
+	builtin, ok := findFunction(fps, "len")
+	a.True(ok)
+	a.Equal(int64(2), builtin.Calls)
+	a.Equal(int64(0), builtin.Instructions)
+
+	a.Equal("<main>", fps[0].Name)
+}
+
+func TestProfilerTailCalls(t *testing.T) {
+	//The recursion is deeper than MaxFrames, which only works as long as tail calls reuse frames.
+	prof := runProfiled(t, `
+	let count = fn(n) { if (n == 0) { 0 } else { count(n - 1) } };
+	let start = fn() { count(5000) };
+	start();
+	`)
+	fps := prof.Functions()
+	a := assert.New(t)
+
+	count, ok := findFunction(fps, "fn#3")
+	a.True(ok)
+	a.Equal(int64(5001), count.Calls)
+
+	//start is replaced by count, which is recorded as called by <main>.
+	start, ok := findFunction(fps, "fn#5")
+	a.True(ok)
+	a.Equal(int64(1), start.Calls)
+	a.Equal(start.Exclusive, start.Inclusive)
+}
+
+func TestProfilerWritePprof(t *testing.T) {
+	prof := runProfiled(t, `let f = fn() { 1 }; f();`)
+	var buf bytes.Buffer
+
+	err := prof.WritePprof(&buf)
+	if err != nil {
+		t.Fatalf("failed to write pprof: (error: %s)", err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("pprof output is not gzip-compressed: (error: %s)", err)
+	}
+	raw, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("failed to decompress pprof output: (error: %s)", err)
+	}
+	a := assert.New(t)
+	a.Contains(string(raw), "instructions")
+	a.Contains(string(raw), "<main>")
+	a.Contains(string(raw), "fn#1")
+}
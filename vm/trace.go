@@ -0,0 +1,97 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/monkey/object"
+)
+
+// TraceStackSize is the number of elements from the top of the stack that are copied into a TraceEvent.
+const TraceStackSize = 4
+
+// TraceEvent describes an instruction that the VM is about to execute.
+// StackTop is a copy of at most TraceStackSize elements, ordered from bottom to top,
+// so the last element is the current top of the stack.
+type TraceEvent struct {
+	Depth    int //the number of frames on the frame stack. The main program runs at depth 1.
+	IP       int
+	Op       code.Opcode
+	Operands []int
+	StackTop []object.Object
+}
+
+// Tracer is called by the VM before every dispatched instruction.
+// When no tracer is set, the VM pays nothing but a nil check per instruction.
+type Tracer interface {
+	Trace(ev TraceEvent)
+}
+
+// SetTracer installs t as the tracer of the VM. Passing nil disables tracing.
+func (vm *VM) SetTracer(t Tracer) {
+	vm.tracer = t
+}
+
+func (vm *VM) trace(ip int, ins code.Instructions) {
+	op := code.Opcode(ins[ip])
+	var operands []int
+	if def, err := code.Lookup(byte(op)); err == nil {
+		operands, _ = code.ReadOperands(def, ins[ip+1:])
+	}
+	start := max(vm.sp-TraceStackSize, 0)
+	stackTop := make([]object.Object, vm.sp-start)
+	copy(stackTop, vm.stack[start:vm.sp])
+
+	vm.tracer.Trace(TraceEvent{
+		Depth:    vm.framesIndex,
+		IP:       ip,
+		Op:       op,
+		Operands: operands,
+		StackTop: stackTop,
+	})
+}
+
+// TextTracer writes one line per instruction to w in the following format.
+//
+//	[depth] ip OpName operands... | stack: [elems...]
+//
+// Lines are indented by frame depth so that nested calls are easy to follow.
+type TextTracer struct {
+	w io.Writer
+}
+
+func NewTextTracer(w io.Writer) *TextTracer {
+	return &TextTracer{w: w}
+}
+
+func (t *TextTracer) Trace(ev TraceEvent) {
+	var out strings.Builder
+	out.WriteString(strings.Repeat("  ", ev.Depth-1))
+	fmt.Fprintf(&out, "[%d] %04d %s", ev.Depth, ev.IP, opName(ev.Op))
+	for _, o := range ev.Operands {
+		fmt.Fprintf(&out, " %d", o)
+	}
+	out.WriteString(" | stack: [")
+	for i, o := range ev.StackTop {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		if o == nil {
+			out.WriteString("<nil>")
+			continue
+		}
+		out.WriteString(o.Inspect())
+	}
+	out.WriteString("]\n")
+	io.WriteString(t.w, out.String())
+}
+
+func opName(op code.Opcode) string {
+	def, err := code.Lookup(byte(op))
+	if err != nil {
+		return fmt.Sprintf("Op(%d)", op)
+	}
+	return def.Name
+}
@@ -0,0 +1,83 @@
+package vm_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/taimats/sarupiler/code"
+	"github.com/taimats/sarupiler/compiler"
+	"github.com/taimats/sarupiler/vm"
+)
+
+type recordingTracer struct {
+	events []vm.TraceEvent
+}
+
+func (r *recordingTracer) Trace(ev vm.TraceEvent) {
+	r.events = append(r.events, ev)
+}
+
+func TestTracerEvents(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn(a) { a }; f(1) + 2;`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	rec := &recordingTracer{}
+	sut := vm.New(comp.Bytecode())
+	sut.SetTracer(rec)
+
+	err = sut.Run()
+	if err != nil {
+		t.Fatalf("vm failed to run: (error: %s)", err)
+	}
+
+	ops := make([]code.Opcode, 0, len(rec.events))
+	depths := make([]int, 0, len(rec.events))
+	for _, ev := range rec.events {
+		ops = append(ops, ev.Op)
+		depths = append(depths, ev.Depth)
+	}
+	a := assert.New(t)
+	a.Equal([]code.Opcode{
+		code.OpClosure,
+		code.OpSetGlobal,
+		code.OpGetGlobal,
+		code.OpConstant,
+		code.OpCallCached,
+		code.OpGetLocal,
+		code.OpReturnValue,
+		code.OpConstant,
+		code.OpAdd,
+		code.OpPop,
+	}, ops)
+	a.Equal([]int{1, 1, 1, 1, 1, 2, 2, 1, 1, 1}, depths)
+	a.Equal([]int{1, 0}, rec.events[4].Operands)
+	a.Len(rec.events[8].StackTop, 2)
+	a.Equal("1", rec.events[8].StackTop[0].Inspect())
+	a.Equal("2", rec.events[8].StackTop[1].Inspect())
+}
+
+func TestTextTracer(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`1 + 2`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	var buf bytes.Buffer
+	sut := vm.New(comp.Bytecode())
+	sut.SetTracer(vm.NewTextTracer(&buf))
+
+	err = sut.Run()
+	if err != nil {
+		t.Fatalf("vm failed to run: (error: %s)", err)
+	}
+
+	want := `[1] 0000 OpConstant 0 | stack: []
+[1] 0003 OpConstant 1 | stack: [1]
+[1] 0006 OpAdd | stack: [1, 2]
+[1] 0007 OpPop | stack: [3]
+`
+	assert.Equal(t, want, buf.String())
+}
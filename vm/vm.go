@@ -14,9 +14,9 @@ const (
 	GlobalSize = 65536
 )
 
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
-var Null = &object.Null{}
+var True = obj.True
+var False = obj.False
+var Null = obj.Null
 
 type VM struct {
 	constants []object.Object
@@ -28,13 +28,29 @@ type VM struct {
 
 	frames      []*Frame
 	framesIndex int
+
+	builtins *obj.Registry
+
+	tracer   Tracer
+	profiler *Profiler
+
+	builtinErrors BuiltinErrorMode
+	callSite      int //callSite is the position of the call instruction being executed in the current frame.
+
+	caches []inlineCache
 }
 
+// New creates a VM running bytecode. Builtins are fetched from the registry that the bytecode
+// was compiled against, or from the default registry if the bytecode carries none.
 func New(bytecode *compiler.Bytecode) *VM {
-	cl := &obj.Closure{Fn: &obj.CompiledFunction{Instructions: bytecode.Instructions}}
+	cl := &obj.Closure{Fn: &obj.CompiledFunction{Instructions: bytecode.Instructions, Handlers: bytecode.Handlers}}
 	frames := make([]*Frame, MaxFrames)
 	frames[0] = NewFrame(cl, 0)
 
+	builtins := bytecode.Builtins
+	if builtins == nil {
+		builtins = obj.DefaultRegistry()
+	}
 	return &VM{
 		constants:   bytecode.Constants,
 		globals:     make([]object.Object, GlobalSize),
@@ -42,6 +58,8 @@ func New(bytecode *compiler.Bytecode) *VM {
 		sp:          0,
 		frames:      frames,
 		framesIndex: 1,
+		builtins:    builtins,
+		caches:      make([]inlineCache, bytecode.NumCaches),
 	}
 }
 
@@ -52,16 +70,74 @@ func NewWithGlobalStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
 }
 
 func (vm *VM) Run() error {
+	return vm.run(0)
+}
+
+// Call calls fn, which is either a closure or a builtin, with args and returns its return value.
+// It can be used once Run has finished, for example to call functions defined by a script from Go,
+// and also while the VM is running, for example by builtins that call back into closures.
+func (vm *VM) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	sp := vm.sp
+	depth := vm.framesIndex
+	callSite := vm.callSite
+	defer func() { vm.callSite = callSite }()
+	err := vm.push(fn)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range args {
+		err := vm.push(a)
+		if err != nil {
+			vm.sp = sp
+			return nil, err
+		}
+	}
+	err = vm.executeCall(len(args))
+	if err == nil {
+		err = vm.run(depth)
+	}
+	if err != nil {
+		vm.sp = sp
+		vm.unwind(depth)
+		return nil, err
+	}
+	return vm.pop(), nil
+}
+
+// run executes instructions until the frame stack shrinks to the given depth.
+// A depth of 0 runs the main program until its last instruction.
+// An error raised above depth is caught by the nearest handler, if any, and execution goes on from there.
+func (vm *VM) run(depth int) error {
+	if vm.profiler != nil {
+		vm.profiler.start()
+		defer vm.profiler.stop()
+	}
+	for {
+		err := vm.execute(depth)
+		if err == nil || !vm.catch(err, depth) {
+			return err
+		}
+	}
+}
+
+// execute executes instructions until the frame stack shrinks to the given depth or an instruction fails.
+func (vm *VM) execute(depth int) error {
 	//ip is instruction pointer.
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
-	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+	for vm.framesIndex > depth && vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
 		vm.currentFrame().ip++
 
 		ip = vm.currentFrame().ip
 		ins = vm.currentFrame().Instructions()
 		op = code.Opcode(ins[ip])
+		if vm.tracer != nil {
+			vm.trace(ip, ins)
+		}
+		if vm.profiler != nil {
+			vm.profiler.instruction(op)
+		}
 		switch op {
 		case code.OpConstant:
 			constIndex := code.ReadUint16(ins[ip+1:])
@@ -110,7 +186,7 @@ func (vm *VM) Run() error {
 			pos := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip += 2
 			condition := vm.pop()
-			if !isTruthy(condition) {
+			if !obj.IsTruthy(condition) {
 				vm.currentFrame().ip = pos - 1
 			}
 		case code.OpNull:
@@ -160,6 +236,7 @@ func (vm *VM) Run() error {
 		case code.OpCall:
 			numArgs := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
+			vm.callSite = ip
 			err := vm.executeCall(int(numArgs))
 			if err != nil {
 				return err
@@ -167,6 +244,9 @@ func (vm *VM) Run() error {
 		case code.OpReturnValue:
 			returnValue := vm.pop()
 			frame := vm.popFrame()
+			if vm.profiler != nil {
+				vm.profiler.leave()
+			}
 			vm.sp = frame.bp - 1
 			err := vm.push(returnValue)
 			if err != nil {
@@ -174,6 +254,9 @@ func (vm *VM) Run() error {
 			}
 		case code.OpReturn:
 			frame := vm.popFrame()
+			if vm.profiler != nil {
+				vm.profiler.leave()
+			}
 			vm.sp = frame.bp - 1
 			err := vm.push(Null)
 			if err != nil {
@@ -195,7 +278,10 @@ func (vm *VM) Run() error {
 		case code.OpGetBuiltin:
 			builtinIndex := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
-			def := obj.Builtins[builtinIndex]
+			def, ok := vm.builtins.At(int(builtinIndex))
+			if !ok {
+				return fmt.Errorf("undefined builtin: (index=%d)", builtinIndex)
+			}
 			err := vm.push(def.Builtin)
 			if err != nil {
 				return err
@@ -216,22 +302,76 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpThrow:
+			return &Exception{Value: vm.pop()}
+		case code.OpConcat:
+			numArrays := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+			array, err := vm.concatArrays(vm.sp-numArrays, vm.sp)
+			if err != nil {
+				return err
+			}
+			vm.sp = vm.sp - numArrays
+			err = vm.push(array)
+			if err != nil {
+				return err
+			}
+		case code.OpCallSpread:
+			vm.callSite = ip
+			err := vm.executeSpreadCall()
+			if err != nil {
+				return err
+			}
+		case code.OpAddLocalConstant, code.OpSubLocalConstant:
+			localIndex := int(code.ReadUint8(ins[ip+1:]))
+			constIndex := code.ReadUint16(ins[ip+2:])
+			vm.currentFrame().ip += 3
+			frame := vm.currentFrame()
+			err := vm.executeLocalConstantOperation(op, vm.stack[frame.bp+localIndex], vm.constants[constIndex])
+			if err != nil {
+				return err
+			}
+		case code.OpJumpUnlessGreaterThan, code.OpJumpUnlessEqual, code.OpJumpUnlessNotEqual:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+			holds, err := vm.executeComparisonJump(op)
+			if err != nil {
+				return err
+			}
+			if !holds {
+				vm.currentFrame().ip = pos - 1
+			}
+		case code.OpIndexConstant:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			slot := code.ReadUint16(ins[ip+3:])
+			vm.currentFrame().ip += 4
+			left := vm.pop()
+			err := vm.executeIndexConstant(left, vm.constants[constIndex].(*object.String), int(slot))
+			if err != nil {
+				return err
+			}
+		case code.OpTailCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			vm.callSite = ip
+			err := vm.executeTailCall(int(numArgs))
+			if err != nil {
+				return err
+			}
+		case code.OpCallCached:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			slot := code.ReadUint16(ins[ip+2:])
+			vm.currentFrame().ip += 3
+			vm.callSite = ip
+			err := vm.executeCachedCall(int(numArgs), int(slot))
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func isTruthy(obj object.Object) bool {
-	switch obj := obj.(type) {
-	case *object.Boolean:
-		return obj.Value
-	case *object.Null:
-		return false
-	default:
-		return true
-	}
-}
-
 func (vm *VM) push(o object.Object) error {
 	if vm.sp >= StackSize {
 		return fmt.Errorf("stack overflow")
@@ -290,7 +430,33 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.O
 	default:
 		return fmt.Errorf("unknown integer operator: %d", op)
 	}
-	return vm.push(&object.Integer{Value: result})
+	return vm.push(obj.NativeInt(result))
+}
+
+// executeLocalConstantOperation executes OpAddLocalConstant or OpSubLocalConstant, computing integers
+// without touching the stack and falling back to the plain instruction for any other operands.
+func (vm *VM) executeLocalConstantOperation(op code.Opcode, left, right object.Object) error {
+	binaryOp := code.OpAdd
+	if op == code.OpSubLocalConstant {
+		binaryOp = code.OpSub
+	}
+	l, lok := left.(*object.Integer)
+	r, rok := right.(*object.Integer)
+	if lok && rok {
+		if binaryOp == code.OpAdd {
+			return vm.push(obj.NativeInt(l.Value + r.Value))
+		}
+		return vm.push(obj.NativeInt(l.Value - r.Value))
+	}
+	err := vm.push(left)
+	if err != nil {
+		return err
+	}
+	err = vm.push(right)
+	if err != nil {
+		return err
+	}
+	return vm.executeBinaryOperation(binaryOp)
 }
 
 func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right object.Object) error {
@@ -308,11 +474,29 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 	if right.Type() == object.INTEGER_OBJ && left.Type() == object.INTEGER_OBJ {
 		return vm.executeIntegerComparison(op, left, right)
 	}
+	if right.Type() == object.STRING_OBJ && left.Type() == object.STRING_OBJ {
+		return vm.executeStringComparison(op, left, right)
+	}
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(obj.Equal(left, right)))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(!obj.Equal(left, right)))
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+func (vm *VM) executeStringComparison(op code.Opcode, left, right object.Object) error {
+	lv := left.(*object.String).Value
+	rv := right.(*object.String).Value
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(left == right))
+		return vm.push(nativeBoolToBooleanObject(lv == rv))
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(left != right))
+		return vm.push(nativeBoolToBooleanObject(lv != rv))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(lv > rv))
 	default:
 		return fmt.Errorf("unknown operator: %d", op)
 	}
@@ -333,6 +517,35 @@ func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object
 	}
 }
 
+// executeComparisonJump pops two operands and reports whether the comparison of a fused comparison and jump holds.
+func (vm *VM) executeComparisonJump(op code.Opcode) (bool, error) {
+	l, lok := vm.stack[vm.sp-2].(*object.Integer)
+	r, rok := vm.stack[vm.sp-1].(*object.Integer)
+	if lok && rok {
+		vm.sp -= 2
+		switch op {
+		case code.OpJumpUnlessEqual:
+			return l.Value == r.Value, nil
+		case code.OpJumpUnlessNotEqual:
+			return l.Value != r.Value, nil
+		default:
+			return l.Value > r.Value, nil
+		}
+	}
+	comparison := code.OpGreaterThan
+	switch op {
+	case code.OpJumpUnlessEqual:
+		comparison = code.OpEqual
+	case code.OpJumpUnlessNotEqual:
+		comparison = code.OpNotEqual
+	}
+	err := vm.executeComparison(comparison)
+	if err != nil {
+		return false, err
+	}
+	return obj.IsTruthy(vm.pop()), nil
+}
+
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	if input {
 		return True
@@ -361,7 +574,7 @@ func (vm *VM) executeMinusOperation() error {
 		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
 	}
 	v := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -v})
+	return vm.push(obj.NativeInt(-v))
 }
 
 func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
@@ -372,19 +585,32 @@ func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
 	return &object.Array{Elements: elems}
 }
 
+// concatArrays joins the arrays on the stack into a new array.
+func (vm *VM) concatArrays(startIndex, endIndex int) (object.Object, error) {
+	var elems []object.Object
+	for i := startIndex; i < endIndex; i++ {
+		array, ok := vm.stack[i].(*object.Array)
+		if !ok {
+			return nil, fmt.Errorf("cannot spread non-array: (type=%s)", vm.stack[i].Type())
+		}
+		elems = append(elems, array.Elements...)
+	}
+	if elems == nil {
+		elems = []object.Object{}
+	}
+	return &object.Array{Elements: elems}, nil
+}
+
+// buildHash builds a hash from the keys and values on the stack, preserving the order in which they were pushed.
 func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
-	hashPairs := make(map[object.HashKey]object.HashPair)
+	hash := obj.NewOrderedHash((endIndex - startIndex) / 2)
 	for i := startIndex; i < endIndex; i += 2 {
-		key := vm.stack[i]
-		value := vm.stack[i+1]
-
-		hashKey, ok := key.(object.Hashable)
-		if !ok {
-			return nil, fmt.Errorf("invalid hash key: %s", key.Type())
+		err := hash.Set(vm.stack[i], vm.stack[i+1])
+		if err != nil {
+			return nil, err
 		}
-		hashPairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: value}
 	}
-	return &object.Hash{Pairs: hashPairs}, nil
+	return hash, nil
 }
 
 func (vm *VM) executeIndexExpression(left, index object.Object) error {
@@ -409,6 +635,16 @@ func (vm *VM) executeArrayIndex(left, index object.Object) error {
 }
 
 func (vm *VM) executeHashIndex(left, index object.Object) error {
+	if hash, ok := left.(*obj.OrderedHash); ok {
+		value, found, err := hash.Get(index)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return vm.push(Null)
+		}
+		return vm.push(value)
+	}
 	hash := left.(*object.Hash)
 	key, ok := index.(object.Hashable)
 	if !ok {
@@ -441,24 +677,158 @@ func (vm *VM) executeCall(numArgs int) error {
 		return vm.callFunction(callee, numArgs)
 	case *object.Builtin:
 		return vm.callBuiltin(callee, numArgs)
+	case *obj.Native:
+		return vm.callNative(callee, numArgs)
 	default:
 		return fmt.Errorf("calling non-function and non-builtin")
 	}
 }
 
+// executeSpreadCall calls the function below the array on top of the stack with the elements of the array.
+func (vm *VM) executeSpreadCall() error {
+	args := vm.stack[vm.sp-1].(*object.Array)
+	vm.sp--
+	for i, a := range args.Elements {
+		err := vm.push(a)
+		if err != nil {
+			vm.sp -= i
+			return err
+		}
+	}
+	return vm.executeCall(len(args.Elements))
+}
+
+// executeTailCall calls a closure in place of the current frame: the callee and its args are moved down to
+// where the current function was called, and the current frame is discarded before the callee's is pushed.
+// Anything else is called like OpCall, and execution goes on in the current frame.
+func (vm *VM) executeTailCall(numArgs int) error {
+	cl, ok := vm.stack[vm.sp-1-numArgs].(*obj.Closure)
+	if !ok {
+		return vm.executeCall(numArgs)
+	}
+	err := checkArgs(cl.Fn, numArgs)
+	if err != nil {
+		return err
+	}
+	if vm.profiler != nil {
+		vm.profiler.leave()
+	}
+	frame := vm.popFrame()
+	base := frame.bp - 1
+	copy(vm.stack[base:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.sp = base + 1 + numArgs
+	return vm.callFunction(cl, numArgs)
+}
+
+// checkArgs reports an error unless fn accepts numArgs args.
+func checkArgs(fn *obj.CompiledFunction, numArgs int) error {
+	required, max := fn.Arity()
+	if numArgs >= required && (max < 0 || numArgs <= max) {
+		return nil
+	}
+	switch {
+	case max < 0:
+		return fmt.Errorf("wrong number of args: (got=%d, want>=%d)", numArgs, required)
+	case required == max:
+		return fmt.Errorf("wrong number of args: (got=%d, want=%d)", numArgs, required)
+	default:
+		return fmt.Errorf("wrong number of args: (got=%d, want=%d to %d)", numArgs, required, max)
+	}
+}
+
 func (vm *VM) callFunction(cl *obj.Closure, numArgs int) error {
-	if numArgs != cl.Fn.NumParameters {
-		return fmt.Errorf("wrong number of args: (got=%d, want=%d)", numArgs, cl.Fn.NumParameters)
+	entry := 0
+	if cl.Fn.NumOptional == 0 && !cl.Fn.Variadic {
+		if numArgs != cl.Fn.NumParameters {
+			return checkArgs(cl.Fn, numArgs)
+		}
+	} else {
+		var err error
+		entry, err = vm.bindArgs(cl.Fn, numArgs)
+		if err != nil {
+			return err
+		}
+		numArgs = cl.Fn.NumParameters
 	}
+	return vm.enterFunction(cl, numArgs, entry)
+}
+
+// enterFunction pushes a frame for a closure whose args are already bound, and starts it at entry.
+func (vm *VM) enterFunction(cl *obj.Closure, numArgs int, entry int) error {
 	frame := NewFrame(cl, vm.sp-numArgs)
+	frame.ip = entry - 1
 	vm.pushFrame(frame)
+	if vm.profiler != nil {
+		vm.profiler.enterFunction(cl.Fn)
+	}
 	vm.sp = frame.bp + cl.Fn.NumLocals //allocating space on the stack
 	return nil
 }
 
+// bindArgs arranges the args on the stack into the parameters of a function with optional or rest parameters.
+// Extra args are gathered into an array for the rest parameter, and missing optional args are set to null
+// until the function sets their default values. It returns where the function starts executing.
+func (vm *VM) bindArgs(fn *obj.CompiledFunction, numArgs int) (int, error) {
+	err := checkArgs(fn, numArgs)
+	if err != nil {
+		return 0, err
+	}
+	required, _ := fn.Arity()
+	base := vm.sp - numArgs
+	if base+fn.NumParameters > StackSize {
+		return 0, fmt.Errorf("stack overflow")
+	}
+	fixed := required + fn.NumOptional
+	if fn.Variadic {
+		elems := []object.Object{}
+		if numArgs > fixed {
+			elems = make([]object.Object, numArgs-fixed)
+			copy(elems, vm.stack[base+fixed:vm.sp])
+		}
+		vm.stack[base+fixed] = &object.Array{Elements: elems}
+	}
+	for i := numArgs; i < fixed; i++ {
+		vm.stack[base+i] = Null
+	}
+	vm.sp = base + fn.NumParameters
+	if fn.NumOptional == 0 {
+		return 0, nil
+	}
+	return fn.Entries[min(numArgs, fixed)-required], nil
+}
+
 func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
 	args := vm.stack[vm.sp-numArgs : vm.sp]
+	if vm.profiler != nil {
+		vm.profiler.enter(vm.builtinName(builtin))
+		defer vm.profiler.leave()
+	}
 	result := builtin.Fn(args...)
+	if err := vm.checkBuiltinResult(builtin, result); err != nil {
+		return err
+	}
+	vm.sp = vm.sp - numArgs - 1 //removing the builtin and its arguments from the stack
+	if result == nil {
+		return vm.push(Null)
+	}
+	return vm.push(result)
+}
+
+func (vm *VM) callNative(native *obj.Native, numArgs int) error {
+	args := make([]object.Object, numArgs)
+	copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+	if vm.profiler != nil {
+		vm.profiler.enter(vm.builtinName(native))
+		defer vm.profiler.leave()
+	}
+	result, err := native.Fn(vm, args...)
+	if err != nil {
+		return err
+	}
+	if err := vm.checkBuiltinResult(native, result); err != nil {
+		return err
+	}
+	vm.sp = vm.sp - numArgs - 1 //removing the builtin and its arguments from the stack
 	if result == nil {
 		return vm.push(Null)
 	}
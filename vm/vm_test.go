@@ -1,14 +1,19 @@
 package vm_test
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/taimats/sarupiler/code"
 	"github.com/taimats/sarupiler/compiler"
 	"github.com/taimats/sarupiler/monkey/ast"
 	"github.com/taimats/sarupiler/monkey/lexer"
 	"github.com/taimats/sarupiler/monkey/object"
 	"github.com/taimats/sarupiler/monkey/parser"
+	obj "github.com/taimats/sarupiler/object"
 	"github.com/taimats/sarupiler/vm"
 )
 
@@ -46,6 +51,7 @@ func runVmTests(t *testing.T, tests []vmTestCase) {
 	for _, tt := range tests {
 		p := parse(tt.input)
 		comp := compiler.New()
+		comp.SetSourceMap(compiler.NewSourceMap(tt.input, p))
 		err := comp.Compile(p)
 		if err != nil {
 			t.Fatalf("compiler failed to compile: (error: %s)", err)
@@ -102,6 +108,70 @@ func TestBooleanExpressions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestStructuralEquality(t *testing.T) {
+	True := &object.Boolean{Value: true}
+	False := &object.Boolean{Value: false}
+	tests := []vmTestCase{
+		{`"mon" + "key" == "monkey"`, True},
+		{`"monkey" != "monkey"`, False},
+		{`"a" == "b"`, False},
+		{`"b" > "a"`, True},
+		{`"a" < "b"`, True},
+		{`"ab" > "b"`, False},
+		{`"a" > "a"`, False},
+		{`[1, 2] == [1, 2]`, True},
+		{`[1, 2] != [1, 2]`, False},
+		{`[1, 2] == [2, 1]`, False},
+		{`[1, [2, "x"]] == [1, [2, "x"]]`, True},
+		{`[1] == [1, 2]`, False},
+		{`push([1], 2) == [1, 2]`, True},
+		{`{"a": 1, "b": [2]} == {"b": [2], "a": 1}`, True},
+		{`merge({"b": 2}, {"a": 1}) == {"a": 1, "b": 2}`, True},
+		{`{"a": 1} == {"a": 2}`, False},
+		{`{"a": 1} == {"b": 1}`, False},
+		{`{"a": 1} == {"a": 1, "b": 2}`, False},
+		{`let f = fn() {}; [f] == [f]`, True},
+		{`[fn() {}] == [fn() {}]`, False},
+		{`if (false) { 1 } == if (false) { 2 }`, True},
+		{`1 == "1"`, False},
+		{`[1] != "[1]"`, True},
+		{`true == [true]`, False},
+	}
+	runVmTests(t, tests)
+}
+
+func TestEqualIsCycleSafe(t *testing.T) {
+	a := &object.Array{}
+	a.Elements = []object.Object{&object.Integer{Value: 1}, a}
+	b := &object.Array{}
+	b.Elements = []object.Object{&object.Integer{Value: 1}, b}
+	c := &object.Array{}
+	c.Elements = []object.Object{&object.Integer{Value: 2}, c}
+
+	assert.True(t, obj.Equal(a, b))
+	assert.False(t, obj.Equal(a, c))
+
+	h := obj.NewOrderedHash(1)
+	h.Set(&object.String{Value: "self"}, h)
+	g := obj.NewOrderedHash(1)
+	g.Set(&object.String{Value: "self"}, g)
+	assert.True(t, obj.Equal(h, g))
+}
+
+func TestEqualOfScalarsDoesNotAllocate(t *testing.T) {
+	x, y := &object.Integer{Value: 1}, &object.Integer{Value: 1}
+	s, u := &object.String{Value: "a"}, &object.String{Value: "b"}
+	empty, one := &object.Array{}, &object.Array{Elements: []object.Object{x}}
+	allocs := testing.AllocsPerRun(100, func() {
+		obj.Equal(x, y)
+		obj.Equal(s, u)
+		obj.Equal(vm.True, vm.False)
+		obj.Equal(vm.Null, vm.Null)
+		obj.Equal(empty, one)
+	})
+	assert.Zero(t, allocs)
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []vmTestCase{
 		{"if (true) { 10 }", &object.Integer{Value: 10}},
@@ -160,37 +230,52 @@ func TestArrayLiterals(t *testing.T) {
 func TestHashLiterals(t *testing.T) {
 	tests := []vmTestCase{
 		{
-			"{}", &object.Hash{Pairs: map[object.HashKey]object.HashPair{}},
+			"{}", newOrderedHash(),
 		},
 		{
 			"{1: 2, 2: 3}",
-			&object.Hash{Pairs: map[object.HashKey]object.HashPair{
-				newHashKey(object.INTEGER_OBJ, uint64(1)): newHashPair(&object.Integer{Value: 1}, &object.Integer{Value: 2}),
-				newHashKey(object.INTEGER_OBJ, uint64(2)): newHashPair(&object.Integer{Value: 2}, &object.Integer{Value: 3}),
-			}},
+			newOrderedHash(
+				&object.Integer{Value: 1}, &object.Integer{Value: 2},
+				&object.Integer{Value: 2}, &object.Integer{Value: 3},
+			),
 		},
 		{
 			"{1 + 1: 2 * 2, 3 + 3: 4 * 4}",
-			&object.Hash{Pairs: map[object.HashKey]object.HashPair{
-				newHashKey(object.INTEGER_OBJ, uint64(2)): newHashPair(&object.Integer{Value: 2}, &object.Integer{Value: 4}),
-				newHashKey(object.INTEGER_OBJ, uint64(6)): newHashPair(&object.Integer{Value: 6}, &object.Integer{Value: 16}),
-			}},
+			newOrderedHash(
+				&object.Integer{Value: 2}, &object.Integer{Value: 4},
+				&object.Integer{Value: 6}, &object.Integer{Value: 16},
+			),
 		},
 	}
 	runVmTests(t, tests)
 }
 
-func newHashPair(key, value object.Object) object.HashPair {
-	return object.HashPair{
-		Key:   key,
-		Value: value,
+// newOrderedHash builds a hash from alternating keys and values.
+func newOrderedHash(kvs ...object.Object) *obj.OrderedHash {
+	h := obj.NewOrderedHash(len(kvs) / 2)
+	for i := 0; i < len(kvs); i += 2 {
+		h.Set(kvs[i], kvs[i+1])
 	}
+	return h
 }
-func newHashKey(objType object.ObjectType, value uint64) object.HashKey {
-	return object.HashKey{
-		Type:  objType,
-		Value: value,
+
+func TestHashKeyOrder(t *testing.T) {
+	tests := []vmTestCase{
+		//Hash literals insert their pairs in the source order.
+		{`to_string({"b": 1, "a": 2, "c": 3})`, &object.String{Value: "{b: 1, a: 2, c: 3}"}},
+		{`keys({10: 1, 9: 2})`, &object.Array{Elements: []object.Object{
+			&object.Integer{Value: 10},
+			&object.Integer{Value: 9},
+		}}},
+		{`to_string({"z": {"y": 1, "x": 2}, len("ab"): [1, 2], "a": 3})`, &object.String{Value: "{z: {y: 1, x: 2}, 2: [1, 2], a: 3}"}},
+		//Pairs set later keep the order they are set in.
+		{`to_string(merge({"z": 1}, {"y": 2}, {"z": 3}))`, &object.String{Value: "{z: 3, y: 2}"}},
+		{`keys(delete({2: 1, 1: 2, 3: 3}, 1))`, &object.Array{Elements: []object.Object{
+			&object.Integer{Value: 2},
+			&object.Integer{Value: 3},
+		}}},
 	}
+	runVmTests(t, tests)
 }
 
 func TestIndexExpressions(t *testing.T) {
@@ -606,3 +691,943 @@ func TestRecursiveClosures(t *testing.T) {
 	}
 	runVmTests(t, tests)
 }
+
+func TestRegisteredBuiltins(t *testing.T) {
+	r := obj.DefaultRegistry()
+	err := r.Register("double", func(args ...object.Object) object.Object {
+		return &object.Integer{Value: args[0].(*object.Integer).Value * 2}
+	})
+	if err != nil {
+		t.Fatalf("failed to register builtin: (error: %s)", err)
+	}
+	assert.EqualError(t, r.Register("len", nil), "builtin already registered: len")
+
+	comp := compiler.NewWithBuiltins(r)
+	err = comp.Compile(parse(`double(len([1, 2, 3]))`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	sut := vm.New(comp.Bytecode())
+	err = sut.Run()
+	if err != nil {
+		t.Fatalf("vm failed to run: (error: %s)", err)
+	}
+
+	assert.Equal(t, &object.Integer{Value: 6}, sut.LastPoppedStackElem())
+}
+
+func TestRegistryLimit(t *testing.T) {
+	r := obj.DefaultRegistry()
+	constant := func(v int64) object.BuiltinFunction {
+		return func(args ...object.Object) object.Object { return &object.Integer{Value: v} }
+	}
+	//Names of the form "xab" are valid identifiers, which cannot contain digits.
+	name := func(i int) string {
+		return "x" + string(rune('a'+i/26)) + string(rune('a'+i%26))
+	}
+	for i := len(r.Definitions()); i < obj.MaxBuiltins; i++ {
+		err := r.Register(name(i), constant(int64(i)))
+		if err != nil {
+			t.Fatalf("failed to register builtin %d: (error: %s)", i, err)
+		}
+	}
+	assert.EqualError(t, r.Register("extra", constant(0)), "too many builtins: a registry holds at most 256: extra")
+	assert.EqualError(t, r.RegisterFunc("extra", func() int { return 0 }), "too many builtins: a registry holds at most 256: extra")
+
+	comp := compiler.NewWithBuiltins(r)
+	err := comp.Compile(parse(name(obj.MaxBuiltins-1) + "()"))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	sut := vm.New(comp.Bytecode())
+	err = sut.Run()
+	if err != nil {
+		t.Fatalf("vm failed to run: (error: %s)", err)
+	}
+	assert.Equal(t, &object.Integer{Value: obj.MaxBuiltins - 1}, sut.LastPoppedStackElem())
+}
+
+func TestCallAfterRun(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let add = fn(a, b) { a + b }; add;`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	sut := vm.New(comp.Bytecode())
+	err = sut.Run()
+	if err != nil {
+		t.Fatalf("vm failed to run: (error: %s)", err)
+	}
+	add := sut.LastPoppedStackElem()
+	a := assert.New(t)
+
+	got, err := sut.Call(add, &object.Integer{Value: 1}, &object.Integer{Value: 2})
+	a.NoError(err)
+	a.Equal(&object.Integer{Value: 3}, got)
+
+	_, err = sut.Call(add, &object.Integer{Value: 1})
+	a.EqualError(err, "wrong number of args: (got=1, want=2)")
+
+	length, _, _ := obj.DefaultRegistry().Lookup("len")
+	got, err = sut.Call(length, &object.String{Value: "four"})
+	a.NoError(err)
+	a.Equal(&object.Integer{Value: 4}, got)
+}
+
+func TestRegisteredGoFunctions(t *testing.T) {
+	r := obj.DefaultRegistry()
+	err := r.RegisterFunc("repeat", strings.Repeat)
+	if err != nil {
+		t.Fatalf("failed to register builtin: (error: %s)", err)
+	}
+	err = r.RegisterFunc("sum", func(nums ...int) int {
+		total := 0
+		for _, n := range nums {
+			total += n
+		}
+		return total
+	})
+	if err != nil {
+		t.Fatalf("failed to register builtin: (error: %s)", err)
+	}
+	err = r.RegisterFunc("atoi", strconv.Atoi)
+	if err != nil {
+		t.Fatalf("failed to register builtin: (error: %s)", err)
+	}
+	assert.EqualError(t, r.RegisterFunc("bad", 1), "builtin bad must be a function: (got=int)")
+
+	tests := []vmTestCase{
+		{`repeat("ab", 3)`, &object.String{Value: "ababab"}},
+		{`sum()`, &object.Integer{Value: 0}},
+		{`sum(1, 2, 3)`, &object.Integer{Value: 6}},
+		{`atoi("42")`, &object.Integer{Value: 42}},
+		{`atoi("x")`, &object.Error{Message: `strconv.Atoi: parsing "x": invalid syntax`}},
+		{`repeat("ab")`, &object.Error{Message: "wrong number of args: (got=1 want=2)"}},
+		{`repeat(1, 2)`, &object.Error{Message: "invalid arg 0 for repeat(): cannot convert INTEGER to string"}},
+	}
+	for _, tt := range tests {
+		comp := compiler.NewWithBuiltins(r)
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler failed to compile: (error: %s)", err)
+		}
+		sut := vm.New(comp.Bytecode())
+		err = sut.Run()
+		if err != nil {
+			t.Fatalf("vm failed to run: (error: %s)", err)
+		}
+		assert.Equal(t, tt.want, sut.LastPoppedStackElem(), tt.input)
+	}
+}
+
+func TestImports(t *testing.T) {
+	loader := compiler.MapLoader{
+		"math": `
+		let _square = fn(x) { x * x };
+		let fact = fn(n) { if (n == 0) { 1 } else { n * fact(n - 1) } };
+		let sumOfSquares = fn(a, b) { _square(a) + _square(b) };
+		let pi = 3;
+		`,
+		"util/strings": `
+		let math = import("../math");
+		let greet = fn(name) { "hello " + name };
+		let size = fn(s) { len(s) * math["pi"] };
+		`,
+		"counter": `let count = 1;`,
+	}
+	tests := []vmTestCase{
+		{`let math = import("math"); math["fact"](5)`, &object.Integer{Value: 120}},
+		{`let math = import("math"); math["sumOfSquares"](1, 2)`, &object.Integer{Value: 5}},
+		{`import("math")["_square"]`, vm.Null},
+		{`let s = import("util/strings"); s["greet"]("monkey")`, &object.String{Value: "hello monkey"}},
+		{`let s = import("util/strings"); s["size"]("ab") + import("math")["pi"]`, &object.Integer{Value: 9}},
+		{`let f = fn() { import("counter")["count"] }; f() + f() + import("counter")["count"]`, &object.Integer{Value: 3}},
+		{`let a = import("math"); let b = import("math"); a == b`, vm.True},
+	}
+	for _, tt := range tests {
+		comp := compiler.New()
+		comp.SetLoader(loader)
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler failed to compile: (error: %s)", err)
+		}
+		sut := vm.New(comp.Bytecode())
+		err = sut.Run()
+		if err != nil {
+			t.Fatalf("vm failed to run: (error: %s)", err)
+		}
+		assert.Equal(t, tt.want, sut.LastPoppedStackElem(), tt.input)
+	}
+}
+
+func TestStringBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`split("a,b,c", ",")`, &object.Array{Elements: []object.Object{
+			&object.String{Value: "a"},
+			&object.String{Value: "b"},
+			&object.String{Value: "c"},
+		}}},
+		{`split(1, ",")`, &object.Error{Message: "an arg must be STRING_OBJ: (got=INTEGER)"}},
+		{`join(["a", "b", "c"], "-")`, &object.String{Value: "a-b-c"}},
+		{`join([], "-")`, &object.String{Value: ""}},
+		{`join(["a", 1], "-")`, &object.Error{Message: "an element must be STRING_OBJ: (got=INTEGER)"}},
+		{`join("a", "-")`, &object.Error{Message: "an arg must be ARRAY_OBJ: (got=STRING)"}},
+		{`trim("  monkey  ")`, &object.String{Value: "monkey"}},
+		{`trim("a", "b")`, &object.Error{Message: "wrong number of args: (got=2 want=1)"}},
+		{`contains("monkey", "key")`, vm.True},
+		{`contains("monkey", "dog")`, vm.False},
+		{`index_of("monkey", "key")`, &object.Integer{Value: 3}},
+		{`index_of("monkey", "dog")`, &object.Integer{Value: -1}},
+		{`replace("a-b-c", "-", "+")`, &object.String{Value: "a+b+c"}},
+		{`upper("monkey")`, &object.String{Value: "MONKEY"}},
+		{`lower("MoNkEy")`, &object.String{Value: "monkey"}},
+		{`substring("monkey", 1, 3)`, &object.String{Value: "on"}},
+		{`substring("monkey", 0, 6)`, &object.String{Value: "monkey"}},
+		{`substring("monkey", 4, 7)`, &object.Error{Message: "substring out of range: (start=4 end=7 len=6)"}},
+		{`substring("monkey", "1", 2)`, &object.Error{Message: "an arg must be INTEGER_OBJ: (got=STRING)"}},
+		{`starts_with("monkey", "mon")`, vm.True},
+		{`ends_with("monkey", "mon")`, vm.False},
+		{`format("%s has %d bananas (%t) %v %%", "saru", 3, true, [1])`, &object.String{Value: "saru has 3 bananas (true) [1] %"}},
+		{`format("%d", "3")`, &object.Error{Message: "format: %d expects INTEGER: (got=STRING)"}},
+		{`format("%d %d", 1)`, &object.Error{Message: "format: missing arg for %d"}},
+		{`format("%d", 1, 2)`, &object.Error{Message: "format: too many args: (got=2 want=1)"}},
+		{`format("%x", 1)`, &object.Error{Message: "format: unknown verb %x"}},
+		{`format("100%")`, &object.Error{Message: `format: missing verb at the end of "100%"`}},
+		{`to_int("42")`, &object.Integer{Value: 42}},
+		{`to_int("-7")`, &object.Integer{Value: -7}},
+		{`to_int("4x")`, &object.Error{Message: `could not parse "4x" as integer`}},
+		{`to_string(42)`, &object.String{Value: "42"}},
+		{`to_string("42")`, &object.String{Value: "42"}},
+		{`to_int(to_string(12)) + 1`, &object.Integer{Value: 13}},
+	}
+	runVmTests(t, tests)
+}
+
+func TestHigherOrderBuiltins(t *testing.T) {
+	ints := func(values ...int64) *object.Array {
+		elems := make([]object.Object, len(values))
+		for i, v := range values {
+			elems[i] = &object.Integer{Value: v}
+		}
+		return &object.Array{Elements: elems}
+	}
+	tests := []vmTestCase{
+		{`map([1, 2, 3], fn(x) { x * 2 })`, ints(2, 4, 6)},
+		{`map([], fn(x) { x * 2 })`, ints()},
+		{`map(["a", "bb"], len)`, ints(1, 2)},
+		{`let n = 10; map([1, 2], fn(x) { x + n })`, ints(11, 12)},
+		{`map([1], 1)`, &object.Error{Message: "an arg must be a function: (got=INTEGER)"}},
+		{`map(1, len)`, &object.Error{Message: "an arg must be ARRAY_OBJ: (got=INTEGER)"}},
+		{`filter([1, 2, 3, 4], fn(x) { x > 2 })`, ints(3, 4)},
+		{`reduce([1, 2, 3, 4], 0, fn(acc, x) { acc + x })`, &object.Integer{Value: 10}},
+		{`reduce([], 5, fn(acc, x) { acc + x })`, &object.Integer{Value: 5}},
+		{`reduce([1], fn(acc, x) { acc })`, &object.Error{Message: "wrong number of args: (got=2 want=3)"}},
+		{`any([1, 2, 3], fn(x) { x == 2 })`, vm.True},
+		{`any([], fn(x) { true })`, vm.False},
+		{`all([1, 2, 3], fn(x) { x > 0 })`, vm.True},
+		{`all([1, 2, 3], fn(x) { x > 1 })`, vm.False},
+		{`sort([3, 1, 2])`, ints(1, 2, 3)},
+		{`sort(["b", "c", "a"])`, &object.Array{Elements: []object.Object{
+			&object.String{Value: "a"},
+			&object.String{Value: "b"},
+			&object.String{Value: "c"},
+		}}},
+		{`sort([1, "a"])`, &object.Error{Message: "cannot compare STRING and INTEGER"}},
+		{`sort([3, 1, 2], fn(a, b) { a > b })`, ints(3, 2, 1)},
+		{`sort_by([[2, 1], [1, 2], [2, 3], [1, 4]], fn(p) { p[0] })[1][1]`, &object.Integer{Value: 4}},
+		{`map(map([1, 2], fn(x) { [x] }), first)`, ints(1, 2)},
+		{`let xs = map([1, 2, 3], fn(x) { reduce([x, x], 0, fn(a, b) { a + b }) }); xs`, ints(2, 4, 6)},
+	}
+	runVmTests(t, tests)
+}
+
+func TestHigherOrderBuiltinsWithManyElements(t *testing.T) {
+	//Recursing over this many elements in monkey would exceed MaxFrames.
+	input := fmt.Sprintf(`
+	let xs = split("%s", ",");
+	let lengths = map(xs, fn(x) { len(x) });
+	reduce(filter(lengths, fn(n) { n > 0 }), 0, fn(acc, n) { acc + n });
+	`, strings.Repeat("ab,", vm.MaxFrames*3))
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	sut := vm.New(comp.Bytecode())
+	err = sut.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, &object.Integer{Value: int64(vm.MaxFrames * 6)}, sut.LastPoppedStackElem())
+}
+
+func TestHigherOrderBuiltinsPropagateRuntimeErrors(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`map([1, 2], fn(a, b) { a })`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	sut := vm.New(comp.Bytecode())
+	err = sut.Run()
+	assert.EqualError(t, err, "wrong number of args: (got=1, want=2)")
+}
+
+func TestHashBuiltins(t *testing.T) {
+	strs := func(values ...string) *object.Array {
+		elems := make([]object.Object, len(values))
+		for i, v := range values {
+			elems[i] = &object.String{Value: v}
+		}
+		return &object.Array{Elements: elems}
+	}
+	tests := []vmTestCase{
+		{`keys({"b": 1, "a": 2, "c": 3})`, strs("b", "a", "c")},
+		{`keys({})`, &object.Array{Elements: []object.Object{}}},
+		{`values({"b": 1, "a": 2})`, &object.Array{Elements: []object.Object{
+			&object.Integer{Value: 1},
+			&object.Integer{Value: 2},
+		}}},
+		{`keys(1)`, &object.Error{Message: "an arg must be HASH_OBJ: (got=INTEGER)"}},
+		{`has_key({"a": 1}, "a")`, vm.True},
+		{`has_key({"a": 1}, "b")`, vm.False},
+		{`has_key({"a": 1}, [])`, &object.Error{Message: "invalid hash key: ARRAY"}},
+		{`keys(delete({"a": 1, "b": 2, "c": 3}, "b"))`, strs("a", "c")},
+		{`let h = {"a": 1}; delete(h, "a"); h["a"]`, &object.Integer{Value: 1}},
+		{`delete({"a": 1}, "z")["a"]`, &object.Integer{Value: 1}},
+		{`keys(merge({"b": 1}, {"a": 2}, {"b": 3, "c": 4}))`, strs("b", "a", "c")},
+		{`merge({"b": 1}, {"a": 2}, {"b": 3, "c": 4})["b"]`, &object.Integer{Value: 3}},
+		{`keys(merge(merge({"z": 1}, {"y": 2}), {"x": 3}))`, strs("z", "y", "x")},
+		{`merge({}, 1)`, &object.Error{Message: "an arg must be HASH_OBJ: (got=INTEGER)"}},
+		{`entries(merge({"b": 1}, {"a": 2}))`, &object.Array{Elements: []object.Object{
+			&object.Array{Elements: []object.Object{&object.String{Value: "b"}, &object.Integer{Value: 1}}},
+			&object.Array{Elements: []object.Object{&object.String{Value: "a"}, &object.Integer{Value: 2}}},
+		}}},
+		{`to_string(merge({"b": 1}, {"a": [2]}))`, &object.String{Value: "{b: 1, a: [2]}"}},
+		{`merge({1: "one"})[1]`, &object.String{Value: "one"}},
+		{`merge({1: "one"})[2]`, vm.Null},
+	}
+	runVmTests(t, tests)
+}
+
+func TestExceptions(t *testing.T) {
+	tests := []vmTestCase{
+		{`try(fn() { throw("boom") }, fn(e) { e })`, &object.String{Value: "boom"}},
+		{`try(fn() { 1 }, fn(e) { 2 })`, &object.Integer{Value: 1}},
+		{`try(fn() { 1 + "a" }, fn(e) { e })`, &object.Error{Message: "invalid operand type"}},
+		{`1 + try(fn() { 2 + throw(3) }, fn(e) { e })`, &object.Integer{Value: 4}},
+		{
+			`
+			let check = fn(x) { if (x > 2) { throw(x) }; x };
+			let sum = fn() { check(1) + check(5) };
+			try(sum, fn(e) { e * 10 })
+			`,
+			&object.Integer{Value: 50},
+		},
+		{
+			`try(fn() { try(fn() { throw(1) }, fn(e) { throw(e + 1) }) }, fn(e) { e + 1 })`,
+			&object.Integer{Value: 3},
+		},
+		{
+			`let f = fn(a) { let b = a * 2; try(fn() { throw(b) }, fn(e) { e + a }) }; f(3)`,
+			&object.Integer{Value: 9},
+		},
+		{`try(1, fn(e) { e })`, &object.Error{Message: "calling non-function and non-builtin"}},
+		{`try(fn(a) { a }, fn(e) { e })`, &object.Error{Message: "wrong number of args: (got=0, want=1)"}},
+		{`let try = fn(a, b) { a + b }; try(1, 2)`, &object.Integer{Value: 3}},
+	}
+	runVmTests(t, tests)
+}
+
+func TestExceptionsWithFinally(t *testing.T) {
+	tests := []vmTestCase{
+		{`try(fn() { 1 }, fn(e) { 2 }, fn() { 3 })`, &object.Integer{Value: 1}},
+		{`try(fn() { throw(0) }, fn(e) { 2 }, fn() { 3 })`, &object.Integer{Value: 2}},
+		{
+			`try(fn() { try(fn() { 1 }, fn(e) { 2 }, fn() { throw("finally") }) }, fn(e) { e })`,
+			&object.String{Value: "finally"},
+		},
+		{
+			`try(fn() { try(fn() { throw(1) }, fn(e) { throw(e + 1) }, fn() { 99 }) }, fn(e) { e })`,
+			&object.Integer{Value: 2},
+		},
+		{
+			`let f = fn() { try(fn() { throw(1) }, fn(e) { throw(e) }, fn() { throw(5) }) }; try(f, fn(e) { e })`,
+			&object.Integer{Value: 5},
+		},
+	}
+	runVmTests(t, tests)
+}
+
+func TestExceptionsThroughBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			`try(fn() { map([1, 2], fn(x) { if (x == 2) { throw("two") }; x }) }, fn(e) { e })`,
+			&object.String{Value: "two"},
+		},
+		{
+			`map([1, 2], fn(x) { try(fn() { throw(x) }, fn(e) { e * 2 }) })`,
+			&object.Array{Elements: []object.Object{&object.Integer{Value: 2}, &object.Integer{Value: 4}}},
+		},
+		{
+			`try(fn() { reduce([1, 2], 0, fn(a) { a }) }, fn(e) { e })`,
+			&object.Error{Message: "wrong number of args: (got=2, want=1)"},
+		},
+		{
+			fmt.Sprintf(`len(map(split("%s", ","), fn(x) { try(fn() { throw(x) }, fn(e) { e }) }))`, strings.Repeat("a,", vm.StackSize)),
+			&object.Integer{Value: vm.StackSize + 1},
+		},
+	}
+	runVmTests(t, tests)
+}
+
+func TestUncaughtExceptions(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`throw("boom")`, "uncaught exception: boom"},
+		{`let f = fn() { throw([1, 2]) }; f()`, "uncaught exception: [1, 2]"},
+		{`try(fn() { 1 + "a" }, fn(e) { throw(e) })`, "invalid operand type"},
+		{`try(fn() { throw(1) }, fn(e) { e }, fn() { throw(2) })`, "uncaught exception: 2"},
+	}
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler failed to compile: (error: %s)", err)
+		}
+		sut := vm.New(comp.Bytecode())
+		err = sut.Run()
+		assert.EqualError(t, err, tt.want)
+	}
+
+	comp := compiler.New()
+	err := comp.Compile(parse(`throw({"code": 1})`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	err = vm.New(comp.Bytecode()).Run()
+	var exc *vm.Exception
+	if assert.ErrorAs(t, err, &exc) {
+		assert.Equal(t, newOrderedHash(&object.String{Value: "code"}, &object.Integer{Value: 1}), exc.Value)
+	}
+}
+
+func TestBuiltinErrorModes(t *testing.T) {
+	tests := []vmTestCase{
+		{`is_error(len(1))`, vm.True},
+		{`is_error(len("a"))`, vm.False},
+		{`let r = first(1); if (is_error(r)) { "failed" } else { r }`, &object.String{Value: "failed"}},
+		{`is_error(try(fn() { 1 + "a" }, fn(e) { e }))`, vm.True},
+	}
+	runVmTests(t, tests)
+
+	run := func(input string) (object.Object, error) {
+		comp := compiler.New()
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler failed to compile: (error: %s)", err)
+		}
+		sut := vm.New(comp.Bytecode())
+		sut.SetBuiltinErrorMode(vm.BuiltinErrorRaise)
+		err = sut.Run()
+		return sut.LastPoppedStackElem(), err
+	}
+
+	_, err := run(`1; len(1)`)
+	assert.EqualError(t, err, "len: unsupported type for len(): (type=INTEGER) (at <main>:0009)")
+	var builtinErr *vm.BuiltinError
+	if assert.ErrorAs(t, err, &builtinErr) {
+		assert.Equal(t, vm.BuiltinError{
+			Builtin:  "len",
+			Message:  "unsupported type for len(): (type=INTEGER)",
+			Function: "<main>",
+			Position: 9,
+		}, *builtinErr)
+	}
+
+	_, err = run(`let f = fn(x) { first(x) }; f(1)`)
+	assert.EqualError(t, err, "first: an arg must be ARRAY_OBJ: (got=INTEGER) (at fn#0:0004)")
+
+	_, err = run(`map([1], fn(x) { x }, 1)`)
+	assert.EqualError(t, err, "map: wrong number of args: (got=3 want=2) (at <main>:0015)")
+
+	got, err := run(`try(fn() { len(1) }, fn(e) { e })`)
+	assert.NoError(t, err)
+	assert.Equal(t, &object.Error{Message: "len: unsupported type for len(): (type=INTEGER) (at fn#1:0005)"}, got)
+
+	got, err = run(`len([1, 2])`)
+	assert.NoError(t, err)
+	assert.Equal(t, &object.Integer{Value: 2}, got)
+}
+
+func TestOptionalAndRestParameters(t *testing.T) {
+	ints := func(values ...int64) *object.Array {
+		elems := make([]object.Object, len(values))
+		for i, v := range values {
+			elems[i] = &object.Integer{Value: v}
+		}
+		return &object.Array{Elements: elems}
+	}
+	tests := []vmTestCase{
+		{`let f = params(fn(a, b) { a + b }, {"b": 2}); f(1)`, &object.Integer{Value: 3}},
+		{`let f = params(fn(a, b) { a + b }, {"b": 2}); f(1, 5)`, &object.Integer{Value: 6}},
+		{`let f = params(fn(a, b, c) { [a, b, c] }, {"b": a * 10, "c": b + 1}); f(1)`, ints(1, 10, 11)},
+		{`let f = params(fn(a, b, c) { [a, b, c] }, {"b": a * 10, "c": b + 1}); f(1, 2)`, ints(1, 2, 3)},
+		{`let f = params(fn(a, b, c) { [a, b, c] }, {"b": a * 10, "c": b + 1}); f(1, 2, 7)`, ints(1, 2, 7)},
+		{`let f = params(fn(a, rest) { rest }, {}, "rest"); f(1)`, ints()},
+		{`let f = params(fn(a, rest) { rest }, {}, "rest"); f(1, 2, 3)`, ints(2, 3)},
+		{`let f = params(fn(a, b, rest) { [a, b, rest] }, {"b": 2}, "rest"); f(1)`, &object.Array{Elements: []object.Object{
+			&object.Integer{Value: 1}, &object.Integer{Value: 2}, ints(),
+		}}},
+		{`let f = params(fn(a, b, rest) { [a, b, rest] }, {"b": 2}, "rest"); f(1, 3, 4, 5)`, &object.Array{Elements: []object.Object{
+			&object.Integer{Value: 1}, &object.Integer{Value: 3}, ints(4, 5),
+		}}},
+		{`let sum = params(fn(xs) { reduce(xs, 0, fn(acc, x) { acc + x }) }, {}, "xs"); sum(1, 2, 3, 4)`, &object.Integer{Value: 10}},
+		{`let n = 0; let counter = params(fn(step) { let x = step * 2; x }, {"step": n + 1}); counter() + counter(2)`, &object.Integer{Value: 6}},
+		{`let base = 100; let f = fn() { params(fn(a) { a }, {"a": base}) }; f()()`, &object.Integer{Value: 100}},
+		{`map([1, 2], params(fn(x, y) { x + y }, {"y": 10}))`, ints(11, 12)},
+		{`let params = fn(a, b) { a + b }; params(1, 2)`, &object.Integer{Value: 3}},
+	}
+	runVmTests(t, tests)
+}
+
+func TestOptionalAndRestParametersWithWrongArgs(t *testing.T) {
+	tests := []vmTestCase{
+		{`params(fn(a, b) { a }, {"b": 1})()`, "wrong number of args: (got=0, want=1 to 2)"},
+		{`params(fn(a, b) { a }, {"b": 1})(1, 2, 3)`, "wrong number of args: (got=3, want=1 to 2)"},
+		{`params(fn(a, b, rest) { a }, {}, "rest")(1)`, "wrong number of args: (got=1, want>=2)"},
+	}
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler failed to compile: (error: %s)", err)
+		}
+		err = vm.New(comp.Bytecode()).Run()
+		assert.EqualError(t, err, tt.want.(string))
+	}
+}
+
+func TestSpread(t *testing.T) {
+	ints := func(values ...int64) *object.Array {
+		elems := make([]object.Object, len(values))
+		for i, v := range values {
+			elems[i] = &object.Integer{Value: v}
+		}
+		return &object.Array{Elements: elems}
+	}
+	tests := []vmTestCase{
+		{`let a = [1, 2]; let b = [3]; [spread(a), spread(b)]`, ints(1, 2, 3)},
+		{`let a = [2, 3]; [1, spread(a), 4, 5]`, ints(1, 2, 3, 4, 5)},
+		{`[spread([]), spread([])]`, ints()},
+		{`let a = [1]; let b = [spread(a)]; push(b, 2); a`, ints(1)},
+		{`let add = fn(a, b, c) { a + b + c }; let args = [2, 3]; add(1, spread(args))`, &object.Integer{Value: 6}},
+		{`let add = fn(a, b) { a + b }; add(spread([1, 2]))`, &object.Integer{Value: 3}},
+		{`len(spread(["monkey"]))`, &object.Integer{Value: 6}},
+		{`let f = params(fn(xs) { xs }, {}, "xs"); f(spread([1, 2]), 3)`, ints(1, 2, 3)},
+		{`let call = fn(f, args) { f(spread(args)) }; call(fn(a, b) { a * b }, [6, 7])`, &object.Integer{Value: 42}},
+		{`map([[1, 2], [3, 4]], fn(p) { fn(a, b) { a - b }(spread(p)) })`, ints(-1, -1)},
+		{`let spread = fn(x) { x * 2 }; [spread(1)]`, ints(2)},
+		{
+			fmt.Sprintf(`let count = params(fn(xs) { len(xs) }, {}, "xs"); count(spread(split("%s", ",")))`, strings.Repeat("a,", 300)),
+			&object.Integer{Value: 301},
+		},
+	}
+	runVmTests(t, tests)
+
+	errTests := []vmTestCase{
+		{`[spread(1)]`, "cannot spread non-array: (type=INTEGER)"},
+		{`fn(a) { a }(spread([1, 2]))`, "wrong number of args: (got=2, want=1)"},
+	}
+	for _, tt := range errTests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler failed to compile: (error: %s)", err)
+		}
+		err = vm.New(comp.Bytecode()).Run()
+		assert.EqualError(t, err, tt.want.(string))
+	}
+}
+
+func TestSuperinstructions(t *testing.T) {
+	tests := []vmTestCase{
+		{`let f = fn(a) { a + 1 }; f(2)`, &object.Integer{Value: 3}},
+		{`let f = fn(a) { a - 1 }; f(2)`, &object.Integer{Value: 1}},
+		{`let f = fn(a) { a + "!" }; f("monkey")`, &object.String{Value: "monkey!"}},
+		{`let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(10)`, &object.Integer{Value: 55}},
+		{`let f = fn(a) { if (a == "x") { 1 } else { 2 } }; f("x") + f("y") * 10`, &object.Integer{Value: 21}},
+		{`let f = fn(a) { if (a != [1]) { 1 } else { 2 } }; f([1])`, &object.Integer{Value: 2}},
+		{`let f = fn(a) { if (a > "b") { 1 } else { 2 } }; f("c")`, &object.Integer{Value: 1}},
+		{`let f = fn(a) { (if (a) { a } else { 0 }) - 1 }; f(5)`, &object.Integer{Value: 4}},
+		{`if (if (true) { false } else { 1 > 2 }) { 3 } else { 4 }`, &object.Integer{Value: 4}},
+	}
+	runVmTests(t, tests)
+
+	errTests := []vmTestCase{
+		{`let f = fn(a) { a - 1 }; f("x")`, "invalid operand type"},
+		{`let f = fn(a) { if (a > true) { 1 } }; f(false)`, fmt.Sprintf("unknown operator: %d", code.OpGreaterThan)},
+	}
+	for _, tt := range errTests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler failed to compile: (error: %s)", err)
+		}
+		err = vm.New(comp.Bytecode()).Run()
+		assert.EqualError(t, err, tt.want.(string))
+	}
+}
+
+func TestSmallIntegersAreShared(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`[1 + 2, 5 - 2, 3, len("abc"), 2000 + 2000, 4000]`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	machine := vm.New(comp.Bytecode())
+	err = machine.Run()
+	if err != nil {
+		t.Fatalf("vm failed to run: (error: %s)", err)
+	}
+	elems := machine.LastPoppedStackElem().(*object.Array).Elements
+	for _, e := range elems[1:4] {
+		assert.Same(t, elems[0], e)
+	}
+	assert.Equal(t, elems[4], elems[5])
+	assert.NotSame(t, elems[4], elems[5])
+}
+
+func BenchmarkArithmetic(b *testing.B) {
+	//Each program computes with integers offset by k. With k = 0 they stay within the preallocated small
+	//integers, while with a large k every result is allocated, which is the baseline without the cache.
+	benchmarks := []struct {
+		name  string
+		input string
+	}{
+		{"counter", `let count = fn(n, acc) { if (n == 0) { acc } else { count(n - 1, acc + 1) } }; let run = fn() { count(500, %[1]d) };`},
+		{"sum", `let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n * 2 - n) } };
+			let repeat = fn(i) { if (i == 0) { 0 } else { sum(40, %[1]d); repeat(i - 1) } }; let run = fn() { repeat(12) };`},
+		{"fibonacci", `let fib = fn(n) { if (n < 2) { n + %[1]d } else { fib(n - 1) + fib(n - 2) - %[1]d } }; let run = fn() { fib(15) };`},
+		{"map", `let run = fn() { map(map(split("1,2,3,4,5,6,7,8,9,10", ","), fn(s) { len(s) + %[1]d }), fn(x) { x * 3 - 1 }) };`},
+	}
+	offsets := []struct {
+		name string
+		k    int
+	}{
+		{"cached", 0},
+		{"uncached", 1 << 20},
+	}
+	for _, bench := range benchmarks {
+		for _, offset := range offsets {
+			b.Run(bench.name+"/"+offset.name, func(b *testing.B) {
+				comp := compiler.New()
+				err := comp.Compile(parse(fmt.Sprintf(bench.input, offset.k)))
+				if err != nil {
+					b.Fatalf("compiler failed to compile: (error: %s)", err)
+				}
+				run, _ := comp.SymbolTable().Resolve("run")
+				globals := make([]object.Object, vm.GlobalSize)
+				sut := vm.NewWithGlobalStore(comp.Bytecode(), globals)
+				err = sut.Run()
+				if err != nil {
+					b.Fatalf("vm failed to run: (error: %s)", err)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for range b.N {
+					_, err := sut.Call(globals[run.Index])
+					if err != nil {
+						b.Fatalf("vm failed to call: (error: %s)", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestInlineCaches(t *testing.T) {
+	tests := []vmTestCase{
+		{`let h = {"a": 1, "b": 2}; let get = fn(x) { x["b"] }; [get(h), get(h)]`, &object.Array{Elements: []object.Object{
+			&object.Integer{Value: 2}, &object.Integer{Value: 2},
+		}}},
+		{`let get = fn(x) { x["b"] }; [get({"b": 1}), get({"a": 0, "b": 2}), get({"a": 3})]`, &object.Array{Elements: []object.Object{
+			&object.Integer{Value: 1}, &object.Integer{Value: 2}, vm.Null,
+		}}},
+		{`let h = {"a": 1, "b": 2}; let get = fn(x) { x["b"] }; get(h); get(delete(h, "a"))`, &object.Integer{Value: 2}},
+		{`let f = len; let g = fn(x) { f(x) + 0 }; g("ab") + g([1, 2, 3])`, &object.Integer{Value: 5}},
+	}
+	runVmTests(t, tests)
+
+	comp := compiler.New()
+	err := comp.Compile(parse(`
+	let f = fn(x) { x + 1 };
+	let g = fn(x) { x * 10 };
+	let h = fn(x, y) { x };
+	let call = fn() { f(1) + 0 };
+	let get = fn(x) { x["b"] };
+	`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	globals := make([]object.Object, vm.GlobalSize)
+	sut := vm.NewWithGlobalStore(comp.Bytecode(), globals)
+	err = sut.Run()
+	if err != nil {
+		t.Fatalf("vm failed to run: (error: %s)", err)
+	}
+	a := assert.New(t)
+	call := func(fn object.Object, args ...object.Object) any {
+		got, err := sut.Call(fn, args...)
+		if err != nil {
+			return err.Error()
+		}
+		return got
+	}
+
+	a.Equal(&object.Integer{Value: 2}, call(globals[3]))
+	a.Equal(&object.Integer{Value: 2}, call(globals[3]))
+	globals[0] = globals[1]
+	a.Equal(&object.Integer{Value: 10}, call(globals[3]))
+	globals[0] = globals[2]
+	a.Equal("wrong number of args: (got=1, want=2)", call(globals[3]))
+
+	hash := obj.NewOrderedHash(2)
+	hash.Set(&object.String{Value: "a"}, &object.Integer{Value: 1})
+	hash.Set(&object.String{Value: "b"}, &object.Integer{Value: 2})
+	a.Equal(&object.Integer{Value: 2}, call(globals[4], hash))
+	hash.Set(&object.String{Value: "b"}, &object.Integer{Value: 3})
+	a.Equal(&object.Integer{Value: 3}, call(globals[4], hash))
+	hash.Delete(&object.String{Value: "a"})
+	a.Equal(&object.Integer{Value: 3}, call(globals[4], hash))
+	hash.Delete(&object.String{Value: "b"})
+	a.Equal(vm.Null, call(globals[4], hash))
+	hash.Set(&object.String{Value: "c"}, &object.Integer{Value: 4})
+	hash.Set(&object.String{Value: "b"}, &object.Integer{Value: 5})
+	a.Equal(&object.Integer{Value: 5}, call(globals[4], hash))
+	a.Equal("invalid index operator: ARRAY", call(globals[4], &object.Array{}))
+}
+
+func TestInlineCachesReportCallSites(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let l = len; l(1)`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	sut := vm.New(comp.Bytecode())
+	sut.SetBuiltinErrorMode(vm.BuiltinErrorRaise)
+	err = sut.Run()
+	assert.EqualError(t, err, "len: unsupported type for len(): (type=INTEGER) (at <main>:0011)")
+}
+
+func BenchmarkInlineCaches(b *testing.B) {
+	benchmarks := []struct {
+		name  string
+		input string
+	}{
+		{"constant key", `let sum = fn(h, n, acc) { if (n == 0) { acc } else { sum(h, n - 1, acc + h["count"] + h["count"] + h["count"] + h["count"]) } };
+			let run = fn() { sum({"name": "monkey", "kind": "ape", "count": 1}, 500, 0) };`},
+		{"variable key", `let key = "count"; let sum = fn(h, n, acc) { if (n == 0) { acc } else { sum(h, n - 1, acc + h[key] + h[key] + h[key] + h[key]) } };
+			let run = fn() { sum({"name": "monkey", "kind": "ape", "count": 1}, 500, 0) };`},
+	}
+	for _, bench := range benchmarks {
+		b.Run(bench.name, func(b *testing.B) {
+			comp := compiler.New()
+			err := comp.Compile(parse(bench.input))
+			if err != nil {
+				b.Fatalf("compiler failed to compile: (error: %s)", err)
+			}
+			run, _ := comp.SymbolTable().Resolve("run")
+			globals := make([]object.Object, vm.GlobalSize)
+			sut := vm.NewWithGlobalStore(comp.Bytecode(), globals)
+			err = sut.Run()
+			if err != nil {
+				b.Fatalf("vm failed to run: (error: %s)", err)
+			}
+			b.ResetTimer()
+			for range b.N {
+				_, err := sut.Call(globals[run.Index])
+				if err != nil {
+					b.Fatalf("vm failed to call: (error: %s)", err)
+				}
+			}
+		})
+	}
+}
+
+func TestDeadCode(t *testing.T) {
+	tests := []vmTestCase{
+		{`let f = fn(x) { if (x) { return 1; } else { return 2; } 3 }; [f(true), f(false)]`, &object.Array{Elements: []object.Object{
+			&object.Integer{Value: 1}, &object.Integer{Value: 2},
+		}}},
+		{`let f = fn(x) { if (x > 0) { if (x > 1) { 1 } else { return 2; } } else { 3 } }; [f(1), f(2), f(0)]`, &object.Array{Elements: []object.Object{
+			&object.Integer{Value: 2}, &object.Integer{Value: 1}, &object.Integer{Value: 3},
+		}}},
+		{`let f = fn(x) { if (x) { throw(1) } 2 }; try(fn() { f(true) }, fn(e) { e + 10 }) + f(false)`, &object.Integer{Value: 13}},
+		{`let f = fn() { let a = 1; let b = fn() { 2 }; let c = 3; c }; f()`, &object.Integer{Value: 3}},
+	}
+	runVmTests(t, tests)
+}
+
+func TestInlining(t *testing.T) {
+	tests := []vmTestCase{
+		{`let add = fn(a, b) { a + b }; let g = fn(x) { add(x, 2) * add(1, x) }; g(3)`, &object.Integer{Value: 20}},
+		{`let k = 10; let add = fn(a) { a + k }; let g = fn(k) { add(k) }; g(1)`, &object.Integer{Value: 11}},
+		{`let sq = fn(a) { let b = a * a; b }; let g = fn(x) { let b = 1; sq(x) + sq(x + b) + b }; g(2)`, &object.Integer{Value: 14}},
+		{`let inc = fn(a) { a + 1 }; let twice = fn(a) { inc(inc(a)) }; let g = fn(x) { twice(x) }; g(1)`, &object.Integer{Value: 3}},
+		{`let f = fn(a) { return a * 2; }; let g = fn() { f(3) }; g()`, &object.Integer{Value: 6}},
+		{`let f = fn() { }; let g = fn() { f() }; g()`, vm.Null},
+		{`let abs = fn(a) { if (a < 0) { -a } else { a } }; let g = fn(x) { abs(x) }; [g(-3), g(4)]`, &object.Array{Elements: []object.Object{
+			&object.Integer{Value: 3}, &object.Integer{Value: 4},
+		}}},
+		{`let f = fn(a) { throw(a) }; let g = fn() { try(fn() { f(1) }, fn(e) { e + 1 }) }; g()`, &object.Integer{Value: 2}},
+		{`let f = fn(a) { a }; let g = fn() { try(fn() { f(1, 2) }, fn(e) { 7 }) }; g()`, &object.Integer{Value: 7}},
+		{`let k = 1; let f = fn(x) { x + k }; let k = 2; let h = fn() { f(0) }; h()`, &object.Integer{Value: 1}},
+		{`let len = fn(x) { 0 }; let f = fn(x) { len(x) }; let g = fn() { f("ab") }; g()`, &object.Integer{Value: 0}},
+		{`let inc = fn(a) { a + 1 }; let g = fn(x) { inc(x) * inc(inc(x)) }; g(1)`, &object.Integer{Value: 6}},
+	}
+	//Inlined calls must give the same results as plain calls.
+	for _, inlining := range []bool{false, true} {
+		for _, tt := range tests {
+			comp := compiler.New()
+			comp.SetInlining(inlining)
+			err := comp.Compile(parse(tt.input))
+			if err != nil {
+				t.Fatalf("compiler failed to compile: (error: %s)", err)
+			}
+			sut := vm.New(comp.Bytecode())
+			err = sut.Run()
+			if err != nil {
+				t.Fatalf("vm failed to run: (error: %s)", err)
+			}
+			assert.Equal(t, tt.want, sut.LastPoppedStackElem(), "inlining=%t: %s", inlining, tt.input)
+		}
+	}
+}
+
+func TestInliningWithHostGlobals(t *testing.T) {
+	input := `let f = fn(x) { x + 1 }; let g = fn(x) { x * 10 }; let call = fn() { f(1) };`
+	tests := []struct {
+		inlining bool
+		want     int64
+	}{
+		//By default, calls of globals see the functions the host stores into them.
+		{inlining: false, want: 10},
+		//Inlining is only for programs whose globals the host leaves alone: the inlined f is kept.
+		{inlining: true, want: 2},
+	}
+	for _, tt := range tests {
+		comp := compiler.New()
+		comp.SetInlining(tt.inlining)
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler failed to compile: (error: %s)", err)
+		}
+		globals := make([]object.Object, vm.GlobalSize)
+		sut := vm.NewWithGlobalStore(comp.Bytecode(), globals)
+		err = sut.Run()
+		if err != nil {
+			t.Fatalf("vm failed to run: (error: %s)", err)
+		}
+		globals[0] = globals[1]
+		got, err := sut.Call(globals[2])
+		if err != nil {
+			t.Fatalf("vm failed to call: (error: %s)", err)
+		}
+		assert.Equal(t, &object.Integer{Value: tt.want}, got, "inlining=%t", tt.inlining)
+	}
+}
+
+func TestInliningAtLocalLimit(t *testing.T) {
+	var body strings.Builder
+	for i := range 253 {
+		fmt.Fprintf(&body, "let v%s = x + 1; ", strings.Repeat("a", i+1))
+	}
+	input := fmt.Sprintf("let add = fn(a, b) { a + b }; let g = fn(x) { %s add(x, vaaa) }; g(1)", body.String())
+	for _, inlining := range []bool{false, true} {
+		comp := compiler.New()
+		comp.SetInlining(inlining)
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler failed to compile: (error: %s)", err)
+		}
+		sut := vm.New(comp.Bytecode())
+		err = sut.Run()
+		if err != nil {
+			t.Fatalf("vm failed to run: (error: %s)", err)
+		}
+		assert.Equal(t, &object.Integer{Value: 3}, sut.LastPoppedStackElem(), "inlining=%t", inlining)
+	}
+}
+
+func BenchmarkInlining(b *testing.B) {
+	input := `let add = fn(a, b) { a + b }; let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, add(acc, n)) } };
+		let run = fn() { sum(500, 0) };`
+	for _, inlining := range []bool{false, true} {
+		b.Run(fmt.Sprintf("inlining=%t", inlining), func(b *testing.B) {
+			comp := compiler.New()
+			comp.SetInlining(inlining)
+			err := comp.Compile(parse(input))
+			if err != nil {
+				b.Fatalf("compiler failed to compile: (error: %s)", err)
+			}
+			run, _ := comp.SymbolTable().Resolve("run")
+			globals := make([]object.Object, vm.GlobalSize)
+			sut := vm.NewWithGlobalStore(comp.Bytecode(), globals)
+			err = sut.Run()
+			if err != nil {
+				b.Fatalf("vm failed to run: (error: %s)", err)
+			}
+			b.ResetTimer()
+			for range b.N {
+				_, err := sut.Call(globals[run.Index])
+				if err != nil {
+					b.Fatalf("vm failed to call: (error: %s)", err)
+				}
+			}
+		})
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{`let count = fn(n) { if (n == 0) { "done" } else { count(n - 1) } }; count(100000)`, &object.String{Value: "done"}},
+		{`let sum = fn(n, acc) { if (n == 0) { return acc; } return sum(n - 1, acc + n); }; sum(10000, 0)`, &object.Integer{Value: 50005000}},
+		{
+			`let even = fn(n, odd) { if (n == 0) { true } else { odd(n - 1, even) } };
+			let odd = fn(n, even) { if (n == 0) { false } else { even(n - 1, odd) } };
+			[even(100001, odd), odd(100001, even)]`,
+			&object.Array{Elements: []object.Object{vm.False, vm.True}},
+		},
+		{`let f = params(fn(n, acc) { if (n == 0) { acc } else { f(n - 1, acc + 1) } }, {"acc": 0}); f(5000)`, &object.Integer{Value: 5000}},
+		{`let f = fn(n) { if (n == 0) { throw(n) } else { f(n - 1) } }; try(fn() { f(5000) }, fn(e) { e + 1 })`, &object.Integer{Value: 1}},
+		{`let f = fn(a) { a }; [1, try(fn() { f(1, 2) }, fn(e) { 7 }), 3]`, &object.Array{Elements: []object.Object{
+			&object.Integer{Value: 1}, &object.Integer{Value: 7}, &object.Integer{Value: 3},
+		}}},
+		{`let f = fn(x) { len(x) }; let g = fn(x) { f(x) }; g("abc") + 1`, &object.Integer{Value: 4}},
+		{`let call = fn(f, x) { if (x) { f(x) } else { 0 } }; call(len, "abc")`, &object.Integer{Value: 3}},
+	}
+	runVmTests(t, tests)
+
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn(a) { a }; let g = fn() { f(1, 2) }; g()`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	err = vm.New(comp.Bytecode()).Run()
+	assert.EqualError(t, err, "wrong number of args: (got=2, want=1)")
+
+	comp = compiler.New()
+	err = comp.Compile(parse(`let count = fn(n) { if (n == 0) { "done" } else { count(n - 1) } };`))
+	if err != nil {
+		t.Fatalf("compiler failed to compile: (error: %s)", err)
+	}
+	globals := make([]object.Object, vm.GlobalSize)
+	sut := vm.NewWithGlobalStore(comp.Bytecode(), globals)
+	err = sut.Run()
+	if err != nil {
+		t.Fatalf("vm failed to run: (error: %s)", err)
+	}
+	got, err := sut.Call(globals[0], &object.Integer{Value: 5000})
+	assert.NoError(t, err)
+	assert.Equal(t, &object.String{Value: "done"}, got)
+}